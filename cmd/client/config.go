@@ -0,0 +1,222 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"sync/atomic"
+
+	"gopkg.in/yaml.v3"
+
+	"portkey/internal/rewrite"
+	"portkey/internal/tunnel"
+)
+
+var (
+    configFile = flag.String("config", "portkey.yaml", "Tunnel config file for 'portkey-client start'")
+    startAll   = flag.Bool("all", false, "With 'start': start every tunnel in the config file")
+)
+
+// config is the file read by "portkey-client start". Server, auth token,
+// transport, pool and the inspector's address apply unless given on the
+// command line.
+//
+//	server: https://tunnel.example.com
+//	auth_token: secret
+//	tunnels:
+//	  api:
+//	    port: 8080            # subdomain defaults to the tunnel name
+//	  web:
+//	    port: 3000
+//	    routes:               # longest matching path prefix wins
+//	      - path: /api/
+//	        port: 8000
+//	        strip_prefix: true
+//	    headers:
+//	      request: ["set Host: app.local", "remove Origin"]
+//	  reports:
+//	    port: 8081
+//	    request_timeout: 5m   # the server caps these
+//	    max_response_body: 2GB
+//	  grpc:
+//	    subdomain: rpc
+//	    port: 9090
+//	    upstream_proto: h2c
+//	  db:
+//	    type: tcp
+//	    port: 5432
+type config struct {
+    Server    string                  `yaml:"server"`
+    AuthToken string                  `yaml:"auth_token"`
+    Transport string                  `yaml:"transport"`
+    Pool      bool                    `yaml:"pool"`
+    Inspect   string                  `yaml:"inspect"`
+    Tunnels   map[string]tunnelConfig `yaml:"tunnels"`
+}
+
+// tunnelConfig is one named tunnel in the config file.
+type tunnelConfig struct {
+    Type            string        `yaml:"type"`
+    Subdomain       string        `yaml:"subdomain"`
+    Host            string        `yaml:"host"`
+    Port            int           `yaml:"port"`
+    Routes          []routeConfig `yaml:"routes"`
+    Headers         headerConfig  `yaml:"headers"`
+    upstreamOptions `yaml:",inline"`
+    limitOptions    `yaml:",inline"`
+}
+
+// headerConfig lists a tunnel's header rules, e.g. "set Host: app.local" or
+// "remove Origin"; see package rewrite.
+type headerConfig struct {
+    Request  []string `yaml:"request"`
+    Response []string `yaml:"response"`
+}
+
+// localTunnel is one tunnel this client serves and where its traffic goes.
+type localTunnel struct {
+    name      string // empty for the single tunnel given by flags
+    kind      string
+    // sub is the subdomain asked for, then the one the server bound, kept
+    // for reconnects. Set by a connection's read loop while handlers and the
+    // next connection read it; see subdomain.
+    sub       atomic.Pointer[string]
+    addr      string      // local host:port
+    routes    []pathRoute   // path prefixes sent elsewhere; HTTP tunnels only
+    rules     rewrite.Rules // header rewrites; HTTP tunnels only
+    limits    url.Values    // timeouts and body limits asked of the server; HTTP tunnels only
+    up        *upstream     // HTTP tunnels only
+    log       *log.Logger
+}
+
+// newLocalTunnel checks tc and prepares the tunnel called name.
+func newLocalTunnel(name string, tc tunnelConfig) (*localTunnel, error) {
+    t := &localTunnel{name: name, kind: tc.Type, log: log.Default()}
+    t.setSubdomain(tc.Subdomain)
+    if name != "" {
+        t.log = log.New(os.Stderr, "["+name+"] ", log.LstdFlags|log.Lmsgprefix)
+    }
+    if t.kind == "" {
+        t.kind = tunnel.KindHTTP
+    }
+    if t.kind == tunnel.KindHTTP && t.subdomain() == "" {
+        t.setSubdomain(name)
+    }
+    switch t.kind {
+    case tunnel.KindHTTP:
+        // Without a subdomain the server picks one.
+        up, err := newUpstream(tc.upstreamOptions)
+        if err != nil {
+            return nil, fmt.Errorf("upstream: %v", err)
+        }
+        t.up = up
+        if t.rules, err = rewrite.ParseAll(tc.Headers.Request, tc.Headers.Response); err != nil {
+            return nil, err
+        }
+        t.limits = tc.limitOptions.values()
+    case tunnel.KindTCP, tunnel.KindUDP:
+        if len(tc.Routes) > 0 || len(tc.Headers.Request) > 0 || len(tc.Headers.Response) > 0 {
+            return nil, fmt.Errorf("routes and header rules only apply to http tunnels")
+        }
+        if len(tc.limitOptions.values()) > 0 {
+            return nil, fmt.Errorf("timeouts and body limits only apply to http tunnels")
+        }
+    default:
+        return nil, fmt.Errorf("unknown type %q (want http, tcp or udp)", t.kind)
+    }
+    if tc.Port == 0 {
+        return nil, fmt.Errorf("missing port")
+    }
+    host := tc.Host
+    if host == "" {
+        host = "localhost"
+    }
+    t.addr = net.JoinHostPort(host, strconv.Itoa(tc.Port))
+    routes, err := newPathRoutes(tc.Routes, host)
+    if err != nil {
+        return nil, err
+    }
+    t.routes = routes
+    return t, nil
+}
+
+// loadTunnels reads the config file and prepares the tunnels named, or all of
+// them. Settings the file gives are applied to the flags not set explicitly.
+func loadTunnels(path string, all bool, names []string) (map[string]*localTunnel, error) {
+    raw, err := os.ReadFile(path)
+    if err != nil {
+        return nil, err
+    }
+    var cfg config
+    if err := yaml.Unmarshal(raw, &cfg); err != nil {
+        return nil, fmt.Errorf("%s: %v", path, err)
+    }
+    set := map[string]bool{}
+    flag.Visit(func(f *flag.Flag) { set[f.Name] = true })
+    for name, v := range map[string]string{"server": cfg.Server, "auth-token": cfg.AuthToken, "transport": cfg.Transport, "inspect": cfg.Inspect} {
+        if v != "" && !set[name] {
+            flag.Set(name, v)
+        }
+    }
+    if cfg.Pool && !set["pool"] {
+        flag.Set("pool", "true")
+    }
+
+    if all {
+        if len(names) > 0 {
+            return nil, fmt.Errorf("give tunnel names or --all, not both")
+        }
+        for name := range cfg.Tunnels {
+            names = append(names, name)
+        }
+        sort.Strings(names)
+    }
+    if len(names) == 0 {
+        return nil, fmt.Errorf("no tunnels to start: name some, or use --all")
+    }
+    tunnels := make(map[string]*localTunnel, len(names))
+    for _, name := range names {
+        tc, ok := cfg.Tunnels[name]
+        if !ok {
+            return nil, fmt.Errorf("%s: no tunnel named %q", path, name)
+        }
+        t, err := newLocalTunnel(name, tc)
+        if err != nil {
+            return nil, fmt.Errorf("tunnel %s: %v", name, err)
+        }
+        tunnels[name] = t
+    }
+    return tunnels, nil
+}
+
+// vars are the values header rule templates can use for req, sent to addr.
+func (t *localTunnel) vars(req tunnel.Request, addr string) rewrite.Vars {
+    ip, _, err := net.SplitHostPort(req.RemoteAddr)
+    if err != nil {
+        ip = req.RemoteAddr
+    }
+    sub := t.subdomain()
+    name := t.name
+    if name == "" {
+        name = sub
+    }
+    return rewrite.Vars{"visitor_ip": ip, "tunnel": name, "subdomain": sub, "local": addr}
+}
+
+// subdomain returns the tunnel's subdomain, empty until the server has picked
+// one if none was asked for.
+func (t *localTunnel) subdomain() string {
+    if s := t.sub.Load(); s != nil {
+        return *s
+    }
+    return ""
+}
+
+func (t *localTunnel) setSubdomain(s string) {
+    t.sub.Store(&s)
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"flag"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/gorilla/websocket"
+
+	"portkey/internal/logstore"
+	"portkey/webui"
+)
+
+var inspectAddr = flag.String("inspect", "127.0.0.1:4040", "Address to serve the local request inspector on (empty=disabled)")
+
+// inspected keeps the requests through this client's tunnels for the
+// inspector; nil when it isn't running.
+var inspected *logstore.Store
+
+// record adds a finished exchange to the inspector.
+func record(e logstore.Entry) {
+    if inspected != nil {
+        inspected.Add(e)
+    }
+}
+
+// startInspector serves the request log dashboard and its API on addr, like
+// the server's /ui/ but for this client's tunnels only and without a token.
+// A client that can't have the address (another one already does) runs
+// without it.
+func startInspector(addr string, tunnels map[string]*localTunnel) {
+    ln, err := net.Listen("tcp", addr)
+    if err != nil {
+        log.Printf("inspector disabled: %v", err)
+        return
+    }
+    inspected = logstore.New(1000)
+
+    mux := http.NewServeMux()
+    mux.Handle("/ui/", http.StripPrefix("/ui/", http.FileServer(http.FS(webui.Files))))
+    mux.Handle("/", http.RedirectHandler("/ui/", http.StatusFound))
+    requests := func(w http.ResponseWriter, r *http.Request) {
+        w.Header().Set("Content-Type", "application/json")
+        if id := strings.TrimPrefix(r.URL.Path, "/api/requests/"); id != r.URL.Path && id != "" {
+            e, ok := inspected.Get(id)
+            if !ok {
+                http.NotFound(w, r)
+                return
+            }
+            json.NewEncoder(w).Encode(e)
+            return
+        }
+        json.NewEncoder(w).Encode(inspected.All())
+    }
+    mux.HandleFunc("/api/requests", requests)
+    mux.HandleFunc("/api/requests/", requests)
+    mux.HandleFunc("/api/tunnels", func(w http.ResponseWriter, r *http.Request) {
+        names := make([]string, 0, len(tunnels))
+        for name, t := range tunnels {
+            names = append(names, cmp.Or(t.subdomain(), name, t.kind))
+        }
+        sort.Strings(names)
+        w.Header().Set("Content-Type", "application/json")
+        json.NewEncoder(w).Encode(names)
+    })
+    mux.HandleFunc("/api/ws", func(w http.ResponseWriter, r *http.Request) {
+        // The default origin check keeps other sites' pages out.
+        ws, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+        if err != nil {
+            return
+        }
+        defer ws.Close()
+        ch, cancel := inspected.Subscribe()
+        defer cancel()
+        go func() {
+            // Notice the page going away even while no requests come in.
+            for {
+                if _, _, err := ws.NextReader(); err != nil {
+                    cancel()
+                    return
+                }
+            }
+        }()
+        for e := range ch {
+            if ws.WriteJSON(e) != nil {
+                return
+            }
+        }
+    })
+
+    log.Printf("Inspect requests at http://%s/ui/", ln.Addr())
+    go http.Serve(ln, localOnly(mux))
+}
+
+// localOnly refuses requests addressed to a host name other than localhost,
+// so a site whose name is rebound to 127.0.0.1 can't read the inspector.
+func localOnly(h http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        host, _, err := net.SplitHostPort(r.Host)
+        if err != nil {
+            host = r.Host
+        }
+        if host != "localhost" && net.ParseIP(strings.Trim(host, "[]")) == nil {
+            http.Error(w, "forbidden", http.StatusForbidden)
+            return
+        }
+        h.ServeHTTP(w, r)
+    })
+}
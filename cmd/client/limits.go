@@ -0,0 +1,64 @@
+package main
+
+import (
+	"flag"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// Limits to ask the server for on the tunnel given by flags; config file
+// tunnels set these per tunnel instead. The server checks them, and caps them
+// at its own maximums.
+var (
+    requestTimeout  = flag.String("request-timeout", "", "How long the server waits for a response to start, e.g. 5m (default: the server's)")
+    idleTimeout     = flag.String("idle-timeout", "", "Abort a response that has sent nothing for this long, e.g. 1m (default: the server's)")
+    maxRequestBody  = flag.String("max-request-body", "", "Largest request body visitors may send, e.g. 10MB (default: the server's)")
+    maxResponseBody = flag.String("max-response-body", "", "Largest response body the server passes on, e.g. 1GB (default: the server's)")
+)
+
+// limitOptions are the timeouts and body size limits an HTTP tunnel asks for.
+type limitOptions struct {
+    RequestTimeout  string `yaml:"request_timeout"`
+    IdleTimeout     string `yaml:"idle_timeout"`
+    MaxRequestBody  string `yaml:"max_request_body"`
+    MaxResponseBody string `yaml:"max_response_body"`
+}
+
+// flagLimitOptions returns the limits given by flags.
+func flagLimitOptions() limitOptions {
+    return limitOptions{
+        RequestTimeout:  *requestTimeout,
+        IdleTimeout:     *idleTimeout,
+        MaxRequestBody:  *maxRequestBody,
+        MaxResponseBody: *maxResponseBody,
+    }
+}
+
+// values returns the limits that were set, as sent to the server.
+func (o limitOptions) values() url.Values {
+    v := url.Values{}
+    for key, val := range map[string]string{
+        "request_timeout":   o.RequestTimeout,
+        "idle_timeout":      o.IdleTimeout,
+        "max_request_body":  o.MaxRequestBody,
+        "max_response_body": o.MaxResponseBody,
+    } {
+        if val != "" {
+            v.Set(key, val)
+        }
+    }
+    return v
+}
+
+// describeLimits renders the limits a server granted, from a Binding's
+// Options, for the log.
+func describeLimits(options string) string {
+    v, _ := url.ParseQuery(options)
+    parts := make([]string, 0, len(v))
+    for key := range v {
+        parts = append(parts, key+"="+v.Get(key))
+    }
+    sort.Strings(parts)
+    return strings.Join(parts, " ")
+}
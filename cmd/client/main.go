@@ -1,17 +1,31 @@
 package main
 
 import (
-	"bytes"
+	"cmp"
+	"context"
+	"crypto/tls"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"log"
+	"math/rand/v2"
+	"net"
 	"net/http"
 	"net/url"
+	"os"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
 
+	"portkey/internal/logstore"
+	"portkey/internal/rewrite"
 	"portkey/internal/tunnel"
 )
 
@@ -19,91 +33,737 @@ var (
     port     = flag.Int("port", 3000, "Local port to expose")
     host     = flag.String("host", "localhost", "Local host running service")
     server   = flag.String("server", "http://localhost:8080", "Portkey server URL")
-    subdomain = flag.String("subdomain", "myapp", "Requested subdomain")
+    subdomain = flag.String("subdomain", "", "Requested subdomain (default: the server picks one)")
     authToken = flag.String("auth-token", "", "Auth token for server")
+    heartbeatInterval = flag.Duration("heartbeat-interval", 15*time.Second, "How often to ping the server (0=no heartbeats)")
+    heartbeatTimeout  = flag.Duration("heartbeat-timeout", 45*time.Second, "Give up on a server that has been silent this long")
+    transport    = flag.String("transport", "ws", "Tunnel transport: ws, or quic (falls back to ws if QUIC can't connect)")
+    quicPort     = flag.Int("quic-port", 4443, "Server UDP port for --transport=quic")
+    quicInsecure = flag.Bool("quic-insecure", false, "Skip verifying the server's QUIC certificate")
+    pool         = flag.Bool("pool", false, "Share the subdomain with other --pool clients, which take turns serving it")
+    force        = flag.Bool("force", false, "Take the subdomain over from another client using the same token")
 )
 
 func main() {
-    flag.Parse()
+    // "portkey-client tcp --port 5432" (or "udp") exposes a raw port, and
+    // "portkey-client start api web" (or "start --all") the tunnels named in
+    // the config file; without a subcommand the client tunnels HTTP as before.
+    kind := tunnel.KindHTTP
+    args := os.Args[1:]
+    if len(args) > 0 && (args[0] == tunnel.KindTCP || args[0] == tunnel.KindUDP || args[0] == "start") {
+        kind, args = args[0], args[1:]
+    }
+    flag.CommandLine.Parse(args)
+
+    var tunnels map[string]*localTunnel
+    if kind == "start" {
+        var err error
+        if tunnels, err = loadTunnels(*configFile, *startAll, flag.Args()); err != nil {
+            log.Fatal(err)
+        }
+        kind = tunnel.KindMulti
+    } else {
+        t, err := newLocalTunnel("", tunnelConfig{Type: kind, Subdomain: *subdomain, Host: *host, Port: *port, Routes: routeFlags, Headers: headerFlags, upstreamOptions: flagUpstreamOptions(), limitOptions: flagLimitOptions()})
+        if err != nil {
+            log.Fatal(err)
+        }
+        tunnels = map[string]*localTunnel{"": t}
+    }
+    if *transport != "ws" && *transport != "quic" {
+        log.Fatalf("unknown transport %q (want ws or quic)", *transport)
+    }
+    if *inspectAddr != "" {
+        startInspector(*inspectAddr, tunnels)
+    }
 
     u, err := url.Parse(*server)
     if err != nil {
         log.Fatalf("invalid server url: %v", err)
     }
 
-    log.Printf("Connecting to %s for subdomain %s (forwarding %s:%d)", *server, *subdomain, *host, *port)
+    switch kind {
+    case tunnel.KindMulti:
+        log.Printf("Connecting to %s for %d tunnels", *server, len(tunnels))
+        names := make([]string, 0, len(tunnels))
+        for name := range tunnels {
+            names = append(names, name)
+        }
+        sort.Strings(names)
+        for _, name := range names {
+            t := tunnels[name]
+            t.log.Printf("%s tunnel forwarding %s", strings.ToUpper(t.kind), t.addr)
+        }
+    case tunnel.KindHTTP:
+        if *subdomain == "" {
+            log.Printf("Connecting to %s for a new subdomain (forwarding %s:%d)", *server, *host, *port)
+        } else {
+            log.Printf("Connecting to %s for subdomain %s (forwarding %s:%d)", *server, *subdomain, *host, *port)
+        }
+    default:
+        log.Printf("Connecting to %s for a %s tunnel (forwarding %s:%d)", *server, strings.ToUpper(kind), *host, *port)
+    }
 
-    // Dial websocket
     wsURL := u
     wsURL.Scheme = strings.ReplaceAll(wsURL.Scheme, "http", "ws")
     wsURL.Path = "/connect"
     q := wsURL.Query()
-    q.Set("subdomain", *subdomain)
+    q.Set("type", kind)
     if *authToken != "" {
         q.Set("token", *authToken)
     }
-    wsURL.RawQuery = q.Encode()
+    // The session lets the server tell our reconnects from another client
+    // after the same subdomain.
+    q.Set("session", uuid.NewString())
+    if *pool {
+        q.Set("pool", "1")
+    }
+    if *force {
+        q.Set("force", "1")
+    }
+    if t := tunnels[""]; t != nil {
+        for key := range t.limits {
+            q.Set(key, t.limits.Get(key))
+        }
+    }
+
+    // Keep the tunnel up across server restarts and network blips. The server
+    // holds an HTTP subdomain for our token for a grace period meanwhile, so
+    // one it picked for us is asked for again by name.
+    for attempt := 0; ; attempt++ {
+        if kind == tunnel.KindHTTP {
+            q.Set("subdomain", tunnels[""].subdomain())
+        }
+        wsURL.RawQuery = q.Encode()
+        c, err := connect(wsURL)
+        if err == nil {
+            attempt = 0
+            c.tunnels = tunnels
+            err = c.run()
+        }
+        if err == errDraining {
+            continue // the old connection winds down by itself
+        }
+        var refused *refusedError
+        if errors.As(err, &refused) && refused.status < 500 {
+            log.Fatal(err)
+        }
+        d := backoff(attempt)
+        log.Printf("tunnel lost: %v; reconnecting in %s", err, d.Round(time.Millisecond))
+        time.Sleep(d)
+    }
+}
+
+// Reconnect delays grow from minBackoff up to maxBackoff.
+const (
+    minBackoff = 500 * time.Millisecond
+    maxBackoff = 30 * time.Second
+)
+
+// backoff returns the delay before reconnect attempt n (counting from 0): a
+// random duration in the upper half of an exponentially growing window, so
+// clients cut off together don't all return at once.
+func backoff(n int) time.Duration {
+    d := maxBackoff
+    if n < 16 {
+        d = min(minBackoff<<n, maxBackoff)
+    }
+    return d/2 + rand.N(d/2)
+}
+
+// refusedError is the server turning down the tunnel with an HTTP status.
+type refusedError struct {
+    status int
+    reason string
+}
+
+func (e *refusedError) Error() string {
+    return fmt.Sprintf("connect refused (%d %s): %s", e.status, http.StatusText(e.status), e.reason)
+}
+
+// boundRefusal turns a Binding's "status reason" Error into a refusedError.
+func boundRefusal(s string) error {
+    code, reason, _ := strings.Cut(s, " ")
+    status, err := strconv.Atoi(code)
+    if err != nil {
+        return errors.New(s)
+    }
+    return &refusedError{status: status, reason: reason}
+}
+
+// connection is one live tunnel to the server. Stream IDs are only meaningful
+// within a connection, so a reconnect starts afresh with a new one.
+type connection struct {
+    tc          tunnel.Transport
+    tunnels     map[string]*localTunnel // by name; "" when the flags give a single tunnel
+    inflight    sync.Map // stream id -> context.CancelCauseFunc of requests to the local service
+    sockets     sync.Map // stream id -> *localSocket
+    udpSessions sync.Map // session id -> *net.UDPConn
+    drained     chan struct{} // closed when the server says it is shutting down
+}
+
+// errDraining is returned by run when the server is shutting down.
+var errDraining = errors.New("server is shutting down")
+
+// run serves the connection until it fails, or until the server says it is
+// shutting down: then the connection finishes its requests in the background
+// and run returns errDraining at once, so a new one can take over.
+func (c *connection) run() error {
+    c.drained = make(chan struct{})
+    done := make(chan error, 1)
+    go func() { done <- c.serve() }()
+    select {
+    case err := <-done:
+        return err
+    case <-c.drained:
+        return errDraining
+    }
+}
+
+// connect opens a tunnel over the chosen transport. A QUIC connection that
+// can't be made (UDP blocked on the way, say) falls back to the WebSocket; a
+// refusal from the server does not.
+func connect(wsURL *url.URL) (*connection, error) {
+    if *transport == "quic" {
+        c, err := dialQUIC(net.JoinHostPort(wsURL.Hostname(), strconv.Itoa(*quicPort)), wsURL.RawQuery)
+        var refused *refusedError
+        if err == nil || errors.As(err, &refused) {
+            return c, err
+        }
+        log.Printf("quic: %v; falling back to websocket", err)
+    }
+    return dial(wsURL.String())
+}
+
+func dialQUIC(addr, query string) (*connection, error) {
+    ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+    defer cancel()
+    tlsConf := &tls.Config{NextProtos: []string{tunnel.QUICProtocol}, InsecureSkipVerify: *quicInsecure}
+    tc, err := tunnel.DialQUIC(ctx, addr, tlsConf, tunnel.NewQUICConfig(*heartbeatInterval, *heartbeatTimeout), query)
+    if err != nil {
+        var refused *tunnel.ConnectError
+        if errors.As(err, &refused) {
+            return nil, &refusedError{status: refused.Status, reason: refused.Reason}
+        }
+        return nil, err
+    }
+    log.Printf("Tunnel established over QUIC, waiting for requests ...")
+    go followRoute(tc, addr)
+    return &connection{tc: tc}, nil
+}
+
+// routeCheckInterval is how often a QUIC tunnel checks for a network change.
+const routeCheckInterval = 2 * time.Second
+
+// followRoute migrates a QUIC tunnel to a new socket when the local address
+// the server is reached from changes, as when a laptop moves from Wi-Fi to a
+// wired network, so the tunnel and the requests on it carry on.
+func followRoute(tc *tunnel.QUICSession, addr string) {
+    ticker := time.NewTicker(routeCheckInterval)
+    defer ticker.Stop()
+    from := localIPFor(addr)
+    for {
+        select {
+        case <-ticker.C:
+        case <-tc.Done():
+            return
+        }
+        to := localIPFor(addr)
+        if to == "" || to == from {
+            continue
+        }
+        log.Printf("network changed (%s -> %s); migrating the QUIC connection", from, to)
+        ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+        err := tc.Migrate(ctx)
+        cancel()
+        if err != nil {
+            // Tried again on the next tick, unless the connection times out first.
+            log.Printf("quic migration: %v", err)
+            continue
+        }
+        from = to
+    }
+}
+
+// localIPFor returns the local IP the system would send to addr from, or ""
+// if there is no route. Nothing is sent.
+func localIPFor(addr string) string {
+    c, err := net.Dial("udp", addr)
+    if err != nil {
+        return ""
+    }
+    defer c.Close()
+    return c.LocalAddr().(*net.UDPAddr).IP.String()
+}
+
+func dial(wsURL string) (*connection, error) {
+    offer := http.Header{tunnel.ProtocolHeader: {strconv.Itoa(tunnel.ProtocolVersion)}}
+    ws, resp, err := websocket.DefaultDialer.Dial(wsURL, offer)
+    if err != nil {
+        if resp != nil {
+            // The server refused the tunnel; its reason is in the body.
+            reason, _ := io.ReadAll(resp.Body)
+            return nil, &refusedError{status: resp.StatusCode, reason: strings.TrimSpace(string(reason))}
+        }
+        return nil, err
+    }
+    // Servers that predate negotiation don't answer the header and speak JSON.
+    tc := tunnel.NewSession(ws, tunnel.NegotiateVersion(resp.Header.Get(tunnel.ProtocolHeader)))
+    tc.Heartbeat(*heartbeatInterval, *heartbeatTimeout)
+    log.Printf("Tunnel established (protocol v%d), waiting for requests ...", tc.Version())
+    return &connection{tc: tc}, nil
+}
+
+// serve runs the read loop until the connection fails, then abandons whatever
+// was still in flight on it.
+func (c *connection) serve() error {
+    tc := c.tc
+    bodies := make(map[uint32]*inbound) // stream id -> body from the server, owned by the read loop
+    defer func() {
+        tc.Close()
+        for _, in := range bodies {
+            in.pw.CloseWithError(io.ErrUnexpectedEOF)
+        }
+        c.inflight.Range(func(k, v any) bool {
+            c.inflight.Delete(k)
+            v.(context.CancelCauseFunc)(errors.New("tunnel lost"))
+            return true
+        })
+        c.sockets.Range(func(_, v any) bool {
+            close(v.(*localSocket).frames) // the read loop was the only sender
+            return true
+        })
+        c.udpSessions.Range(func(k, v any) bool {
+            c.udpSessions.Delete(k)
+            v.(*net.UDPConn).Close()
+            return true
+        })
+    }()
+    // Named tunnels share the connection, and are each asked for in turn.
+    for name, t := range c.tunnels {
+        if name == "" {
+            continue
+        }
+        bind := tunnel.Binding{Name: name, Kind: t.kind, Subdomain: t.subdomain(), Options: t.limits.Encode()}
+        if err := tc.WriteMessage(tunnel.Message{Type: tunnel.TypeBind, Bound: &bind}); err != nil {
+            return err
+        }
+    }
+    for {
+        msg, err := tc.ReadMessage()
+        if err != nil {
+            return err
+        }
+
+        switch msg.Type {
+        case tunnel.TypeBound:
+            t := c.tunnels[msg.Bound.Name]
+            if t == nil {
+                continue
+            }
+            if msg.Bound.Error != "" && t.name == "" {
+                return boundRefusal(msg.Bound.Error)
+            } else if msg.Bound.Error != "" {
+                t.log.Printf("refused by server: %s", msg.Bound.Error)
+            } else {
+                if msg.Bound.Subdomain != "" {
+                    t.setSubdomain(msg.Bound.Subdomain) // kept for reconnects
+                }
+                for _, r := range t.routes {
+                    t.log.Printf("Forwarding %s%s -> %s", msg.Bound.URL, r.prefix, r.addr)
+                }
+                t.log.Printf("Forwarding %s -> %s", msg.Bound.URL, t.addr)
+                if len(t.limits) > 0 {
+                    t.log.Printf("Limits: %s", describeLimits(msg.Bound.Options))
+                }
+            }
+        case tunnel.TypeRequest:
+            pr, pw := tc.Pipe(msg.Request.ID)
+            in := &inbound{pw: pw}
+            bodies[msg.Request.ID] = in
+            // Registered here rather than in the handler so a Cancel can't overtake it.
+            ctx, cancel := context.WithCancelCause(context.Background())
+            c.inflight.Store(msg.Request.ID, cancel)
+            go c.handleRequest(ctx, c.tunnelFor(msg.Request.Tunnel, tunnel.KindHTTP), *msg.Request, pr, in)
+        case tunnel.TypeTCPOpen:
+            pr, pw := tc.Pipe(msg.Request.ID)
+            bodies[msg.Request.ID] = &inbound{pw: pw}
+            go c.handleTCP(c.tunnelFor(msg.Request.Tunnel, tunnel.KindTCP), *msg.Request, pr)
+        case tunnel.TypeWSOpen:
+            sock := &localSocket{frames: make(chan tunnel.WSFrame, 64), done: make(chan struct{})}
+            c.sockets.Store(msg.Request.ID, sock)
+            // Registered here for the same reason as a request's.
+            ctx, cancel := context.WithCancelCause(context.Background())
+            c.inflight.Store(msg.Request.ID, cancel)
+            go c.handleWebSocket(ctx, c.tunnelFor(msg.Request.Tunnel, tunnel.KindHTTP), *msg.Request, sock)
+        case tunnel.TypeWSFrame:
+            if v, ok := c.sockets.Load(msg.Frame.ID); ok {
+                sock := v.(*localSocket)
+                select {
+                case sock.frames <- *msg.Frame:
+                case <-sock.done:
+                default:
+                    // Waiting for a local service that stopped reading would
+                    // hold up every other stream; end this one instead.
+                    log.Printf("websocket %d: local service not reading, closing", msg.Frame.ID)
+                    c.sockets.Delete(msg.Frame.ID)
+                    close(sock.frames)
+                }
+            }
+        case tunnel.TypeData:
+            in, ok := bodies[msg.Data.ID]
+            if !ok {
+                tc.Discard(msg.Data.ID, len(msg.Data.Body))
+                continue
+            }
+            if len(msg.Data.Body) > 0 {
+                in.pw.Write(msg.Data.Body)
+            }
+            if msg.Data.End {
+                in.setTrailers(msg.Data.Trailers)
+                in.pw.Close()
+                delete(bodies, msg.Data.ID)
+            }
+        case tunnel.TypeReset:
+            if in, ok := bodies[msg.Reset.ID]; ok {
+                in.pw.CloseWithError(fmt.Errorf("stream reset by server: %s", msg.Reset.Reason))
+                delete(bodies, msg.Reset.ID)
+            } else if v, ok := c.udpSessions.LoadAndDelete(msg.Reset.ID); ok {
+                v.(*net.UDPConn).Close()
+            }
+        case tunnel.TypeCancel:
+            if v, ok := c.inflight.LoadAndDelete(msg.Reset.ID); ok {
+                v.(context.CancelCauseFunc)(fmt.Errorf("cancelled by server: %s", msg.Reset.Reason))
+            }
+            if in, ok := bodies[msg.Reset.ID]; ok {
+                in.pw.CloseWithError(context.Canceled)
+                delete(bodies, msg.Reset.ID)
+            }
+            if v, ok := c.sockets.LoadAndDelete(msg.Reset.ID); ok {
+                close(v.(*localSocket).frames) // the read loop was the only sender
+            }
+        case tunnel.TypeDatagram:
+            c.handleDatagram(*msg.Datagram)
+        case tunnel.TypeDrain:
+            select {
+            case <-c.drained:
+            default:
+                log.Printf("Server is draining (%s); reconnecting while requests in flight finish", msg.Reset.Reason)
+                close(c.drained)
+            }
+        }
+    }
+}
+
+// tunnelFor returns the tunnel a stream was opened for, or nil if this client
+// doesn't serve one by that name and kind.
+func (c *connection) tunnelFor(name, kind string) *localTunnel {
+    if t := c.tunnels[name]; t != nil && t.kind == kind {
+        return t
+    }
+    return nil
+}
+
+// errNoTunnel answers streams for a tunnel this client doesn't serve.
+var errNoTunnel = errors.New("no such tunnel on this client")
+
+// inbound is a body streaming in from the server.
+type inbound struct {
+    pw *tunnel.PipeWriter
 
-    conn, _, err := websocket.DefaultDialer.Dial(wsURL.String(), nil)
+    mu sync.Mutex
+    // trailers come with the End chunk, set by the read loop before pw is
+    // closed and handed to net/http by trailerBody once the body is read.
+    trailers tunnel.Header
+}
+
+func (in *inbound) setTrailers(h tunnel.Header) {
+    in.mu.Lock()
+    defer in.mu.Unlock()
+    in.trailers = h
+}
+
+// trailerBody is a request body that fills in its request's declared trailers
+// when it reaches EOF. net/http reads Request.Trailer on the goroutine reading
+// the body, and may look at it before then, so that is the only safe place to
+// write it.
+type trailerBody struct {
+    io.Reader
+    io.Closer
+    in      *inbound
+    trailer http.Header // the request's Trailer, holding the declared names
+}
+
+func (b *trailerBody) Read(p []byte) (int, error) {
+    n, err := b.Reader.Read(p)
+    if err == io.EOF {
+        b.in.mu.Lock()
+        for _, f := range b.in.trailers {
+            k := http.CanonicalHeaderKey(f.Name)
+            if _, declared := b.trailer[k]; declared {
+                b.trailer[k] = append(b.trailer[k], f.Value)
+            }
+        }
+        b.in.trailers = nil
+        b.in.mu.Unlock()
+    }
+    return n, err
+}
+
+// handleTCP dials the local service for one visitor connection and pipes bytes
+// both ways; in carries what the visitor sends, fed by the read loop.
+func (c *connection) handleTCP(t *localTunnel, req tunnel.Request, in *tunnel.PipeReader) {
+    defer in.CloseWithError(io.ErrClosedPipe)
+    if t == nil {
+        c.tc.WriteMessage(tunnel.Message{Type: tunnel.TypeReset, Reset: &tunnel.Reset{ID: req.ID, Reason: errNoTunnel.Error()}})
+        return
+    }
+
+    local, err := net.Dial("tcp", t.addr)
     if err != nil {
-        log.Fatalf("dial error: %v", err)
+        t.log.Printf("local tcp error: %v", err)
+        c.tc.WriteMessage(tunnel.Message{Type: tunnel.TypeReset, Reset: &tunnel.Reset{ID: req.ID, Reason: err.Error()}})
+        return
     }
-    defer conn.Close()
+    defer local.Close()
+    t.log.Printf("tcp connection from %s", req.RemoteAddr)
 
-    log.Printf("Tunnel established, waiting for requests ...")
+    upDone := make(chan struct{})
+    go func() {
+        defer close(upDone)
+        tunnel.SendBody(req.ID, local, nil, c.tc.WriteMessage)
+    }()
+    if _, err := io.Copy(local, in); err != nil {
+        local.Close()
+    } else if tc, ok := local.(*net.TCPConn); ok {
+        tc.CloseWrite()
+    }
+    <-upDone
+}
+
+// handleDatagram forwards a visitor datagram to the local service, opening a
+// socket for the session on first use so replies find their way back.
+func (c *connection) handleDatagram(dg tunnel.Datagram) {
+    if v, ok := c.udpSessions.Load(dg.Session); ok {
+        v.(*net.UDPConn).Write(dg.Payload)
+        return
+    }
+    t := c.tunnelFor(dg.Tunnel, tunnel.KindUDP)
+    if t == nil {
+        c.tc.WriteMessage(tunnel.Message{Type: tunnel.TypeReset, Reset: &tunnel.Reset{ID: dg.Session, Reason: errNoTunnel.Error()}})
+        return
+    }
+    raddr, err := net.ResolveUDPAddr("udp", t.addr)
+    if err == nil {
+        var local *net.UDPConn
+        if local, err = net.DialUDP("udp", nil, raddr); err == nil {
+            c.udpSessions.Store(dg.Session, local)
+            if dg.RemoteAddr != "" {
+                t.log.Printf("udp session from %s", dg.RemoteAddr)
+            }
+            local.Write(dg.Payload)
+            go c.relayUDPReplies(dg.Session, local)
+            return
+        }
+    }
+    t.log.Printf("local udp error: %v", err)
+    c.tc.WriteMessage(tunnel.Message{Type: tunnel.TypeReset, Reset: &tunnel.Reset{ID: dg.Session, Reason: err.Error()}})
+}
 
+// relayUDPReplies sends whatever the local service answers back to the
+// session's visitor until the server expires the session and the socket is closed.
+func (c *connection) relayUDPReplies(session uint32, local *net.UDPConn) {
+    buf := make([]byte, 64*1024)
     for {
-        var req tunnel.Request
-        if err := conn.ReadJSON(&req); err != nil {
-            log.Fatalf("read: %v", err)
+        n, err := local.Read(buf)
+        if err != nil {
+            if _, live := c.udpSessions.LoadAndDelete(session); live {
+                // Still registered, so this is a local failure rather than expiry.
+                local.Close()
+                c.tc.WriteMessage(tunnel.Message{Type: tunnel.TypeReset, Reset: &tunnel.Reset{ID: session, Reason: err.Error()}})
+            }
+            return
+        }
+        payload := make([]byte, n)
+        copy(payload, buf[:n])
+        if err := c.tc.WriteMessage(tunnel.Message{Type: tunnel.TypeDatagram, Datagram: &tunnel.Datagram{Session: session, Payload: payload}}); err != nil {
+            return
         }
+    }
+}
 
-        go handleRequest(conn, req)
+// localSocket is a WebSocket relayed to the local service.
+type localSocket struct {
+    frames chan tunnel.WSFrame
+    done   chan struct{}
+}
+
+// handleWebSocket dials the local service's WebSocket endpoint, reports the
+// handshake result to the server and relays frames until either side closes.
+func (c *connection) handleWebSocket(ctx context.Context, t *localTunnel, req tunnel.Request, sock *localSocket) {
+    defer func() {
+        c.sockets.Delete(req.ID)
+        close(sock.done)
+    }()
+    defer func() {
+        if v, ok := c.inflight.LoadAndDelete(req.ID); ok {
+            v.(context.CancelCauseFunc)(nil)
+        }
+    }()
+    if t == nil {
+        c.sendError(req.ID, errNoTunnel)
+        return
+    }
+
+    addr, path := t.target(req.Path)
+    target := t.up.url(addr, true, path)
+    h := req.Headers.HTTP()
+    tunnel.StripHandshakeHeaders(h)
+    host := addr
+    if t.up.opts.Host != "" {
+        host = t.up.opts.Host
+    }
+    rewrite.Apply(t.rules.Request, h, &host, t.vars(req, addr))
+    if host != addr {
+        h.Set("Host", host)
+    }
+
+    ws, resp, err := t.up.dialWebSocket(ctx, target, h)
+    if err != nil && ctx.Err() != nil {
+        t.log.Printf("websocket %s %v", req.Path, context.Cause(ctx))
+        return
+    }
+    if err != nil {
+        t.log.Printf("local websocket error: %v", err)
+        if resp == nil {
+            c.sendError(req.ID, err)
+            return
+        }
+        // The local service answered the handshake without upgrading; pass it on.
+        defer resp.Body.Close()
+        headers := tunnel.HeaderFrom(resp.Header, nil)
+        record(logstore.Entry{ID: uuid.NewString(), Subdomain: t.subdomain(), Method: req.Method, Path: req.Path, Status: resp.StatusCode, ClientIP: t.vars(req, addr)["visitor_ip"],
+            Timestamp: time.Now(), Headers: req.Headers, ResponseHeaders: headers})
+        c.tc.WriteMessage(tunnel.Message{Type: tunnel.TypeResponse, Response: &tunnel.Response{ID: req.ID, Status: resp.StatusCode, Headers: headers}})
+        tunnel.SendBody(req.ID, resp.Body, nil, c.tc.WriteMessage)
+        return
+    }
+
+    var headers tunnel.Header
+    if p := ws.Subprotocol(); p != "" {
+        headers = append(headers, tunnel.HeaderField{Name: "Sec-Websocket-Protocol", Value: p})
+    }
+    for _, cookie := range resp.Header.Values("Set-Cookie") {
+        headers = append(headers, tunnel.HeaderField{Name: "Set-Cookie", Value: cookie})
+    }
+    if err := c.tc.WriteMessage(tunnel.Message{Type: tunnel.TypeResponse, Response: &tunnel.Response{ID: req.ID, Status: http.StatusSwitchingProtocols, Headers: headers}}); err != nil {
+        ws.Close()
+        return
     }
+    record(logstore.Entry{ID: uuid.NewString(), Subdomain: t.subdomain(), Method: req.Method, Path: req.Path, Status: http.StatusSwitchingProtocols, ClientIP: t.vars(req, addr)["visitor_ip"],
+        Timestamp: time.Now(), Headers: req.Headers, ResponseHeaders: headers})
+    tunnel.RelayWebSocket(req.ID, ws, sock.frames, c.tc.WriteMessage, nil)
 }
 
-func handleRequest(conn *websocket.Conn, req tunnel.Request) {
-    // Forward to local server
-    target := fmt.Sprintf("http://%s:%d%s", *host, *port, req.Path)
-    httpReq, err := http.NewRequest(req.Method, target, bytes.NewReader(req.Body))
+// discarded counts local responses dropped because the server cancelled them.
+var discarded atomic.Uint64
+
+func (c *connection) handleRequest(ctx context.Context, t *localTunnel, req tunnel.Request, body *tunnel.PipeReader, in *inbound) {
+    // Whatever happens, stop the read loop from blocking on a body we no longer read.
+    defer body.CloseWithError(io.ErrClosedPipe)
+    defer func() {
+        if v, ok := c.inflight.LoadAndDelete(req.ID); ok {
+            v.(context.CancelCauseFunc)(nil)
+        }
+    }()
+
+    if t == nil {
+        c.sendError(req.ID, errNoTunnel)
+        return
+    }
+
+    // Forward to local server, or the one its path is routed to
+    addr, path := t.target(req.Path)
+    target := t.up.url(addr, false, path)
+    var reqBody, respBody logstore.BodyCapture
+    // Still closed by the transport when it is done with it, as body alone would be.
+    trailer := req.Headers.DeclaredTrailers()
+    teed := &trailerBody{Reader: io.TeeReader(body, &reqBody), Closer: body, in: in, trailer: trailer}
+    httpReq, err := http.NewRequestWithContext(ctx, req.Method, target, teed)
     if err != nil {
-        log.Printf("build req: %v", err)
+        t.log.Printf("build req: %v", err)
+        c.sendError(req.ID, err)
         return
     }
-    for k, v := range req.Headers {
-        httpReq.Header.Set(k, v)
+    httpReq.Header = req.Headers.HTTP()
+    // The transport announces trailers itself from httpReq.Trailer.
+    httpReq.Header.Del("Trailer")
+    httpReq.Trailer = trailer
+    if t.up.opts.Host != "" {
+        httpReq.Host = t.up.opts.Host
+    }
+    vars := t.vars(req, addr)
+    // inspect shows the exchange in the inspector once it is over.
+    inspect := func(status int, headers tunnel.Header) {
+        record(logstore.Entry{ID: uuid.NewString(), Subdomain: t.subdomain(), Method: req.Method, Path: req.Path, Status: status, ClientIP: vars["visitor_ip"],
+            Timestamp: time.Now(), Headers: req.Headers, Body: reqBody.String(), ResponseHeaders: headers, ResponseBody: respBody.String()})
+    }
+    host := cmp.Or(httpReq.Host, addr)
+    rewrite.Apply(t.rules.Request, httpReq.Header, &host, vars)
+    httpReq.Host = host
+    if t.up.opts.Proto != "http1" {
+        for _, h := range hopHeaders {
+            httpReq.Header.Del(h)
+        }
+    }
+    if n, err := strconv.ParseInt(req.Headers.Get("Content-Length"), 10, 64); err == nil {
+        httpReq.ContentLength = n
+        if n == 0 {
+            httpReq.Body = http.NoBody
+        }
     }
 
-    resp, err := http.DefaultClient.Do(httpReq)
+    resp, err := t.up.client.Do(httpReq)
+    if err != nil && ctx.Err() != nil {
+        // Nobody is waiting for the answer any more.
+        t.log.Printf("%s %s %v, discarding (%d so far)", req.Method, req.Path, context.Cause(ctx), discarded.Add(1))
+        return
+    }
     if err != nil {
-        log.Printf("local request error: %v", err)
-        sendError(conn, req.ID, err)
+        t.log.Printf("local request error: %v", err)
+        c.sendError(req.ID, err)
+        respBody.Write([]byte(err.Error()))
+        inspect(http.StatusBadGateway, nil)
         return
     }
     defer resp.Body.Close()
-
-    body, _ := io.ReadAll(resp.Body)
-    headers := make(map[string]string)
-    for k, v := range resp.Header {
-        headers[k] = strings.Join(v, ";")
+    // Undeclared trailers (gRPC's status, say) are only filled into a map
+    // that already exists when the body ends.
+    if resp.Trailer == nil {
+        resp.Trailer = make(http.Header)
     }
+
+    rewrite.Apply(t.rules.Response, resp.Header, nil, vars)
     resMsg := tunnel.Response{
-        ID:     req.ID,
-        Status: resp.StatusCode,
-        Headers: headers,
-        Body:   body,
+        ID:      req.ID,
+        Status:  resp.StatusCode,
+        Headers: tunnel.HeaderFrom(resp.Header, resp.Trailer),
+    }
+    if err := c.tc.WriteMessage(tunnel.Message{Type: tunnel.TypeResponse, Response: &resMsg}); err != nil {
+        t.log.Printf("write back: %v", err)
+        return
     }
-    if err := conn.WriteJSON(resMsg); err != nil {
-        log.Printf("write back: %v", err)
+    if err := tunnel.SendBody(req.ID, io.TeeReader(resp.Body, &respBody), resp.Trailer, c.tc.WriteMessage); err != nil && ctx.Err() == nil {
+        t.log.Printf("stream body: %v", err)
     }
+    inspect(resp.StatusCode, resMsg.Headers)
 }
 
-func sendError(conn *websocket.Conn, id string, err error) {
+func (c *connection) sendError(id uint32, err error) {
     res := tunnel.Response{
-        ID:     id,
-        Status: 502,
-        Headers: map[string]string{"Content-Type": "text/plain"},
-        Body:   []byte(err.Error()),
+        ID:      id,
+        Status:  502,
+        Headers: tunnel.Header{{Name: "Content-Type", Value: "text/plain"}},
     }
-    conn.WriteJSON(res)
+    c.tc.WriteMessage(tunnel.Message{Type: tunnel.TypeResponse, Response: &res})
+    tunnel.SendBody(id, strings.NewReader(err.Error()), nil, c.tc.WriteMessage)
 }
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// routeFlags collects --route rules for the tunnel given by flags, and
+// headerFlags its header rules.
+var (
+    routeFlags  routeList
+    headerFlags headerConfig
+)
+
+func init() {
+    flag.Var(&routeFlags, "route", "Send a path prefix to another local service: PATH=[HOST:]PORT, with ',strip' to drop the prefix (repeatable)")
+    flag.Var((*stringList)(&headerFlags.Request), "request-header", "Header rule for requests to the local service, e.g. 'set Host: app.local' (repeatable)")
+    flag.Var((*stringList)(&headerFlags.Response), "response-header", "Header rule for the local service's responses, e.g. 'remove Server' (repeatable)")
+}
+
+// stringList is a repeatable string flag.
+type stringList []string
+
+func (l *stringList) String() string     { return strings.Join(*l, ", ") }
+func (l *stringList) Set(s string) error { *l = append(*l, s); return nil }
+
+// routeConfig sends requests under a path prefix to another local service,
+// in the config file or from --route.
+//
+//	routes:
+//	  - path: /api/
+//	    port: 8000
+//	    strip_prefix: true
+type routeConfig struct {
+    Path        string `yaml:"path"`
+    Host        string `yaml:"host"`
+    Port        int    `yaml:"port"`
+    StripPrefix bool   `yaml:"strip_prefix"`
+}
+
+// routeList is a flag.Value of --route rules.
+type routeList []routeConfig
+
+func (l *routeList) String() string {
+    if l == nil {
+        return ""
+    }
+    rules := make([]string, len(*l))
+    for i, r := range *l {
+        rules[i] = fmt.Sprintf("%s=%s:%d", r.Path, r.Host, r.Port)
+        if r.StripPrefix {
+            rules[i] += ",strip"
+        }
+    }
+    return strings.Join(rules, " ")
+}
+
+// Set parses "PATH=[HOST:]PORT[,strip]".
+func (l *routeList) Set(s string) error {
+    path, target, ok := strings.Cut(s, "=")
+    if !ok {
+        return fmt.Errorf("want PATH=[HOST:]PORT, got %q", s)
+    }
+    r := routeConfig{Path: path}
+    target, r.StripPrefix = strings.CutSuffix(target, ",strip")
+    port := target
+    if i := strings.LastIndex(target, ":"); i >= 0 {
+        r.Host, port = target[:i], target[i+1:]
+    }
+    var err error
+    if r.Port, err = strconv.Atoi(port); err != nil {
+        return fmt.Errorf("bad port in %q", s)
+    }
+    *l = append(*l, r)
+    return nil
+}
+
+// pathRoute is a prepared routeConfig.
+type pathRoute struct {
+    prefix string
+    strip  bool
+    addr   string // local host:port
+}
+
+// newPathRoutes checks rc and orders the routes longest prefix first, so the
+// most specific one matches. Routes without a host use defaultHost.
+func newPathRoutes(rc []routeConfig, defaultHost string) ([]pathRoute, error) {
+    routes := make([]pathRoute, 0, len(rc))
+    for _, r := range rc {
+        if !strings.HasPrefix(r.Path, "/") {
+            return nil, fmt.Errorf("route path %q must start with /", r.Path)
+        }
+        if r.Port == 0 {
+            return nil, fmt.Errorf("route %s: missing port", r.Path)
+        }
+        host := r.Host
+        if host == "" {
+            host = defaultHost
+        }
+        // "/api/*" reads naturally and means the same as "/api/".
+        prefix := strings.TrimSuffix(r.Path, "*")
+        routes = append(routes, pathRoute{prefix: prefix, strip: r.StripPrefix, addr: net.JoinHostPort(host, strconv.Itoa(r.Port))})
+    }
+    sort.SliceStable(routes, func(i, j int) bool { return len(routes[i].prefix) > len(routes[j].prefix) })
+    return routes, nil
+}
+
+// match reports whether path (which may carry a query) falls under the
+// route: "/api" matches "/api" and "/api/users", but not "/apiary".
+func (r pathRoute) match(path string) bool {
+    p, _, _ := strings.Cut(path, "?")
+    if !strings.HasPrefix(p, r.prefix) {
+        return false
+    }
+    return strings.HasSuffix(r.prefix, "/") || len(p) == len(r.prefix) || p[len(r.prefix)] == '/'
+}
+
+// target returns the local address a request for path goes to, and the path
+// to ask it for.
+func (t *localTunnel) target(path string) (addr, localPath string) {
+    for _, r := range t.routes {
+        if !r.match(path) {
+            continue
+        }
+        if !r.strip {
+            return r.addr, path
+        }
+        rest := strings.TrimPrefix(path, strings.TrimSuffix(r.prefix, "/"))
+        if !strings.HasPrefix(rest, "/") {
+            rest = "/" + rest
+        }
+        return r.addr, rest
+    }
+    return t.addr, path
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+
+	"github.com/gorilla/websocket"
+	"golang.org/x/net/http2"
+)
+
+// How the client talks to the local service; config file tunnels set these
+// per tunnel instead.
+var (
+    upstreamProto    = flag.String("upstream-proto", "http1", "Protocol spoken to the local service: http1, h2c (HTTP/2 cleartext, e.g. gRPC) or h2 (HTTP/2 over TLS)")
+    upstreamScheme   = flag.String("upstream-scheme", "", "http, or https for a local service that only serves TLS (default: https for h2, http otherwise)")
+    upstreamCA       = flag.String("upstream-ca", "", "PEM file of CA certificates to trust for an https upstream")
+    upstreamInsecure = flag.Bool("upstream-insecure", false, "Skip verifying the upstream's certificate")
+    upstreamCert     = flag.String("upstream-cert", "", "Client certificate (PEM) to present to the upstream")
+    upstreamKey      = flag.String("upstream-key", "", "Key (PEM) for --upstream-cert")
+    upstreamSNI      = flag.String("upstream-sni", "", "TLS server name for the upstream (default: --host)")
+    upstreamHost     = flag.String("upstream-host", "", "Host header sent to the upstream (default: host:port)")
+)
+
+// upstreamOptions describe how to reach a local HTTP service.
+type upstreamOptions struct {
+    Proto    string `yaml:"upstream_proto"`
+    Scheme   string `yaml:"upstream_scheme"`
+    CA       string `yaml:"upstream_ca"`
+    Insecure bool   `yaml:"upstream_insecure"`
+    Cert     string `yaml:"upstream_cert"`
+    Key      string `yaml:"upstream_key"`
+    SNI      string `yaml:"upstream_sni"`
+    Host     string `yaml:"upstream_host"`
+}
+
+// flagUpstreamOptions returns the options given by the --upstream-* flags.
+func flagUpstreamOptions() upstreamOptions {
+    return upstreamOptions{
+        Proto:    *upstreamProto,
+        Scheme:   *upstreamScheme,
+        CA:       *upstreamCA,
+        Insecure: *upstreamInsecure,
+        Cert:     *upstreamCert,
+        Key:      *upstreamKey,
+        SNI:      *upstreamSNI,
+        Host:     *upstreamHost,
+    }
+}
+
+// upstream sends requests to a local service and opens WebSockets to it.
+type upstream struct {
+    opts     upstreamOptions
+    client   *http.Client
+    wsDialer *websocket.Dialer
+}
+
+// hopHeaders are connection-specific and must not be forwarded over HTTP/2,
+// whose transport rejects them.
+var hopHeaders = []string{"Connection", "Keep-Alive", "Proxy-Connection", "Transfer-Encoding", "Upgrade"}
+
+// newUpstream checks o, filling in defaults, and sets up its transports.
+func newUpstream(o upstreamOptions) (*upstream, error) {
+    if o.Proto == "" {
+        o.Proto = "http1"
+    }
+    if o.Scheme == "" {
+        o.Scheme = "http"
+        if o.Proto == "h2" {
+            o.Scheme = "https" // HTTP/2 proper is always over TLS
+        }
+    }
+    if o.Scheme != "http" && o.Scheme != "https" {
+        return nil, fmt.Errorf("unknown scheme %q (want http or https)", o.Scheme)
+    }
+    if o.Proto == "h2c" && o.Scheme == "https" {
+        return nil, errors.New("h2c is cleartext; use --upstream-proto=h2 with https")
+    }
+    if o.Proto == "h2" && o.Scheme == "http" {
+        return nil, errors.New("h2 is HTTP/2 over TLS; use --upstream-proto=h2c with http")
+    }
+
+    up := &upstream{opts: o, client: http.DefaultClient, wsDialer: websocket.DefaultDialer}
+    var tlsConf *tls.Config
+    if o.Scheme == "https" {
+        var err error
+        if tlsConf, err = o.tlsConfig(); err != nil {
+            return nil, err
+        }
+        up.wsDialer = &websocket.Dialer{
+            Proxy:            http.ProxyFromEnvironment,
+            HandshakeTimeout: websocket.DefaultDialer.HandshakeTimeout,
+            TLSClientConfig:  tlsConf,
+        }
+    }
+
+    switch o.Proto {
+    case "http1":
+        if tlsConf != nil {
+            t := http.DefaultTransport.(*http.Transport).Clone()
+            t.TLSClientConfig = tlsConf
+            t.ForceAttemptHTTP2 = false
+            up.client = &http.Client{Transport: t}
+        }
+    case "h2c":
+        up.client = &http.Client{Transport: &http2.Transport{
+            AllowHTTP: true,
+            // Plain TCP where the transport expects TLS: that's h2c.
+            DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+                var d net.Dialer
+                return d.DialContext(ctx, network, addr)
+            },
+        }}
+    case "h2":
+        up.client = &http.Client{Transport: &http2.Transport{TLSClientConfig: tlsConf}}
+    default:
+        return nil, fmt.Errorf("unknown protocol %q (want http1, h2c or h2)", o.Proto)
+    }
+    return up, nil
+}
+
+// tlsConfig builds the TLS settings for an https upstream.
+func (o upstreamOptions) tlsConfig() (*tls.Config, error) {
+    // An empty ServerName is taken from the URL, i.e. the local host.
+    conf := &tls.Config{ServerName: o.SNI, InsecureSkipVerify: o.Insecure}
+    if o.CA != "" {
+        pem, err := os.ReadFile(o.CA)
+        if err != nil {
+            return nil, err
+        }
+        conf.RootCAs = x509.NewCertPool()
+        if !conf.RootCAs.AppendCertsFromPEM(pem) {
+            return nil, fmt.Errorf("no certificates found in %s", o.CA)
+        }
+    }
+    if o.Cert != "" || o.Key != "" {
+        cert, err := tls.LoadX509KeyPair(o.Cert, o.Key)
+        if err != nil {
+            return nil, err
+        }
+        conf.Certificates = []tls.Certificate{cert}
+    }
+    return conf, nil
+}
+
+// url returns the local service's URL for path at addr, as ws:// or wss://
+// for WebSocket handshakes.
+func (up *upstream) url(addr string, ws bool, path string) string {
+    scheme := up.opts.Scheme
+    if ws {
+        scheme = map[string]string{"http": "ws", "https": "wss"}[scheme]
+    }
+    return fmt.Sprintf("%s://%s%s", scheme, addr, path)
+}
+
+// dialWebSocket opens a WebSocket to the local service. Unlike
+// wsDialer.DialContext, which only applies ctx to connecting, it also gives
+// up on a handshake in progress once ctx is done.
+func (up *upstream) dialWebSocket(ctx context.Context, target string, h http.Header) (*websocket.Conn, *http.Response, error) {
+    d := *up.wsDialer
+    var stop func() bool
+    d.NetDialContext = func(dialCtx context.Context, network, addr string) (net.Conn, error) {
+        var nd net.Dialer
+        conn, err := nd.DialContext(dialCtx, network, addr)
+        if err == nil {
+            stop = context.AfterFunc(ctx, func() { conn.Close() })
+        }
+        return conn, err
+    }
+    ws, resp, err := d.DialContext(ctx, target, h)
+    if stop != nil {
+        stop()
+    }
+    return ws, resp, err
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"portkey/internal/tunnel"
+)
+
+// Timeouts and body limits. The flags are the defaults; a tunnel may ask for
+// lower values, or higher ones up to --max-tunnel-timeout and
+// --max-tunnel-body.
+var (
+    requestTimeout   = flag.Duration("request-timeout", 30*time.Second, "How long a tunnel may take to start answering a request (0=no limit)")
+    idleTimeout      = flag.Duration("idle-timeout", 0, "Abort a response that has sent nothing for this long (0=no limit)")
+    maxTunnelTimeout = flag.Duration("max-tunnel-timeout", 10*time.Minute, "Longest request or idle timeout a tunnel may ask for (0=no limit)")
+    maxRequestBody   = byteSize(100 << 20)
+    maxResponseBody  byteSize
+    maxTunnelBody    = byteSize(1 << 30)
+)
+
+func init() {
+    flag.Var(&maxRequestBody, "max-request-body", "Largest request body visitors may send, e.g. 10MB (0=no limit)")
+    flag.Var(&maxResponseBody, "max-response-body", "Largest response body a tunnel may send, e.g. 1GB (0=no limit)")
+    flag.Var(&maxTunnelBody, "max-tunnel-body", "Largest body limit a tunnel may ask for (0=no limit)")
+}
+
+// limits bound the requests on one tunnel. Zero means no limit.
+type limits struct {
+    requestTimeout  time.Duration // until the response starts
+    idleTimeout     time.Duration // between response body chunks
+    maxRequestBody  int64
+    maxResponseBody int64
+}
+
+// requestedLimits returns the limits for a tunnel that asked for q's
+// request_timeout, idle_timeout, max_request_body and max_response_body,
+// each capped at what the server allows.
+func requestedLimits(q url.Values) (limits, error) {
+    l := limits{*requestTimeout, *idleTimeout, int64(maxRequestBody), int64(maxResponseBody)}
+    for _, d := range []struct {
+        key string
+        v   *time.Duration
+    }{{"request_timeout", &l.requestTimeout}, {"idle_timeout", &l.idleTimeout}} {
+        v := q.Get(d.key)
+        if v == "" {
+            continue
+        }
+        asked, err := time.ParseDuration(v)
+        if err != nil || asked < 0 {
+            return limits{}, fmt.Errorf("bad %s %q", d.key, v)
+        }
+        *d.v = capAt(asked, loosest(*d.v, *maxTunnelTimeout))
+    }
+    for _, n := range []struct {
+        key string
+        v   *int64
+    }{{"max_request_body", &l.maxRequestBody}, {"max_response_body", &l.maxResponseBody}} {
+        v := q.Get(n.key)
+        if v == "" {
+            continue
+        }
+        asked, err := parseSize(v)
+        if err != nil {
+            return limits{}, fmt.Errorf("bad %s: %v", n.key, err)
+        }
+        *n.v = capAt(asked, loosest(*n.v, int64(maxTunnelBody)))
+    }
+    return l, nil
+}
+
+// limitKeys are the query parameters requestedLimits reads.
+var limitKeys = []string{"request_timeout", "idle_timeout", "max_request_body", "max_response_body"}
+
+// options encodes l for a Binding, to tell the client what it got.
+func (l limits) options() string {
+    return url.Values{
+        "request_timeout":   {l.requestTimeout.String()},
+        "idle_timeout":      {l.idleTimeout.String()},
+        "max_request_body":  {formatSize(l.maxRequestBody)},
+        "max_response_body": {formatSize(l.maxResponseBody)},
+    }.Encode()
+}
+
+// deadline fires once a response has taken too long to start; it never does
+// without a request timeout.
+func (l limits) deadline() <-chan time.Time {
+    if l.requestTimeout <= 0 {
+        return nil
+    }
+    return time.After(l.requestTimeout)
+}
+
+// capAt returns v, or limit if v is beyond it; 0 means no limit for both.
+func capAt[T int64 | time.Duration](v, limit T) T {
+    if limit > 0 && (v == 0 || v > limit) {
+        return limit
+    }
+    return v
+}
+
+// loosest returns the higher of two limits, where 0 means no limit.
+func loosest[T int64 | time.Duration](a, b T) T {
+    if a == 0 || b == 0 {
+        return 0
+    }
+    return max(a, b)
+}
+
+// Units parseSize and formatSize know, largest first.
+var sizeUnits = []struct {
+    suffix string
+    bytes  int64
+}{{"GB", 1 << 30}, {"MB", 1 << 20}, {"KB", 1 << 10}, {"B", 1}}
+
+// parseSize reads a byte count such as "512", "64KB", "10MB" or "1GB"
+// (powers of 1024).
+func parseSize(s string) (int64, error) {
+    num, unit := strings.ToUpper(strings.TrimSpace(s)), int64(1)
+    for _, u := range sizeUnits {
+        if rest, ok := strings.CutSuffix(num, u.suffix); ok {
+            num, unit = strings.TrimSpace(rest), u.bytes
+            break
+        }
+    }
+    n, err := strconv.ParseInt(num, 10, 64)
+    if err != nil || n < 0 || n > (1<<63-1)/unit {
+        return 0, fmt.Errorf("invalid size %q", s)
+    }
+    return n * unit, nil
+}
+
+// formatSize writes n in the largest unit that divides it.
+func formatSize(n int64) string {
+    for _, u := range sizeUnits {
+        if n != 0 && n%u.bytes == 0 {
+            return strconv.FormatInt(n/u.bytes, 10) + u.suffix
+        }
+    }
+    return "0"
+}
+
+// byteSize is a flag.Value for sizes like "10MB".
+type byteSize int64
+
+func (b *byteSize) String() string { return formatSize(int64(*b)) }
+
+func (b *byteSize) Set(s string) error {
+    n, err := parseSize(s)
+    *b = byteSize(n)
+    return err
+}
+
+// overReader passes on reads from an http.MaxBytesReader and closes over when
+// it hits its limit, so the proxy can answer 413 without waiting for the tunnel.
+type overReader struct {
+    r    io.Reader
+    over chan struct{}
+    once sync.Once
+}
+
+func (o *overReader) Read(p []byte) (int, error) {
+    n, err := o.r.Read(p)
+    var tooLarge *http.MaxBytesError
+    if errors.As(err, &tooLarge) {
+        o.once.Do(func() { close(o.over) })
+    }
+    return n, err
+}
+
+// Errors that end a response part way, once the visitor has its head.
+var (
+    errIdle             = errors.New("response idle timeout")
+    errResponseTooLarge = errors.New("response body too large")
+)
+
+// idleReader reads a stream's response body, failing it once it has waited
+// longer than d for the next chunk.
+type idleReader struct {
+    pr    *tunnel.PipeReader
+    timer *time.Timer
+    d     time.Duration
+}
+
+func newIdleReader(pr *tunnel.PipeReader, d time.Duration) *idleReader {
+    t := time.AfterFunc(d, func() { pr.CloseWithError(errIdle) })
+    t.Stop()
+    return &idleReader{pr: pr, timer: t, d: d}
+}
+
+func (r *idleReader) Read(p []byte) (int, error) {
+    r.timer.Reset(r.d)
+    n, err := r.pr.Read(p)
+    r.timer.Stop()
+    return n, err
+}
@@ -3,31 +3,199 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"flag"
+	"fmt"
 	"io"
 	"log"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
+	"github.com/quic-go/quic-go"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
 
 	"portkey/internal/auth"
 	"portkey/internal/caddysetup"
+	"portkey/internal/domains"
+	"portkey/internal/forward"
 	"portkey/internal/logstore"
+	"portkey/internal/ports"
 	"portkey/internal/registry"
+	"portkey/internal/rewrite"
 	"portkey/internal/tunnel"
 )
 
 
 type Client struct {
-    conn    *websocket.Conn
-    pending sync.Map // id -> chan tunnel.Response
+    conn    tunnel.Transport
+    nextID  atomic.Uint32
+    pending sync.Map    // stream id -> *stream
+    udp     []*udpRelay // UDP tunnels on this connection; owned by the read loop
+    // bind handles Bind messages on a KindMulti connection.
+    bind func(req tunnel.Binding)
+    // late counts responses that arrived after their visitor had gone.
+    late   atomic.Uint64
+    active atomic.Int64 // streams open, for load balancing pools
+    gone chan struct{} // closed once the read loop has stopped
+
+    // intake stops each raw-port tunnel taking new visitors; see stopIntake.
+    intakeMu      sync.Mutex
+    intake        []func()
+    intakeStopped bool
+}
+
+func newClient(conn tunnel.Transport) *Client {
+    return &Client{conn: conn, gone: make(chan struct{})}
+}
+
+// onStopIntake registers stop to run once the server starts draining, or
+// straight away if it already has.
+func (c *Client) onStopIntake(stop func()) {
+    c.intakeMu.Lock()
+    stopped := c.intakeStopped
+    if !stopped {
+        c.intake = append(c.intake, stop)
+    }
+    c.intakeMu.Unlock()
+    if stopped {
+        stop()
+    }
+}
+
+// stopIntake stops the client's TCP and UDP tunnels taking new visitors;
+// connections and sessions already open carry on.
+func (c *Client) stopIntake() {
+    c.intakeMu.Lock()
+    c.intakeStopped = true
+    intake := c.intake
+    c.intake = nil
+    c.intakeMu.Unlock()
+    for _, stop := range intake {
+        stop()
+    }
+}
+
+// refusal is a tunnel turned down with an HTTP status. Sent in a Binding's
+// Error as "status reason".
+type refusal struct {
+    status int
+    reason string
+}
+
+func (r *refusal) Error() string {
+    return fmt.Sprintf("%d %s", r.status, r.reason)
+}
+
+// conflictReason explains to a client why it can't have a subdomain.
+func conflictReason(err error) string {
+    switch err {
+    case registry.ErrInUse:
+        return err.Error() + "; use --force with the same token to take it over"
+    case registry.ErrPool:
+        return err.Error() + "; connect with --pool to join it"
+    }
+    return err.Error()
+}
+
+// route is one tunnel on a client connection, as registered for its subdomain
+// or port. name is only set on KindMulti connections, where it tells the
+// client which of its tunnels a stream is for.
+type route struct {
+    *Client
+    name   string
+    token  string // the tunnel's, for custom domains tied to an owner
+    limits limits
+}
+
+// admission is a /connect request that passed its checks and is waiting for
+// its transport to come up.
+type admission struct {
+    kind, sub, token string
+    session          string // the client's, kept across its reconnects
+    pool             bool   // share sub with other pool members
+    force            bool   // take sub over from another session of token
+    limits           limits // HTTP tunnels only
+    tcpLn            net.Listener
+    udpPC            net.PacketConn
+    port             int
+    release          func() // frees the public port
+}
+
+// owner is who a's subdomain belongs to once it is bound.
+func (a *admission) owner() registry.Owner {
+    return registry.Owner{Token: a.token, Session: a.session}
+}
+
+// stream tracks one in-flight request: the response head, a pipe the read
+// loop feeds response body chunks into and, for upgraded requests, frames.
+type stream struct {
+    id     uint32
+    resp   chan tunnel.Response
+    body   *tunnel.PipeWriter
+    frames chan tunnel.WSFrame
+    // overflowed is set, by the read loop, once frames was closed because
+    // the visitor stopped reading.
+    overflowed bool
+    // trailers arrive with the End chunk. The read loop sets them and then
+    // closes ended; they may only be read once ended is closed.
+    trailers tunnel.Header
+    ended    chan struct{}
+    done   chan struct{}
+}
+
+// openStream allocates a stream ID and registers the stream, returning it with
+// the reading end of its body pipe.
+func (c *Client) openStream() (*stream, *tunnel.PipeReader) {
+    id := c.nextID.Add(1)
+    pr, pw := c.conn.Pipe(id)
+    st := &stream{
+        id:     id,
+        resp:   make(chan tunnel.Response, 1),
+        body:   pw,
+        frames: make(chan tunnel.WSFrame, 64),
+        ended:  make(chan struct{}),
+        done:   make(chan struct{}),
+    }
+    c.pending.Store(id, st)
+    c.active.Add(1)
+    return st, pr
+}
+
+// closeStream forgets the stream and releases the read loop if it is blocked on it.
+func (c *Client) closeStream(st *stream, pr *tunnel.PipeReader) {
+    c.pending.Delete(st.id)
+    c.active.Add(-1)
+    close(st.done)
+    pr.CloseWithError(io.ErrClosedPipe)
+}
+
+// InFlight reports the streams open on the connection; pools send new
+// requests to the member with the fewest.
+func (c *Client) InFlight() int {
+    return int(c.active.Load())
+}
+
+// cancel tells the client nobody is waiting for a stream any more, so it can
+// abort the local request.
+func (c *Client) cancel(id uint32, reason string) {
+    c.send(tunnel.Message{Type: tunnel.TypeCancel, Reset: &tunnel.Reset{ID: id, Reason: reason}})
+}
+
+// send queues a message for the client; safe for concurrent use.
+func (c *Client) send(m tunnel.Message) error {
+    return c.conn.WriteMessage(m)
 }
 
 var (
@@ -40,11 +208,73 @@ var (
     logStoreType = flag.String("log-store", "memory", "Log store backend (memory|sqlite)")
     logDBPath   = flag.String("log-db", "logs.db", "SQLite database file when --log-store=sqlite")
     logRetention = flag.Int("log-retention", 0, "Retention days for SQLite logs (0=keep forever)")
+    tcpPorts = flag.String("tcp-ports", "", "Port range for TCP tunnels, e.g. 20000-20100 (empty=disabled)")
+    udpPorts = flag.String("udp-ports", "", "Port range for UDP tunnels, e.g. 21000-21100 (empty=disabled)")
+    udpIdle  = flag.Duration("udp-idle-timeout", time.Minute, "Expire UDP visitor sessions after this much inactivity (0=never)")
+    heartbeatInterval = flag.Duration("heartbeat-interval", 15*time.Second, "How often to ping connected clients (0=no heartbeats)")
+    heartbeatTimeout  = flag.Duration("heartbeat-timeout", 45*time.Second, "Drop a client that has been silent this long")
+    reconnectGrace    = flag.Duration("reconnect-grace", 30*time.Second, "Hold a disconnected client's subdomain for its token this long")
+    shutdownTimeout   = flag.Duration("shutdown-timeout", 30*time.Second, "On SIGTERM, wait this long for requests in flight before exiting")
+    quicPort = flag.Int("quic-port", 0, "UDP port to accept QUIC tunnels on (0=disabled)")
+    quicCert = flag.String("quic-cert", "", "TLS certificate file for QUIC (default: self-signed)")
+    quicKey  = flag.String("quic-key", "", "TLS key file for QUIC")
+    domainsFile = flag.String("domains-file", "", "JSON file the custom domain table is kept in (default: memory only)")
+    requestHeaderRules, responseHeaderRules stringList
+    trustedFlag   = flag.String("trusted-proxies", "", "Comma-separated CIDRs of proxies whose X-Forwarded-For and PROXY protocol headers are believed (loopback is added with --https)")
+    proxyProtocol = flag.Bool("proxy-protocol", false, "Accept PROXY protocol v1/v2 headers from trusted proxies on the HTTP listener")
+    dnsResolver = flag.String("dns-resolver", "", "DNS server (host:port) to verify custom domain CNAMEs with (default: the system's)")
 )
 
+func init() {
+    flag.Var(&requestHeaderRules, "request-header", "Header rule for every proxied request, e.g. 'set X-Env: dev' (repeatable)")
+    flag.Var(&responseHeaderRules, "response-header", "Header rule for every proxied response, e.g. 'remove Server' (repeatable)")
+}
+
+// stringList is a repeatable string flag.
+type stringList []string
+
+func (l *stringList) String() string     { return strings.Join(*l, ", ") }
+func (l *stringList) Set(s string) error { *l = append(*l, s); return nil }
+
+// headerRules rewrite headers on every tunnel, before the client's own rules
+// for requests and after them for responses.
+var headerRules rewrite.Rules
+
+// trustedProxies may tell us who the visitor really is.
+var trustedProxies forward.Trusted
+
+// visitorVars are the values header rule templates can use for r.
+func visitorVars(r *http.Request, client *route, sub string) rewrite.Vars {
+    ip := forward.ClientIP(r, trustedProxies)
+    name := client.name
+    if name == "" {
+        name = sub
+    }
+    return rewrite.Vars{"visitor_ip": ip, "tunnel": name, "subdomain": sub, "host": r.Host}
+}
+
 func main() {
     flag.Parse()
 
+    var err error
+    if headerRules, err = rewrite.ParseAll(requestHeaderRules, responseHeaderRules); err != nil {
+        log.Fatalf("header rules: %v", err)
+    }
+    for _, r := range headerRules.Request {
+        // The client picks the Host the local service sees.
+        if r.TouchesHost() {
+            log.Fatalf("--request-header %q: Host can only be rewritten by the client's rules", r)
+        }
+    }
+    if trustedProxies, err = forward.ParseTrusted(*trustedFlag); err != nil {
+        log.Fatalf("--trusted-proxies: %v", err)
+    }
+    if *httpsEnabled {
+        // The embedded Caddy forwards from loopback.
+        loopback, _ := forward.ParseTrusted("127.0.0.1, ::1")
+        trustedProxies = append(trustedProxies, loopback...)
+    }
+
     if *domain == "" {
         log.Fatal("--domain must be set and non-empty")
     }
@@ -61,7 +291,35 @@ func main() {
         log.Printf("auth disabled (no auth-file provided)")
     }
 
+    var tcpPool *ports.Pool
+    if *tcpPorts != "" {
+        var err error
+        if tcpPool, err = ports.ParseRange(*tcpPorts); err != nil {
+            log.Fatalf("--tcp-ports: %v", err)
+        }
+        log.Printf("tcp tunnels enabled (ports %s)", *tcpPorts)
+    }
+    var udpPool *ports.Pool
+    if *udpPorts != "" {
+        var err error
+        if udpPool, err = ports.ParseRange(*udpPorts); err != nil {
+            log.Fatalf("--udp-ports: %v", err)
+        }
+        log.Printf("udp tunnels enabled (ports %s)", *udpPorts)
+    }
+
     reg := registry.New()
+    customDomains, err := domains.Open(*domainsFile)
+    if err != nil {
+        log.Fatalf("--domains-file: %v", err)
+    }
+    resolver := net.DefaultResolver
+    if *dnsResolver != "" {
+        resolver = &net.Resolver{PreferGo: true, Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+            var d net.Dialer
+            return d.DialContext(ctx, network, *dnsResolver)
+        }}
+    }
     memStore := logstore.New(1000)
     var sqlStore *logstore.SQLite
     if *logStoreType == "sqlite" {
@@ -92,6 +350,17 @@ func main() {
         return host
     }
 
+    // publicURL is the address visitors use to reach a subdomain.
+    publicURL := func(sub string) string {
+        if *httpsEnabled {
+            return "https://" + sub + "." + *domain
+        }
+        if *port == 80 {
+            return "http://" + sub + "." + *domain
+        }
+        return fmt.Sprintf("http://%s.%s:%d", sub, *domain, *port)
+    }
+
     // On-demand TLS allowlist endpoint: approve cert only for registered subdomains (and apex)
     mux.HandleFunc("/allow-host", func(w http.ResponseWriter, r *http.Request) {
         h := normalizeHost(r.URL.Query().Get("host"))
@@ -108,6 +377,11 @@ func main() {
                 return
             }
         }
+        // ...or it is a verified custom domain
+        if cd, ok := customDomains.Lookup(h); ok && cd.Verified {
+            w.WriteHeader(http.StatusOK)
+            return
+        }
         http.Error(w, "forbidden", http.StatusForbidden)
         return
     })
@@ -124,62 +398,173 @@ func main() {
         return false
     }
 
+    record := func(e logstore.Entry) {
+        memStore.Add(e)
+        if sqlStore != nil {
+            sqlStore.Add(e)
+        }
+    }
+
     proxy := func(w http.ResponseWriter, r *http.Request) {
-        sub := strings.TrimSuffix(normalizeHost(r.Host), "."+*domain)
+        h := normalizeHost(r.Host)
+        sub, owner := strings.TrimSuffix(h, "."+*domain), ""
+        if sub == h {
+            // Not one of ours: a verified custom domain, or nothing.
+            cd, ok := customDomains.Lookup(h)
+            if !ok || !cd.Verified {
+                http.NotFound(w, r)
+                return
+            }
+            sub, owner = cd.Subdomain, cd.Owner
+        }
         cVal, ok := reg.Lookup(sub)
         if !ok {
             http.NotFound(w, r)
             return
         }
-        client := cVal.(*Client)
+        if cVal == nil {
+            // Reserved while its client reconnects.
+            w.Header().Set("Retry-After", "1")
+            http.Error(w, "tunnel reconnecting", http.StatusServiceUnavailable)
+            return
+        }
+        client := cVal.(*route)
+        if owner != "" && client.token != owner {
+            http.NotFound(w, r)
+            return
+        }
 
-        id := uuid.New().String()
-        reqMsg := tunnel.Request{
-            ID:     id,
-            Method: r.Method,
-            Path:   r.URL.RequestURI(),
-            Headers: func() map[string]string {
-                h := make(map[string]string)
-                for k, v := range r.Header {
-                    h[k] = strings.Join(v, ";")
-                }
-                return h
-            }(),
+        if websocket.IsWebSocketUpgrade(r) {
+            proxyWebSocket(w, r, client, sub, record)
+            return
         }
-        if b, err := io.ReadAll(r.Body); err == nil {
-            reqMsg.Body = b
+        lim := client.limits
+        if lim.maxRequestBody > 0 && r.ContentLength > lim.maxRequestBody {
+            http.Error(w, "request body too large", http.StatusRequestEntityTooLarge)
+            return
         }
 
-        respCh := make(chan tunnel.Response, 1)
-        client.pending.Store(id, respCh)
-        defer client.pending.Delete(id)
+        st, pr := client.openStream()
+        defer client.closeStream(st, pr)
+        // If the visitor goes away mid-response, stop waiting on the tunnel and
+        // let the client know. Deferred last, so it's disarmed before closeStream.
+        stop := context.AfterFunc(r.Context(), func() {
+            client.cancel(st.id, "visitor disconnected")
+            pr.CloseWithError(context.Canceled)
+        })
+        defer stop()
+
+        vars := visitorVars(r, client, sub)
+        fwd := r.Header.Clone()
+        forward.Set(fwd, r, trustedProxies)
+        rewrite.Apply(headerRules.Request, fwd, nil, vars)
+        headers := tunnel.HeaderFrom(fwd, r.Trailer)
+        reqMsg := tunnel.Request{
+            ID:         st.id,
+            Method:     r.Method,
+            Path:       r.URL.RequestURI(),
+            Headers:    headers,
+            RemoteAddr: vars["visitor_ip"],
+            Tunnel:     client.name,
+        }
 
-        if err := client.conn.WriteJSON(reqMsg); err != nil {
+        if err := client.send(tunnel.Message{Type: tunnel.TypeRequest, Request: &reqMsg}); err != nil {
             http.Error(w, "tunnel write error", http.StatusBadGateway)
             return
         }
 
+        // Upload the request body concurrently: the local app may answer before
+        // reading it all. A body over the limit is reset on the tunnel, and the
+        // visitor told unless the app has already answered.
+        var reqBody logstore.BodyCapture
+        body := &overReader{r: r.Body, over: make(chan struct{})}
+        if lim.maxRequestBody > 0 {
+            body.r = http.MaxBytesReader(w, r.Body, lim.maxRequestBody)
+        }
+        uploaded := make(chan struct{})
+        go func() {
+            defer close(uploaded)
+            if err := tunnel.SendBody(st.id, io.TeeReader(body, &reqBody), r.Trailer, client.send); err != nil {
+                log.Printf("request body %s/%d: %v", sub, st.id, err)
+            }
+        }()
+        // abandonUpload stops the upload and waits for it to end, for exits
+        // that don't need the rest of the body: r.Body mustn't be read once
+        // the handler returns, and a visitor still sending it shouldn't hold
+        // up the answer.
+        abandonUpload := func() {
+            http.NewResponseController(w).SetReadDeadline(time.Now())
+            r.Body.Close()
+            <-uploaded
+        }
+
         select {
-        case resp := <-respCh:
-            for k, v := range resp.Headers {
-                w.Header().Set(k, v)
+        case resp := <-st.resp:
+            if n, err := strconv.ParseInt(resp.Headers.Get("Content-Length"), 10, 64); err == nil && lim.maxResponseBody > 0 && n > lim.maxResponseBody {
+                client.cancel(st.id, errResponseTooLarge.Error())
+                http.Error(w, errResponseTooLarge.Error(), http.StatusBadGateway)
+                abandonUpload()
+                return
+            }
+            for _, f := range resp.Headers {
+                // Trailers are sent undeclared, via TrailerPrefix, once the body is done.
+                if http.CanonicalHeaderKey(f.Name) != "Trailer" {
+                    w.Header().Add(f.Name, f.Value)
+                }
             }
+            rewrite.Apply(headerRules.Response, w.Header(), nil, vars)
             w.WriteHeader(resp.Status)
-            w.Write(resp.Body)
-            entry := logstore.Entry{ID: id, Subdomain: sub, Method: r.Method, Path: r.URL.RequestURI(), Status: resp.Status, Timestamp: time.Now(), Headers: func() map[string]string {
-                    h := make(map[string]string)
-                    for k, v := range r.Header {
-                        h[k] = strings.Join(v, ";")
-                    }
-                    return h
-                }(),
-                Body: string(reqMsg.Body)}
-            memStore.Add(entry)
-            if sqlStore != nil {
-                sqlStore.Add(entry)
+            var respBody io.Reader = pr
+            if lim.idleTimeout > 0 {
+                respBody = newIdleReader(pr, lim.idleTimeout)
+            }
+            src := respBody
+            if lim.maxResponseBody > 0 {
+                src = io.LimitReader(respBody, lim.maxResponseBody)
             }
-        case <-time.After(30 * time.Second):
+            n, err := io.Copy(flushWriter{w}, src)
+            if err == nil && lim.maxResponseBody > 0 && n == lim.maxResponseBody {
+                // Exactly at the limit is fine; anything more isn't.
+                if m, _ := respBody.Read(make([]byte, 1)); m > 0 {
+                    err = errResponseTooLarge
+                }
+            }
+            if err == errIdle || err == errResponseTooLarge {
+                // The visitor can only tell from a broken connection.
+                log.Printf("response body %s/%d: %v; aborting", sub, st.id, err)
+                client.cancel(st.id, err.Error())
+                abandonUpload()
+                panic(http.ErrAbortHandler)
+            }
+            if err != nil {
+                log.Printf("response body %s/%d: %v", sub, st.id, err)
+            }
+            select {
+            case <-st.ended:
+                for _, f := range st.trailers {
+                    w.Header().Add(http.TrailerPrefix+f.Name, f.Value)
+                }
+            default:
+                // The body was cut short; there are no trailers to pass on.
+            }
+            <-uploaded
+            entry := logstore.Entry{ID: uuid.New().String(), Subdomain: sub, Method: r.Method, Path: r.URL.RequestURI(), Status: resp.Status, ClientIP: vars["visitor_ip"], Timestamp: time.Now(), Headers: headers,
+                Body: reqBody.String()}
+            record(entry)
+        case <-r.Context().Done():
+            // The AfterFunc has already cancelled the stream.
+            abandonUpload()
+        case <-client.gone:
+            http.Error(w, "tunnel disconnected", http.StatusBadGateway)
+            abandonUpload()
+        case <-body.over:
+            client.cancel(st.id, "request body too large")
+            http.Error(w, "request body too large", http.StatusRequestEntityTooLarge)
+            abandonUpload()
+        case <-lim.deadline():
+            client.cancel(st.id, "timeout")
             http.Error(w, "tunnel timeout", http.StatusGatewayTimeout)
+            abandonUpload()
         }
     }
 
@@ -240,6 +625,78 @@ func main() {
         })
     }
 
+    // Custom domains, admin only: GET lists the table, POST {host, subdomain,
+    // owner} maps a host, POST /api/domains/<host>/verify checks it is a CNAME
+    // for the subdomain so it gets routed, and DELETE /api/domains/<host>
+    // removes it. Without --auth-file there are no admins, so the table can
+    // only be read: verified hosts are approved for TLS certificates.
+    domainsAPI := func(w http.ResponseWriter, r *http.Request) {
+        if !isRootHost(r.Host) { proxy(w, r); return }
+        if mgr != nil && mgr.Role(r.URL.Query().Get("token")) != "admin" {
+            http.Error(w, "forbidden", http.StatusForbidden)
+            return
+        }
+        if mgr == nil && r.Method != http.MethodGet {
+            http.Error(w, "custom domains can only be changed on a server with --auth-file", http.StatusForbidden)
+            return
+        }
+        host, verify := strings.CutSuffix(strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/api/domains"), "/"), "/verify")
+        w.Header().Set("Content-Type", "application/json")
+        switch {
+        case r.Method == http.MethodGet && host == "":
+            json.NewEncoder(w).Encode(customDomains.List())
+        case r.Method == http.MethodPost && host == "":
+            var d domains.Domain
+            if err := json.NewDecoder(r.Body).Decode(&d); err != nil {
+                http.Error(w, "bad json: "+err.Error(), http.StatusBadRequest)
+                return
+            }
+            if h := domains.Normalize(d.Host); h == *domain || strings.HasSuffix(h, "."+*domain) {
+                http.Error(w, "host is under the server's own domain", http.StatusBadRequest)
+                return
+            }
+            if mgr != nil && d.Owner != "" && !mgr.Validate(d.Owner, d.Subdomain) {
+                http.Error(w, "owner token may not use subdomain "+d.Subdomain, http.StatusBadRequest)
+                return
+            }
+            d, err := customDomains.Add(d)
+            if errors.Is(err, domains.ErrExists) {
+                http.Error(w, err.Error(), http.StatusConflict)
+                return
+            }
+            if err != nil {
+                http.Error(w, err.Error(), http.StatusBadRequest)
+                return
+            }
+            log.Printf("custom domain %s -> %s added; awaiting CNAME to %s.%s", d.Host, d.Subdomain, d.Subdomain, *domain)
+            w.WriteHeader(http.StatusCreated)
+            json.NewEncoder(w).Encode(d)
+        case r.Method == http.MethodPost && verify:
+            cd, ok := customDomains.Lookup(host)
+            if !ok {
+                http.NotFound(w, r)
+                return
+            }
+            d, err := customDomains.Verify(r.Context(), host, cd.Subdomain+"."+*domain, resolver)
+            if err != nil {
+                http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+                return
+            }
+            log.Printf("custom domain %s verified", d.Host)
+            json.NewEncoder(w).Encode(d)
+        case r.Method == http.MethodDelete && host != "" && !verify:
+            if err := customDomains.Remove(host); err != nil {
+                http.NotFound(w, r)
+                return
+            }
+            w.WriteHeader(http.StatusNoContent)
+        default:
+            http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+        }
+    }
+    mux.HandleFunc("/api/domains", domainsAPI)
+    mux.HandleFunc("/api/domains/", domainsAPI)
+
     if *enableWebUI {
         mux.HandleFunc("/api/ws", func(w http.ResponseWriter, r *http.Request) {
             if !isRootHost(r.Host) { proxy(w, r); return }
@@ -258,48 +715,301 @@ func main() {
         })
     }
 
-    mux.HandleFunc("/connect", func(w http.ResponseWriter, r *http.Request) {
-        sub := r.URL.Query().Get("subdomain")
-        token := r.URL.Query().Get("token")
-        if sub == "" {
-            http.Error(w, "missing subdomain", http.StatusBadRequest)
-            return
+    // allocate picks a free subdomain for a client that didn't ask for one:
+    // a random name inside one of its token's patterns, else a free exact one.
+    allocate := func(a *admission) string {
+        patterns := []string{"*"}
+        if mgr != nil {
+            patterns = mgr.Patterns(a.token)
         }
-        if mgr != nil && !mgr.Validate(token, sub) {
-            http.Error(w, "unauthorized", http.StatusUnauthorized)
-            return
+        for i := 0; i < 20; i++ {
+            name, ok := auth.Generate(patterns)
+            if !ok {
+                break
+            }
+            if _, taken := reg.Lookup(name); !taken {
+                return name
+            }
         }
-        up := websocket.Upgrader{CheckOrigin: func(r *http.Request) bool { return true }}
-        ws, err := up.Upgrade(w, r, nil)
-        if err != nil {
-            log.Printf("upgrade error: %v", err)
-            return
+        for _, name := range auth.Exact(patterns) {
+            if reg.Check(name, a.owner(), a.pool, false) == nil {
+                return name
+            }
         }
+        return ""
+    }
 
-        client := &Client{conn: ws}
-        reg.Register(sub, client)
-        log.Printf("subdomain %s registered", sub)
+    // Once draining, the server is shutting down and takes no new tunnels.
+    var draining atomic.Bool
+    // live holds the connected clients, to tell them about it.
+    var live sync.Map // *Client -> struct{}
 
-        go func() {
-            defer func() {
-                reg.Remove(sub)
-                ws.Close()
-                log.Printf("subdomain %s disconnected", sub)
-            }()
-            for {
-                var resp tunnel.Response
-                if err := ws.ReadJSON(&resp); err != nil {
-                    log.Printf("read error: %v", err)
+    // admit checks a /connect request and reserves what its tunnel needs, or
+    // returns the status and reason to refuse it with. Raw tunnels get a public
+    // port up front so failures can still be reported before the transport is up.
+    admit := func(q url.Values) (*admission, int, string) {
+        if draining.Load() {
+            return nil, http.StatusServiceUnavailable, "server is shutting down"
+        }
+        a := &admission{kind: q.Get("type"), sub: q.Get("subdomain"), token: q.Get("token"), release: func() {}}
+        a.session, a.pool, a.force = q.Get("session"), q.Get("pool") == "1", q.Get("force") == "1"
+        if a.kind == "" {
+            a.kind = tunnel.KindHTTP
+        }
+        switch a.kind {
+        case tunnel.KindHTTP:
+            var err error
+            if a.limits, err = requestedLimits(q); err != nil {
+                return nil, http.StatusBadRequest, err.Error()
+            }
+            if a.sub == "" {
+                if mgr != nil && !mgr.Known(a.token) {
+                    return nil, http.StatusUnauthorized, "unauthorized"
+                }
+                if a.sub = allocate(a); a.sub == "" {
+                    return nil, http.StatusConflict, "no free subdomain matches the token's patterns"
+                }
+            }
+            if mgr != nil && !mgr.Validate(a.token, a.sub) {
+                return nil, http.StatusUnauthorized, "unauthorized"
+            }
+            if err := reg.Check(a.sub, a.owner(), a.pool, a.force); err != nil {
+                return nil, http.StatusConflict, conflictReason(err)
+            }
+        case tunnel.KindTCP:
+            if tcpPool == nil {
+                return nil, http.StatusBadRequest, "tcp tunnels are not enabled on this server"
+            }
+            if mgr != nil && !mgr.Known(a.token) {
+                return nil, http.StatusUnauthorized, "unauthorized"
+            }
+            var err error
+            a.port, err = tcpPool.Acquire(func(p int) (err error) {
+                a.tcpLn, err = net.Listen("tcp", ":"+strconv.Itoa(p))
+                return err
+            })
+            if err != nil {
+                return nil, http.StatusServiceUnavailable, err.Error()
+            }
+            a.release = func() {
+                a.tcpLn.Close()
+                tcpPool.Release(a.port)
+            }
+        case tunnel.KindUDP:
+            if udpPool == nil {
+                return nil, http.StatusBadRequest, "udp tunnels are not enabled on this server"
+            }
+            if mgr != nil && !mgr.Known(a.token) {
+                return nil, http.StatusUnauthorized, "unauthorized"
+            }
+            var err error
+            a.port, err = udpPool.Acquire(func(p int) (err error) {
+                a.udpPC, err = net.ListenPacket("udp", ":"+strconv.Itoa(p))
+                return err
+            })
+            if err != nil {
+                return nil, http.StatusServiceUnavailable, err.Error()
+            }
+            a.release = func() {
+                a.udpPC.Close()
+                udpPool.Release(a.port)
+            }
+        case tunnel.KindMulti:
+            // Each tunnel is admitted on its own as the client binds it.
+            if mgr != nil && !mgr.Known(a.token) {
+                return nil, http.StatusUnauthorized, "unauthorized"
+            }
+        default:
+            return nil, http.StatusBadRequest, "unknown tunnel type " + a.kind
+        }
+        return a, 0, ""
+    }
+
+    // bindTunnel puts an admitted tunnel on client under name, returning the
+    // Binding to tell the client about and the cleanup to run once the
+    // connection is gone. It must be called from the client's read loop, or
+    // before it starts.
+    bindTunnel := func(client *Client, a *admission, name, via string) (*tunnel.Binding, func(), error) {
+        rt := &route{Client: client, name: name, token: a.token, limits: a.limits}
+        label := ""
+        if name != "" {
+            label = " [" + name + "]"
+        }
+        switch a.kind {
+        case tunnel.KindTCP, tunnel.KindUDP:
+            log.Printf("%s tunnel on port %d registered%s (%s)", a.kind, a.port, label, via)
+            var relay *udpRelay
+            if a.kind == tunnel.KindTCP {
+                go serveTCP(a.tcpLn, rt, a.port, record)
+                client.onStopIntake(func() { a.tcpLn.Close() })
+            } else {
+                relay = newUDPRelay(a.udpPC, rt, a.port, *udpIdle, record)
+                client.udp = append(client.udp, relay)
+                go relay.serve()
+                client.onStopIntake(relay.stopAdmitting)
+            }
+            b := &tunnel.Binding{Name: name, Kind: a.kind, Port: a.port, URL: fmt.Sprintf("%s://%s:%d", a.kind, *domain, a.port)}
+            return b, func() {
+                if relay != nil {
+                    relay.close()
+                }
+                a.release()
+                log.Printf("%s tunnel on port %d disconnected%s", a.kind, a.port, label)
+            }, nil
+        default:
+            if a.pool {
+                if !reg.Join(a.sub, rt) {
+                    return nil, nil, &refusal{http.StatusConflict, conflictReason(registry.ErrNotPool)}
+                }
+                _, n := reg.Pooled(a.sub)
+                log.Printf("subdomain %s registered%s, pool of %d (%s)", a.sub, label, n, via)
+            } else {
+                displaced, err := reg.Claim(a.sub, rt, a.owner(), a.force)
+                if err != nil {
+                    return nil, nil, &refusal{http.StatusConflict, conflictReason(err)}
+                }
+                for _, c := range displaced {
+                    // Tell the old tunnel why it stopped getting traffic.
+                    old := c.(*route)
+                    b := &tunnel.Binding{Name: old.name, Kind: a.kind, Subdomain: a.sub,
+                        Error: (&refusal{http.StatusConflict, "subdomain was taken over by another client"}).Error()}
+                    go old.send(tunnel.Message{Type: tunnel.TypeBound, Bound: b})
+                }
+                if len(displaced) > 0 {
+                    log.Printf("subdomain %s taken over%s (%s)", a.sub, label, via)
+                } else {
+                    log.Printf("subdomain %s registered%s (%s)", a.sub, label, via)
+                }
+            }
+            b := &tunnel.Binding{Name: name, Kind: a.kind, Subdomain: a.sub, URL: publicURL(a.sub), Options: a.limits.options()}
+            return b, func() {
+                reg.Reserve(a.sub, rt, a.token, *reconnectGrace)
+                if _, n := reg.Pooled(a.sub); n > 0 {
+                    log.Printf("subdomain %s: pool member disconnected, %d left", a.sub, n)
+                } else {
+                    log.Printf("subdomain %s disconnected (held for %s)", a.sub, *reconnectGrace)
+                }
+            }, nil
+        }
+    }
+
+    // attach brings an admitted connection up on its transport; via describes
+    // the transport for the logs. A KindMulti connection starts without
+    // tunnels and binds them as the client asks.
+    attach := func(a *admission, conn tunnel.Transport, via string) {
+        client := newClient(conn)
+        var cleanups []func() // run by the read loop once it stops
+        if a.kind == tunnel.KindMulti {
+            log.Printf("multi-tunnel client connected (%s)", via)
+            client.bind = func(req tunnel.Binding) {
+                q := url.Values{"type": {req.Kind}, "subdomain": {req.Subdomain}, "token": {a.token}, "session": {a.session}}
+                if a.pool {
+                    q.Set("pool", "1")
+                }
+                if a.force {
+                    q.Set("force", "1")
+                }
+                refused := &tunnel.Binding{Name: req.Name, Kind: req.Kind, Subdomain: req.Subdomain}
+                if req.Kind == tunnel.KindMulti {
+                    refused.Error = (&refusal{http.StatusBadRequest, "tunnels can't be nested"}).Error()
+                    client.send(tunnel.Message{Type: tunnel.TypeBound, Bound: refused})
+                    return
+                }
+                opts, err := url.ParseQuery(req.Options)
+                if err != nil {
+                    refused.Error = (&refusal{http.StatusBadRequest, "bad options: " + err.Error()}).Error()
+                    client.send(tunnel.Message{Type: tunnel.TypeBound, Bound: refused})
                     return
                 }
-                if chVal, ok := client.pending.Load(resp.ID); ok {
-                    ch := chVal.(chan tunnel.Response)
-                    ch <- resp
+                for _, k := range limitKeys {
+                    if v := opts.Get(k); v != "" {
+                        q.Set(k, v)
+                    }
                 }
+                ta, status, reason := admit(q)
+                if ta == nil {
+                    refused.Error = (&refusal{status, reason}).Error()
+                    client.send(tunnel.Message{Type: tunnel.TypeBound, Bound: refused})
+                    return
+                }
+                b, cleanup, err := bindTunnel(client, ta, req.Name, via)
+                if err != nil {
+                    ta.release()
+                    refused.Error = err.Error()
+                    client.send(tunnel.Message{Type: tunnel.TypeBound, Bound: refused})
+                    return
+                }
+                cleanups = append(cleanups, cleanup)
+                client.send(tunnel.Message{Type: tunnel.TypeBound, Bound: b})
             }
+        } else {
+            b, cleanup, err := bindTunnel(client, a, "", via)
+            if err != nil {
+                // Lost a race since admission; the client hears why and leaves.
+                log.Printf("tunnel %s refused: %v", a.sub, err)
+                a.release()
+                client.send(tunnel.Message{Type: tunnel.TypeBound, Bound: &tunnel.Binding{Kind: a.kind, Subdomain: a.sub, Error: err.Error()}})
+                time.AfterFunc(5*time.Second, func() { conn.Close() })
+                go client.serve()
+                return
+            }
+            cleanups = append(cleanups, cleanup)
+            client.send(tunnel.Message{Type: tunnel.TypeBound, Bound: b})
+        }
+        live.Store(client, struct{}{})
+        go func() {
+            defer func() {
+                live.Delete(client)
+                for _, cleanup := range cleanups {
+                    cleanup()
+                }
+                if a.kind == tunnel.KindMulti {
+                    log.Printf("multi-tunnel client disconnected")
+                }
+            }()
+            client.serve()
         }()
+    }
+
+    mux.HandleFunc("/connect", func(w http.ResponseWriter, r *http.Request) {
+        a, status, reason := admit(r.URL.Query())
+        if a == nil {
+            http.Error(w, reason, status)
+            return
+        }
+        version := tunnel.NegotiateVersion(r.Header.Get(tunnel.ProtocolHeader))
+        up := websocket.Upgrader{CheckOrigin: func(r *http.Request) bool { return true }}
+        ws, err := up.Upgrade(w, r, http.Header{tunnel.ProtocolHeader: {strconv.Itoa(version)}})
+        if err != nil {
+            log.Printf("upgrade error: %v", err)
+            a.release()
+            return
+        }
+        sess := tunnel.NewSession(ws, version)
+        sess.Heartbeat(*heartbeatInterval, *heartbeatTimeout)
+        attach(a, sess, fmt.Sprintf("protocol v%d", version))
     })
 
+    var quicLn *quic.Listener
+    if *quicPort != 0 {
+        tlsConf, err := quicTLSConfig(*quicCert, *quicKey, *domain)
+        if err != nil {
+            log.Fatalf("quic tls: %v", err)
+        }
+        pc, err := net.ListenUDP("udp", &net.UDPAddr{Port: *quicPort})
+        if err != nil {
+            log.Fatalf("quic listen: %v", err)
+        }
+        // A Transport of our own outlives the listener, so closing the
+        // listener when draining leaves the live connections up.
+        tr := &quic.Transport{Conn: pc}
+        if quicLn, err = tr.Listen(tlsConf, tunnel.NewQUICConfig(*heartbeatInterval, *heartbeatTimeout)); err != nil {
+            log.Fatalf("quic listen: %v", err)
+        }
+        log.Printf("quic tunnels enabled (udp port %d)", *quicPort)
+        go serveQUIC(quicLn, admit, attach)
+    }
+
     mux.HandleFunc("/", proxy)
 
     listenAddr := ":" + strconv.Itoa(*port)
@@ -307,13 +1017,192 @@ func main() {
         listenAddr = "127.0.0.1:8081"
         ctx := context.Background()
         ask := "http://" + listenAddr + "/allow-host"
-        if err := caddysetup.Start(ctx, ":"+strconv.Itoa(*port), listenAddr, *domain, *caddyEmail, ask); err != nil {
+        if err := caddysetup.Start(ctx, ":"+strconv.Itoa(*port), listenAddr, *domain, *caddyEmail, ask, *shutdownTimeout); err != nil {
             log.Fatalf("caddy start: %v", err)
         }
     }
 
-    log.Printf("portkey-server listening on %s", listenAddr)
-    if err := http.ListenAndServe(listenAddr, mux); err != nil {
+    ln, err := net.Listen("tcp", listenAddr)
+    if err != nil {
         log.Fatal(err)
     }
+    if *proxyProtocol {
+        ln = &forward.Listener{Listener: ln, Trusted: trustedProxies}
+        log.Printf("accepting PROXY protocol from trusted proxies")
+    }
+    log.Printf("portkey-server listening on %s", listenAddr)
+    // Accept HTTP/2 without TLS as well, so gRPC reaches the proxy from Caddy
+    // (or directly, in development) with its streams and trailers intact.
+    srv := &http.Server{Handler: h2c.NewHandler(mux, &http2.Server{})}
+    go func() {
+        if err := srv.Serve(ln); err != http.ErrServerClosed {
+            log.Fatal(err)
+        }
+    }()
+
+    // On SIGTERM, stop taking tunnels and visitors, tell the clients so they
+    // can reconnect elsewhere, and give the requests in flight until
+    // --shutdown-timeout to finish.
+    signals := make(chan os.Signal, 1)
+    signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+    log.Printf("%s: draining (for up to %s)", <-signals, *shutdownTimeout)
+    draining.Store(true)
+    if quicLn != nil {
+        quicLn.Close()
+    }
+    live.Range(func(k, _ any) bool {
+        c := k.(*Client)
+        c.stopIntake()
+        // Older clients can't decode the notice; they reconnect once closed.
+        if c.conn.Version() >= tunnel.ProtocolDrain {
+            c.send(tunnel.Message{Type: tunnel.TypeDrain, Reset: &tunnel.Reset{Reason: "server shutting down"}})
+        }
+        return true
+    })
+    ctx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+    defer cancel()
+    if *httpsEnabled {
+        // Caddy waits for what it is proxying, within the same timeout.
+        caddysetup.Stop()
+    }
+    if err := srv.Shutdown(ctx); err != nil {
+        log.Printf("shutdown: %v", err)
+    }
+    // The HTTP server doesn't wait for TCP tunnels and upgraded WebSockets.
+    for inFlight(&live) > 0 && ctx.Err() == nil {
+        time.Sleep(100 * time.Millisecond)
+    }
+    if n := inFlight(&live); n > 0 {
+        log.Printf("shutdown: %d streams cut off", n)
+    }
+    live.Range(func(k, _ any) bool {
+        k.(*Client).conn.Close()
+        return true
+    })
+    if sqlStore != nil {
+        if err := sqlStore.Close(); err != nil {
+            log.Printf("sqlite: %v", err)
+        }
+    }
+    log.Printf("portkey-server stopped")
+}
+
+// inFlight counts the streams open on the clients in live.
+func inFlight(live *sync.Map) int {
+    n := 0
+    live.Range(func(k, _ any) bool {
+        n += k.(*Client).InFlight()
+        return true
+    })
+    return n
+}
+
+// serve runs the client's read loop, dispatching messages to their streams
+// until the connection fails, then tears down whatever was still in flight.
+func (c *Client) serve() {
+    defer close(c.gone)
+    defer c.conn.Close()
+    defer func() {
+        // Fail any responses, WebSockets and TCP connections still streaming from this client.
+        c.pending.Range(func(_, v any) bool {
+            st := v.(*stream)
+            st.body.CloseWithError(io.ErrUnexpectedEOF)
+            if !st.overflowed {
+                close(st.frames) // the read loop was the only sender
+            }
+            return true
+        })
+    }()
+    for {
+        msg, err := c.conn.ReadMessage()
+        if err != nil {
+            log.Printf("read error: %v", err)
+            return
+        }
+        switch msg.Type {
+        case tunnel.TypeResponse:
+            if stVal, ok := c.pending.Load(msg.Response.ID); ok {
+                st := stVal.(*stream)
+                select {
+                case st.resp <- *msg.Response:
+                case <-st.done:
+                    c.discardLate(msg.Response.ID)
+                }
+            } else {
+                c.discardLate(msg.Response.ID)
+            }
+        case tunnel.TypeWSFrame:
+            if stVal, ok := c.pending.Load(msg.Frame.ID); ok && !stVal.(*stream).overflowed {
+                st := stVal.(*stream)
+                select {
+                case st.frames <- *msg.Frame:
+                case <-st.done:
+                default:
+                    // Waiting for a visitor that stopped reading would hold
+                    // up every other stream; end this one instead.
+                    log.Printf("websocket %d: visitor not reading, closing", st.id)
+                    st.overflowed = true
+                    close(st.frames)
+                }
+            }
+        case tunnel.TypeReset:
+            if stVal, ok := c.pending.Load(msg.Reset.ID); ok {
+                stVal.(*stream).body.CloseWithError(fmt.Errorf("stream reset by client: %s", msg.Reset.Reason))
+            } else {
+                for _, u := range c.udp {
+                    if u.drop(msg.Reset.ID) {
+                        break
+                    }
+                }
+            }
+        case tunnel.TypeDatagram:
+            for _, u := range c.udp {
+                if u.deliver(*msg.Datagram) {
+                    break
+                }
+            }
+        case tunnel.TypeBind:
+            if c.bind != nil {
+                c.bind(*msg.Bound)
+            }
+        case tunnel.TypeData:
+            if stVal, ok := c.pending.Load(msg.Data.ID); ok {
+                st := stVal.(*stream)
+                if len(msg.Data.Body) > 0 {
+                    st.body.Write(msg.Data.Body)
+                }
+                if msg.Data.End {
+                    select {
+                    case <-st.ended:
+                    default:
+                        st.trailers = msg.Data.Trailers
+                        close(st.ended)
+                    }
+                    st.body.Close()
+                }
+            } else {
+                c.conn.Discard(msg.Data.ID, len(msg.Data.Body))
+            }
+        }
+    }
+}
+
+// discardLate drops a response whose stream was cancelled or timed out.
+func (c *Client) discardLate(id uint32) {
+    n := c.late.Add(1)
+    log.Printf("discarded late response for stream %d (%d so far)", id, n)
+}
+
+// flushWriter flushes after every write so streamed responses reach the visitor
+// as chunks arrive from the tunnel.
+type flushWriter struct {
+    w http.ResponseWriter
+}
+
+func (f flushWriter) Write(p []byte) (int, error) {
+    n, err := f.w.Write(p)
+    if fl, ok := f.w.(http.Flusher); ok {
+        fl.Flush()
+    }
+    return n, err
 }
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"log"
+	"math/big"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/quic-go/quic-go"
+
+	"portkey/internal/tunnel"
+)
+
+// quicTLSConfig loads the QUIC listener's certificate, or makes a self-signed
+// one for domain when no files are given. Clients then need --quic-insecure.
+func quicTLSConfig(certFile, keyFile, domain string) (*tls.Config, error) {
+    var cert tls.Certificate
+    var err error
+    if certFile != "" || keyFile != "" {
+        cert, err = tls.LoadX509KeyPair(certFile, keyFile)
+    } else {
+        cert, err = selfSignedCert(domain)
+    }
+    if err != nil {
+        return nil, err
+    }
+    return &tls.Config{Certificates: []tls.Certificate{cert}, NextProtos: []string{tunnel.QUICProtocol}}, nil
+}
+
+func selfSignedCert(domain string) (tls.Certificate, error) {
+    key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+    if err != nil {
+        return tls.Certificate{}, err
+    }
+    tmpl := x509.Certificate{
+        SerialNumber: big.NewInt(time.Now().UnixNano()),
+        Subject:      pkix.Name{CommonName: domain},
+        DNSNames:     []string{domain},
+        NotBefore:    time.Now().Add(-time.Hour),
+        NotAfter:     time.Now().Add(365 * 24 * time.Hour),
+        KeyUsage:     x509.KeyUsageDigitalSignature,
+        ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+    }
+    der, err := x509.CreateCertificate(rand.Reader, &tmpl, &tmpl, &key.PublicKey, key)
+    if err != nil {
+        return tls.Certificate{}, err
+    }
+    return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
+
+// serveQUIC admits tunnels arriving over QUIC exactly as /connect admits them
+// over a WebSocket.
+func serveQUIC(ln *quic.Listener, admit func(url.Values) (*admission, int, string), attach func(*admission, tunnel.Transport, string)) {
+    for {
+        conn, err := ln.Accept(context.Background())
+        if err != nil {
+            if err != quic.ErrServerClosed {
+                log.Printf("quic accept: %v", err)
+            }
+            return
+        }
+        go func() {
+            ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+            sess, req, err := tunnel.AcceptQUIC(ctx, conn)
+            cancel()
+            if err != nil {
+                log.Printf("quic handshake from %s: %v", conn.RemoteAddr(), err)
+                return
+            }
+            _, query, _ := strings.Cut(req.Path, "?")
+            q, _ := url.ParseQuery(query)
+            a, status, reason := admit(q)
+            if a == nil {
+                sess.Refuse(status, reason)
+                return
+            }
+            if err := sess.Admit(); err != nil {
+                a.release()
+                return
+            }
+            attach(a, sess, "quic")
+        }()
+    }
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"time"
+
+	"github.com/google/uuid"
+
+	"portkey/internal/logstore"
+	"portkey/internal/tunnel"
+)
+
+// serveTCP accepts visitor connections on ln and relays each over its own
+// stream until ln is closed.
+func serveTCP(ln net.Listener, client *route, port int, record func(logstore.Entry)) {
+    for {
+        conn, err := ln.Accept()
+        if err != nil {
+            return
+        }
+        go proxyTCP(conn, client, port, record)
+    }
+}
+
+// proxyTCP pipes one visitor connection through the tunnel. Each direction is
+// half-closed independently so protocols that shut down their write side first
+// keep working.
+func proxyTCP(conn net.Conn, client *route, port int, record func(logstore.Entry)) {
+    defer conn.Close()
+    st, pr := client.openStream()
+    defer client.closeStream(st, pr)
+
+    open := tunnel.Request{ID: st.id, RemoteAddr: conn.RemoteAddr().String(), Tunnel: client.name}
+    if err := client.send(tunnel.Message{Type: tunnel.TypeTCPOpen, Request: &open}); err != nil {
+        return
+    }
+    start := time.Now()
+
+    var in byteCounter
+    upDone := make(chan struct{})
+    go func() {
+        defer close(upDone)
+        tunnel.SendBody(st.id, io.TeeReader(conn, &in), nil, client.send)
+    }()
+
+    out, err := io.Copy(conn, pr)
+    if err != nil {
+        log.Printf("tcp :%d stream %d: %v", port, st.id, err)
+        conn.Close()
+    } else if tc, ok := conn.(*net.TCPConn); ok {
+        tc.CloseWrite()
+    }
+    <-upDone
+
+    record(logstore.Entry{
+        ID:        uuid.New().String(),
+        Subdomain: fmt.Sprintf("tcp:%d", port),
+        Method:    "TCP",
+        Path:      open.RemoteAddr,
+        ClientIP:  conn.RemoteAddr().(*net.TCPAddr).IP.String(),
+        Timestamp: start,
+        Body:      fmt.Sprintf("%d bytes in, %d bytes out, %s", in, out, time.Since(start).Round(time.Millisecond)),
+    })
+}
+
+// byteCounter is an io.Writer that only counts what is written to it.
+type byteCounter int64
+
+func (c *byteCounter) Write(p []byte) (int, error) {
+    *c += byteCounter(len(p))
+    return len(p), nil
+}
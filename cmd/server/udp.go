@@ -0,0 +1,202 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+
+	"portkey/internal/logstore"
+	"portkey/internal/tunnel"
+)
+
+// udpRelay owns the public UDP port of one client and tracks visitors as
+// sessions keyed by source address, each expiring after idle time.
+type udpRelay struct {
+    pc     net.PacketConn
+    client *route
+    port   int
+    idle   time.Duration
+    record func(logstore.Entry)
+
+    mu     sync.Mutex
+    byAddr map[string]*udpSession
+    byID   map[uint32]*udpSession
+    // closedToNew drops datagrams that would start a session, once draining.
+    closedToNew bool
+}
+
+type udpSession struct {
+    id       uint32
+    addr     net.Addr
+    started  time.Time
+    lastSeen time.Time
+    in, out  int
+}
+
+func newUDPRelay(pc net.PacketConn, client *route, port int, idle time.Duration, record func(logstore.Entry)) *udpRelay {
+    return &udpRelay{
+        pc:     pc,
+        client: client,
+        port:   port,
+        idle:   idle,
+        record: record,
+        byAddr: make(map[string]*udpSession),
+        byID:   make(map[uint32]*udpSession),
+    }
+}
+
+// serve reads visitor datagrams and forwards them to the client until the
+// socket is closed.
+func (u *udpRelay) serve() {
+    go u.expireLoop()
+    buf := make([]byte, 64*1024)
+    for {
+        n, addr, err := u.pc.ReadFrom(buf)
+        if err != nil {
+            return
+        }
+        u.mu.Lock()
+        if u.byAddr == nil {
+            u.mu.Unlock()
+            return
+        }
+        s, ok := u.byAddr[addr.String()]
+        if !ok && u.closedToNew {
+            u.mu.Unlock()
+            continue
+        }
+        if !ok {
+            s = &udpSession{id: u.client.nextID.Add(1), addr: addr, started: time.Now()}
+            u.byAddr[addr.String()] = s
+            u.byID[s.id] = s
+        }
+        s.lastSeen = time.Now()
+        s.in++
+        u.mu.Unlock()
+
+        payload := make([]byte, n)
+        copy(payload, buf[:n])
+        dg := tunnel.Datagram{Session: s.id, Payload: payload}
+        if !ok {
+            dg.RemoteAddr, dg.Tunnel = addr.String(), u.client.name
+        }
+        if err := u.client.send(tunnel.Message{Type: tunnel.TypeDatagram, Datagram: &dg}); err != nil {
+            return
+        }
+    }
+}
+
+// stopAdmitting turns away visitors without a session; the sessions already
+// open carry on until they expire or the client goes.
+func (u *udpRelay) stopAdmitting() {
+    u.mu.Lock()
+    u.closedToNew = true
+    u.mu.Unlock()
+}
+
+// deliver writes a datagram from the client back to the session's visitor.
+// It reports whether the session is one of this relay's.
+func (u *udpRelay) deliver(dg tunnel.Datagram) bool {
+    u.mu.Lock()
+    s, ok := u.byID[dg.Session]
+    if ok {
+        s.lastSeen = time.Now()
+        s.out++
+    }
+    u.mu.Unlock()
+    if !ok {
+        return false
+    }
+    if _, err := u.pc.WriteTo(dg.Payload, s.addr); err != nil {
+        log.Printf("udp :%d session %d: %v", u.port, s.id, err)
+    }
+    return true
+}
+
+// drop ends a session, e.g. because the client couldn't reach its local target.
+// It reports whether the session was one of this relay's.
+func (u *udpRelay) drop(id uint32) bool {
+    u.mu.Lock()
+    s, ok := u.byID[id]
+    if ok {
+        u.remove(s)
+    }
+    u.mu.Unlock()
+    if ok {
+        u.logSession(s)
+    }
+    return ok
+}
+
+// expireLoop checks for idle sessions until the relay is closed. An idle
+// timeout <= 0 means sessions never expire.
+func (u *udpRelay) expireLoop() {
+    if u.idle <= 0 {
+        return
+    }
+    ticker := time.NewTicker(max(u.idle/2, time.Millisecond))
+    defer ticker.Stop()
+    for range ticker.C {
+        if !u.expire(time.Now()) {
+            return
+        }
+    }
+}
+
+// expire ends sessions idle for longer than u.idle and tells the client to
+// release their local sockets. It reports false once the relay is closed.
+func (u *udpRelay) expire(now time.Time) bool {
+    u.mu.Lock()
+    if u.byAddr == nil {
+        u.mu.Unlock()
+        return false
+    }
+    var expired []*udpSession
+    for _, s := range u.byID {
+        if now.Sub(s.lastSeen) > u.idle {
+            expired = append(expired, s)
+            u.remove(s)
+        }
+    }
+    u.mu.Unlock()
+
+    for _, s := range expired {
+        u.client.send(tunnel.Message{Type: tunnel.TypeReset, Reset: &tunnel.Reset{ID: s.id, Reason: "idle"}})
+        u.logSession(s)
+    }
+    return true
+}
+
+// close releases the socket and logs the sessions that were still open.
+func (u *udpRelay) close() {
+    u.pc.Close()
+    u.mu.Lock()
+    sessions := u.byID
+    u.byAddr, u.byID = nil, nil
+    u.mu.Unlock()
+    for _, s := range sessions {
+        u.logSession(s)
+    }
+}
+
+// remove forgets s; callers hold u.mu.
+func (u *udpRelay) remove(s *udpSession) {
+    delete(u.byAddr, s.addr.String())
+    delete(u.byID, s.id)
+}
+
+func (u *udpRelay) logSession(s *udpSession) {
+    u.record(logstore.Entry{
+        ID:        uuid.New().String(),
+        Subdomain: fmt.Sprintf("udp:%d", u.port),
+        Method:    "UDP",
+        Path:      s.addr.String(),
+        ClientIP:  s.addr.(*net.UDPAddr).IP.String(),
+        Timestamp: s.started,
+        Body:      fmt.Sprintf("%d datagrams in, %d out, %s", s.in, s.out, s.lastSeen.Sub(s.started).Round(time.Millisecond)),
+    })
+}
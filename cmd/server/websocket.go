@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+
+	"portkey/internal/forward"
+	"portkey/internal/logstore"
+	"portkey/internal/rewrite"
+	"portkey/internal/tunnel"
+)
+
+// proxyWebSocket asks the client to open a WebSocket to the local service and,
+// once it has, upgrades the visitor connection and relays frames both ways.
+func proxyWebSocket(w http.ResponseWriter, r *http.Request, client *route, sub string, record func(logstore.Entry)) {
+    if client.conn.Version() == tunnel.ProtocolLegacy {
+        http.Error(w, "tunnel client too old for WebSockets", http.StatusBadGateway)
+        return
+    }
+    vars := visitorVars(r, client, sub)
+    fwd := r.Header.Clone()
+    tunnel.StripHandshakeHeaders(fwd)
+    forward.Set(fwd, r, trustedProxies)
+    rewrite.Apply(headerRules.Request, fwd, nil, vars)
+    headers := tunnel.HeaderFrom(fwd, nil)
+    path := r.URL.RequestURI()
+
+    st, pr := client.openStream()
+    defer client.closeStream(st, pr)
+    id := st.id
+
+    open := tunnel.Request{ID: id, Method: r.Method, Path: path, Headers: headers, RemoteAddr: vars["visitor_ip"], Tunnel: client.name}
+    if err := client.send(tunnel.Message{Type: tunnel.TypeWSOpen, Request: &open}); err != nil {
+        http.Error(w, "tunnel write error", http.StatusBadGateway)
+        return
+    }
+
+    var resp tunnel.Response
+    select {
+    case resp = <-st.resp:
+    case <-client.gone:
+        http.Error(w, "tunnel disconnected", http.StatusBadGateway)
+        return
+    case <-r.Context().Done():
+        // The visitor gave up on the handshake; so can the client.
+        client.cancel(id, "visitor disconnected")
+        return
+    case <-client.limits.deadline():
+        http.Error(w, "tunnel timeout", http.StatusGatewayTimeout)
+        return
+    }
+    record(logstore.Entry{ID: uuid.New().String(), Subdomain: sub, Method: r.Method, Path: path, Status: resp.Status, ClientIP: vars["visitor_ip"], Timestamp: time.Now(), Headers: headers})
+
+    if resp.Status != http.StatusSwitchingProtocols {
+        // The local service refused the upgrade; pass its answer through.
+        for _, f := range resp.Headers {
+            w.Header().Add(f.Name, f.Value)
+        }
+        rewrite.Apply(headerRules.Response, w.Header(), nil, vars)
+        w.WriteHeader(resp.Status)
+        io.Copy(w, pr)
+        return
+    }
+
+    up := websocket.Upgrader{CheckOrigin: func(r *http.Request) bool { return true }}
+    respHeader := http.Header{}
+    for _, f := range resp.Headers {
+        switch http.CanonicalHeaderKey(f.Name) {
+        case "Sec-Websocket-Protocol":
+            up.Subprotocols = []string{f.Value}
+        case "Set-Cookie":
+            respHeader.Add(f.Name, f.Value)
+        }
+    }
+    rewrite.Apply(headerRules.Response, respHeader, nil, vars)
+    ws, err := up.Upgrade(w, r, respHeader)
+    if err != nil {
+        log.Printf("websocket upgrade %s/%d: %v", sub, id, err)
+        f := tunnel.WSFrame{ID: id, OpCode: websocket.CloseMessage, Payload: websocket.FormatCloseMessage(websocket.CloseGoingAway, "")}
+        client.send(tunnel.Message{Type: tunnel.TypeWSFrame, Frame: &f})
+        return
+    }
+
+    tunnel.RelayWebSocket(id, ws, st.frames, client.send, func(f tunnel.WSFrame, inbound bool) {
+        method := "WS-OUT"
+        if inbound {
+            method = "WS-IN"
+        }
+        record(logstore.Entry{ID: uuid.New().String(), Subdomain: sub, Method: method, Path: path, Timestamp: time.Now(), Body: describeFrame(f)})
+    })
+}
+
+// describeFrame renders a frame for the request log: text payloads verbatim
+// (truncated like any body), binary and control frames as a summary.
+func describeFrame(f tunnel.WSFrame) string {
+    switch f.OpCode {
+    case websocket.TextMessage:
+        var c logstore.BodyCapture
+        c.Write(f.Payload)
+        return c.String()
+    case websocket.CloseMessage:
+        return "[close]"
+    default:
+        return fmt.Sprintf("[binary %d bytes]", len(f.Payload))
+    }
+}
@@ -0,0 +1,83 @@
+package integration
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSubdomainAllocation(t *testing.T) {
+    tempDir := t.TempDir()
+
+    serverBin := filepath.Join(tempDir, "portkey-server")
+    clientBin := filepath.Join(tempDir, "portkey-client")
+
+    buildBinary(t, "../cmd/server", serverBin)
+    buildBinary(t, "../cmd/client", clientBin)
+
+    local := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { io.WriteString(w, "allocated") }))
+    defer local.Close()
+
+    srvPort, _ := findFreePort()
+    serverURL := fmt.Sprintf("http://127.0.0.1:%d", srvPort)
+
+    ctx, cancel := context.WithCancel(context.Background())
+    defer cancel()
+
+    authPath := filepath.Join(".", "auth.yaml")
+    srvCmd := exec.CommandContext(ctx, serverBin, "--port", fmt.Sprintf("%d", srvPort), "-auth-file", authPath, "--domain", "example.com")
+    srvCmd.Stdout, srvCmd.Stderr = os.Stdout, os.Stderr
+    if err := srvCmd.Start(); err != nil { t.Fatalf("srv: %v", err) }
+    time.Sleep(300 * time.Millisecond)
+
+    // no --subdomain: the server picks one inside the token's "team-*" pattern
+    clientCmd := exec.CommandContext(ctx, clientBin, "--server", serverURL, "--auth-token", "team789",
+        "--host", "127.0.0.1", "--port", strings.Split(local.URL, ":")[2])
+    clientCmd.Stdout = os.Stdout
+    logs, _ := clientCmd.StderrPipe()
+    if err := clientCmd.Start(); err != nil { t.Fatalf("cli: %v", err) }
+    defer func() { cancel(); clientCmd.Wait(); srvCmd.Wait() }()
+
+    forwarding := regexp.MustCompile(`Forwarding http://([a-z0-9-]+)\.example\.com`)
+    found := make(chan string, 1)
+    go func() {
+        sc := bufio.NewScanner(logs)
+        for sc.Scan() {
+            fmt.Fprintln(os.Stderr, sc.Text())
+            if m := forwarding.FindStringSubmatch(sc.Text()); m != nil {
+                found <- m[1]
+                break
+            }
+        }
+        io.Copy(os.Stderr, logs)
+    }()
+    var sub string
+    select {
+    case sub = <-found:
+    case <-time.After(5 * time.Second):
+        t.Fatalf("client didn't print its public URL")
+    }
+    if !regexp.MustCompile(`^team-[a-z]+-[a-z]+-[0-9]+$`).MatchString(sub) {
+        t.Fatalf("allocated subdomain %q is outside the token's pattern", sub)
+    }
+
+    req, _ := http.NewRequest("GET", serverURL+"/", nil)
+    req.Host = sub + ".example.com"
+    resp, err := (&http.Client{Timeout: 5 * time.Second}).Do(req)
+    if err != nil { t.Fatalf("request: %v", err) }
+    defer resp.Body.Close()
+    body, _ := io.ReadAll(resp.Body)
+    if string(body) != "allocated" {
+        t.Fatalf("%s served %d %q", sub, resp.StatusCode, body)
+    }
+}
@@ -26,8 +26,8 @@ func findFreePort() (int, error) {
     return l.Addr().(*net.TCPAddr).Port, nil
 }
 
-func buildBinary(t *testing.T, pkg, out string) {
-    cmd := exec.Command("go", "build", "-o", out, pkg)
+func buildBinary(t *testing.T, pkg, out string, flags ...string) {
+    cmd := exec.Command("go", append(append([]string{"build"}, flags...), "-o", out, pkg)...)
     cmd.Env = append(os.Environ(), "GOOS="+runtime.GOOS, "GOARCH="+runtime.GOARCH)
     if outBytes, err := cmd.CombinedOutput(); err != nil {
         t.Fatalf("build %s: %v\n%s", pkg, err, string(outBytes))
@@ -0,0 +1,65 @@
+package integration
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestVisitorCancelAbortsLocalRequest(t *testing.T) {
+    tempDir := t.TempDir()
+
+    serverBin := filepath.Join(tempDir, "portkey-server")
+    clientBin := filepath.Join(tempDir, "portkey-client")
+
+    buildBinary(t, "../cmd/server", serverBin)
+    buildBinary(t, "../cmd/client", clientBin)
+
+    // local app hangs until its request is aborted
+    aborted := make(chan struct{}, 1)
+    local := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        select {
+        case <-r.Context().Done():
+            aborted <- struct{}{}
+        case <-time.After(10 * time.Second):
+        }
+    }))
+    defer local.Close()
+    localPort := strings.Split(local.URL, ":")[2]
+
+    srvPort, _ := findFreePort()
+
+    ctx, cancel := context.WithCancel(context.Background())
+    defer cancel()
+
+    srvCmd := exec.CommandContext(ctx, serverBin, "--port", fmt.Sprintf("%d", srvPort), "--domain", "example.com")
+    srvCmd.Stdout, srvCmd.Stderr = os.Stdout, os.Stderr
+    if err := srvCmd.Start(); err != nil { t.Fatalf("srv: %v", err) }
+    time.Sleep(300 * time.Millisecond)
+
+    serverURL := fmt.Sprintf("http://127.0.0.1:%d", srvPort)
+    clientCmd := exec.CommandContext(ctx, clientBin, "--server", serverURL, "--subdomain", "slow", "--port", localPort)
+    clientCmd.Stdout, clientCmd.Stderr = os.Stdout, os.Stderr
+    if err := clientCmd.Start(); err != nil { t.Fatalf("cli: %v", err) }
+    defer func() { cancel(); clientCmd.Wait(); srvCmd.Wait() }()
+    time.Sleep(500 * time.Millisecond)
+
+    req, _ := http.NewRequest("GET", serverURL+"/wait", nil)
+    req.Host = "slow.example.com"
+    if _, err := (&http.Client{Timeout: 500 * time.Millisecond}).Do(req); err == nil {
+        t.Fatalf("expected the visitor to time out")
+    }
+
+    select {
+    case <-aborted:
+    case <-time.After(3 * time.Second):
+        t.Fatalf("local request was not aborted after the visitor left")
+    }
+}
@@ -0,0 +1,134 @@
+package integration
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestCustomDomain(t *testing.T) {
+    tempDir := t.TempDir()
+
+    serverBin := filepath.Join(tempDir, "portkey-server")
+    clientBin := filepath.Join(tempDir, "portkey-client")
+
+    buildBinary(t, "../cmd/server", serverBin)
+    buildBinary(t, "../cmd/client", clientBin)
+
+    local := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { io.WriteString(w, "custom") }))
+    defer local.Close()
+
+    // stand-in resolver: dev.ourcompany.test is a CNAME for the tunnel
+    dns := serveCNAMEs(t, map[string]string{"dev.ourcompany.test.": "project1.example.com."})
+
+    srvPort, _ := findFreePort()
+    serverURL := fmt.Sprintf("http://127.0.0.1:%d", srvPort)
+
+    ctx, cancel := context.WithCancel(context.Background())
+    defer cancel()
+
+    authPath := filepath.Join(".", "auth.yaml")
+    srvCmd := exec.CommandContext(ctx, serverBin, "--port", fmt.Sprintf("%d", srvPort), "-auth-file", authPath, "--domain", "example.com",
+        "--domains-file", filepath.Join(tempDir, "domains.json"), "--dns-resolver", dns)
+    srvCmd.Stdout, srvCmd.Stderr = os.Stdout, os.Stderr
+    if err := srvCmd.Start(); err != nil { t.Fatalf("srv: %v", err) }
+    time.Sleep(300 * time.Millisecond)
+
+    clientCmd := exec.CommandContext(ctx, clientBin, "--server", serverURL, "--subdomain", "project1", "--auth-token", "abc123",
+        "--host", "127.0.0.1", "--port", strings.Split(local.URL, ":")[2])
+    clientCmd.Stdout, clientCmd.Stderr = os.Stdout, os.Stderr
+    if err := clientCmd.Start(); err != nil { t.Fatalf("cli: %v", err) }
+    defer func() { cancel(); clientCmd.Wait(); srvCmd.Wait() }()
+    time.Sleep(500 * time.Millisecond)
+
+    hc := &http.Client{Timeout: 5 * time.Second}
+    do := func(method, path, host, body string) (int, string) {
+        req, _ := http.NewRequest(method, serverURL+path, strings.NewReader(body))
+        if host != "" {
+            req.Host = host
+        }
+        resp, err := hc.Do(req)
+        if err != nil { t.Fatalf("%s %s: %v", method, path, err) }
+        defer resp.Body.Close()
+        b, _ := io.ReadAll(resp.Body)
+        return resp.StatusCode, string(b)
+    }
+
+    if status, _ := do("POST", "/api/domains?token=abc123", "", `{"host":"dev.ourcompany.test","subdomain":"project1"}`); status != http.StatusForbidden {
+        t.Fatalf("non-admin added a domain: %d", status)
+    }
+    if status, body := do("POST", "/api/domains?token=admin456", "", `{"host":"dev.ourcompany.test","subdomain":"project1","owner":"abc123"}`); status != http.StatusCreated {
+        t.Fatalf("add domain: %d %s", status, body)
+    }
+
+    // not routed, nor given a certificate, until its CNAME checks out
+    if status, _ := do("GET", "/", "dev.ourcompany.test", ""); status != http.StatusNotFound {
+        t.Fatalf("unverified domain routed: %d", status)
+    }
+    if status, _ := do("GET", "/allow-host?host=dev.ourcompany.test", "", ""); status != http.StatusForbidden {
+        t.Fatalf("unverified domain allowed a certificate: %d", status)
+    }
+    if status, body := do("POST", "/api/domains/dev.ourcompany.test/verify?token=admin456", "", ""); status != http.StatusOK || !strings.Contains(body, `"verified":true`) {
+        t.Fatalf("verify: %d %s", status, body)
+    }
+
+    if status, body := do("GET", "/", "dev.ourcompany.test", ""); status != http.StatusOK || body != "custom" {
+        t.Fatalf("custom domain served %d %q", status, body)
+    }
+    if status, _ := do("GET", "/allow-host?host=dev.ourcompany.test", "", ""); status != http.StatusOK {
+        t.Fatalf("verified domain refused a certificate: %d", status)
+    }
+
+    // a domain whose CNAME points elsewhere stays unverified
+    do("POST", "/api/domains?token=admin456", "", `{"host":"stray.ourcompany.test","subdomain":"project1"}`)
+    if status, _ := do("POST", "/api/domains/stray.ourcompany.test/verify?token=admin456", "", ""); status != http.StatusUnprocessableEntity {
+        t.Fatalf("unresolvable domain verified: %d", status)
+    }
+}
+
+// serveCNAMEs runs a minimal DNS server on UDP answering A and AAAA queries
+// for the names in cnames with a CNAME record, and returns its address.
+func serveCNAMEs(t *testing.T, cnames map[string]string) string {
+    pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+    if err != nil { t.Fatalf("dns listen: %v", err) }
+    t.Cleanup(func() { pc.Close() })
+    go func() {
+        buf := make([]byte, 512)
+        for {
+            n, addr, err := pc.ReadFrom(buf)
+            if err != nil { return }
+            var p dnsmessage.Parser
+            hdr, err := p.Start(buf[:n])
+            if err != nil { continue }
+            q, err := p.Question()
+            if err != nil { continue }
+            b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: hdr.ID, Response: true, Authoritative: true})
+            target, ok := cnames[q.Name.String()]
+            if !ok {
+                b = dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: hdr.ID, Response: true, RCode: dnsmessage.RCodeNameError})
+            }
+            b.StartQuestions()
+            b.Question(q)
+            if ok {
+                b.StartAnswers()
+                b.CNAMEResource(dnsmessage.ResourceHeader{Name: q.Name, Class: dnsmessage.ClassINET, TTL: 60},
+                    dnsmessage.CNAMEResource{CNAME: dnsmessage.MustNewName(target)})
+            }
+            msg, err := b.Finish()
+            if err != nil { continue }
+            pc.WriteTo(msg, addr)
+        }
+    }()
+    return pc.LocalAddr().String()
+}
@@ -0,0 +1,96 @@
+package integration
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestForwardingHeadersAndProxyProtocol(t *testing.T) {
+    tempDir := t.TempDir()
+
+    serverBin := filepath.Join(tempDir, "portkey-server")
+    clientBin := filepath.Join(tempDir, "portkey-client")
+
+    buildBinary(t, "../cmd/server", serverBin)
+    buildBinary(t, "../cmd/client", clientBin)
+
+    // the local app echoes what it was told about the visitor
+    local := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        for _, h := range []string{"X-Forwarded-For", "X-Forwarded-Proto", "X-Forwarded-Host", "Forwarded"} {
+            fmt.Fprintf(w, "%s: %s\n", h, r.Header.Get(h))
+        }
+    }))
+    defer local.Close()
+
+    srvPort, _ := findFreePort()
+    serverURL := fmt.Sprintf("http://127.0.0.1:%d", srvPort)
+
+    ctx, cancel := context.WithCancel(context.Background())
+    defer cancel()
+
+    // loopback plays the load balancer
+    srvCmd := exec.CommandContext(ctx, serverBin, "--port", fmt.Sprintf("%d", srvPort), "--domain", "example.com", "--enable-web-ui",
+        "--trusted-proxies", "127.0.0.0/8", "--proxy-protocol")
+    srvCmd.Stdout, srvCmd.Stderr = os.Stdout, os.Stderr
+    if err := srvCmd.Start(); err != nil { t.Fatalf("srv: %v", err) }
+    time.Sleep(300 * time.Millisecond)
+
+    clientCmd := exec.CommandContext(ctx, clientBin, "--server", serverURL, "--subdomain", "fwd", "--host", "127.0.0.1", "--port", strings.Split(local.URL, ":")[2])
+    clientCmd.Stdout, clientCmd.Stderr = os.Stdout, os.Stderr
+    if err := clientCmd.Start(); err != nil { t.Fatalf("cli: %v", err) }
+    defer func() { cancel(); clientCmd.Wait(); srvCmd.Wait() }()
+    time.Sleep(500 * time.Millisecond)
+
+    // a PROXY v1 header names the real visitor, who isn't trusted: the
+    // X-Forwarded-For it sent itself is dropped
+    conn, err := net.DialTimeout("tcp", fmt.Sprintf("127.0.0.1:%d", srvPort), 2*time.Second)
+    if err != nil { t.Fatalf("dial: %v", err) }
+    defer conn.Close()
+    conn.SetDeadline(time.Now().Add(5 * time.Second))
+    io.WriteString(conn, "PROXY TCP4 203.0.113.7 127.0.0.1 40000 80\r\n")
+    io.WriteString(conn, "GET / HTTP/1.1\r\nHost: fwd.example.com\r\nX-Forwarded-For: 198.51.100.1\r\nConnection: close\r\n\r\n")
+    resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+    if err != nil { t.Fatalf("response: %v", err) }
+    body, _ := io.ReadAll(resp.Body)
+    resp.Body.Close()
+
+    for _, want := range []string{
+        "X-Forwarded-For: 203.0.113.7\n",
+        "X-Forwarded-Proto: http\n",
+        "X-Forwarded-Host: fwd.example.com\n",
+        "Forwarded: for=203.0.113.7;host=fwd.example.com;proto=http\n",
+    } {
+        if !strings.Contains(string(body), want) {
+            t.Errorf("local app missing %q in:\n%s", strings.TrimSpace(want), body)
+        }
+    }
+
+    // the log records the resolved visitor
+    logs, err := http.Get(serverURL + "/api/requests")
+    if err != nil { t.Fatalf("logs: %v", err) }
+    defer logs.Body.Close()
+    var entries []struct {
+        Subdomain string `json:"subdomain"`
+        ClientIP  string `json:"client_ip"`
+    }
+    json.NewDecoder(logs.Body).Decode(&entries)
+    found := false
+    for _, e := range entries {
+        found = found || (e.Subdomain == "fwd" && e.ClientIP == "203.0.113.7")
+    }
+    if !found {
+        t.Errorf("no log entry with the visitor's IP: %+v", entries)
+    }
+}
@@ -0,0 +1,92 @@
+package integration
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+)
+
+func TestGRPCOverH2C(t *testing.T) {
+    tempDir := t.TempDir()
+
+    serverBin := filepath.Join(tempDir, "portkey-server")
+    clientBin := filepath.Join(tempDir, "portkey-client")
+
+    buildBinary(t, "../cmd/server", serverBin)
+    buildBinary(t, "../cmd/client", clientBin)
+
+    // local gRPC server with the standard health service
+    lis, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil { t.Fatalf("listen: %v", err) }
+    healthSrv := health.NewServer()
+    grpcSrv := grpc.NewServer()
+    healthpb.RegisterHealthServer(grpcSrv, healthSrv)
+    go grpcSrv.Serve(lis)
+    defer grpcSrv.Stop()
+    localPort := lis.Addr().(*net.TCPAddr).Port
+
+    srvPort, _ := findFreePort()
+
+    ctx, cancel := context.WithCancel(context.Background())
+    defer cancel()
+
+    srvCmd := exec.CommandContext(ctx, serverBin, "--port", fmt.Sprintf("%d", srvPort), "--domain", "example.com")
+    srvCmd.Stdout, srvCmd.Stderr = os.Stdout, os.Stderr
+    if err := srvCmd.Start(); err != nil { t.Fatalf("srv: %v", err) }
+    time.Sleep(300 * time.Millisecond)
+
+    serverURL := fmt.Sprintf("http://127.0.0.1:%d", srvPort)
+    clientCmd := exec.CommandContext(ctx, clientBin, "--server", serverURL, "--subdomain", "rpc", "--port", fmt.Sprintf("%d", localPort), "--upstream-proto", "h2c")
+    clientCmd.Stdout, clientCmd.Stderr = os.Stdout, os.Stderr
+    if err := clientCmd.Start(); err != nil { t.Fatalf("cli: %v", err) }
+    defer func() { cancel(); clientCmd.Wait(); srvCmd.Wait() }()
+    time.Sleep(500 * time.Millisecond)
+
+    conn, err := grpc.NewClient(fmt.Sprintf("127.0.0.1:%d", srvPort),
+        grpc.WithTransportCredentials(insecure.NewCredentials()), grpc.WithAuthority("rpc.example.com"))
+    if err != nil { t.Fatalf("grpc client: %v", err) }
+    defer conn.Close()
+    hc := healthpb.NewHealthClient(conn)
+
+    rpcCtx, rpcCancel := context.WithTimeout(ctx, 5*time.Second)
+    defer rpcCancel()
+
+    // unary call: the status comes back in trailers
+    res, err := hc.Check(rpcCtx, &healthpb.HealthCheckRequest{})
+    if err != nil { t.Fatalf("check: %v", err) }
+    if res.Status != healthpb.HealthCheckResponse_SERVING {
+        t.Fatalf("status = %v", res.Status)
+    }
+    _, err = hc.Check(rpcCtx, &healthpb.HealthCheckRequest{Service: "missing"})
+    if status.Code(err) != codes.NotFound {
+        t.Fatalf("check of unknown service: %v, want NotFound", err)
+    }
+
+    // server streaming: updates arrive while the call stays open
+    watch, err := hc.Watch(rpcCtx, &healthpb.HealthCheckRequest{Service: "db"})
+    if err != nil { t.Fatalf("watch: %v", err) }
+    healthSrv.SetServingStatus("db", healthpb.HealthCheckResponse_SERVING)
+    for {
+        res, err := watch.Recv()
+        if err != nil { t.Fatalf("watch recv: %v", err) }
+        if res.Status == healthpb.HealthCheckResponse_SERVING {
+            break
+        }
+    }
+    healthSrv.SetServingStatus("db", healthpb.HealthCheckResponse_NOT_SERVING)
+    if res, err := watch.Recv(); err != nil || res.Status != healthpb.HealthCheckResponse_NOT_SERVING {
+        t.Fatalf("second update: %v, %v", res, err)
+    }
+}
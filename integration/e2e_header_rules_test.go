@@ -0,0 +1,71 @@
+package integration
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHeaderRules(t *testing.T) {
+    tempDir := t.TempDir()
+
+    serverBin := filepath.Join(tempDir, "portkey-server")
+    clientBin := filepath.Join(tempDir, "portkey-client")
+
+    buildBinary(t, "../cmd/server", serverBin)
+    buildBinary(t, "../cmd/client", clientBin)
+
+    // the local app reports the request headers the rules touch
+    local := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        w.Header().Set("X-Internal", "secret")
+        fmt.Fprintf(w, "host=%s origin=%q visitor=%s tunnel=%s", r.Host, r.Header.Get("Origin"), r.Header.Get("X-Visitor"), r.Header.Get("X-Tunnel"))
+    }))
+    defer local.Close()
+
+    srvPort, _ := findFreePort()
+    serverURL := fmt.Sprintf("http://127.0.0.1:%d", srvPort)
+
+    ctx, cancel := context.WithCancel(context.Background())
+    defer cancel()
+
+    // server-wide rules, then the tunnel's own
+    srvCmd := exec.CommandContext(ctx, serverBin, "--port", fmt.Sprintf("%d", srvPort), "--domain", "example.com",
+        "--request-header", "set X-Visitor: {visitor_ip}", "--response-header", "set X-Served-By: portkey")
+    srvCmd.Stdout, srvCmd.Stderr = os.Stdout, os.Stderr
+    if err := srvCmd.Start(); err != nil { t.Fatalf("srv: %v", err) }
+    time.Sleep(300 * time.Millisecond)
+
+    clientCmd := exec.CommandContext(ctx, clientBin, "--server", serverURL, "--subdomain", "rules", "--host", "127.0.0.1", "--port", strings.Split(local.URL, ":")[2],
+        "--request-header", "set Host: app.local", "--request-header", "remove Origin", "--request-header", "set X-Tunnel: {tunnel}",
+        "--response-header", "remove X-Internal")
+    clientCmd.Stdout, clientCmd.Stderr = os.Stdout, os.Stderr
+    if err := clientCmd.Start(); err != nil { t.Fatalf("cli: %v", err) }
+    defer func() { cancel(); clientCmd.Wait(); srvCmd.Wait() }()
+    time.Sleep(500 * time.Millisecond)
+
+    req, _ := http.NewRequest("GET", serverURL+"/", nil)
+    req.Host = "rules.example.com"
+    req.Header.Set("Origin", "https://elsewhere.test")
+    resp, err := (&http.Client{Timeout: 5 * time.Second}).Do(req)
+    if err != nil { t.Fatalf("request: %v", err) }
+    defer resp.Body.Close()
+    body, _ := io.ReadAll(resp.Body)
+
+    if want := `host=app.local origin="" visitor=127.0.0.1 tunnel=rules`; string(body) != want {
+        t.Errorf("local app saw %q, want %q", body, want)
+    }
+    if resp.Header.Get("X-Internal") != "" {
+        t.Errorf("X-Internal leaked to the visitor")
+    }
+    if resp.Header.Get("X-Served-By") != "portkey" {
+        t.Errorf("server response rule not applied: %v", resp.Header)
+    }
+}
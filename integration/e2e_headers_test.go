@@ -0,0 +1,111 @@
+package integration
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRepeatedHeadersAndTrailers(t *testing.T) {
+    t.Run("plain", func(t *testing.T) { testRepeatedHeadersAndTrailers(t) })
+    // the client hands trailers to net/http while its transport is busy with
+    // the request, so check that under the race detector too
+    t.Run("race", func(t *testing.T) { testRepeatedHeadersAndTrailers(t, "-race") })
+}
+
+func testRepeatedHeadersAndTrailers(t *testing.T, buildFlags ...string) {
+    tempDir := t.TempDir()
+
+    serverBin := filepath.Join(tempDir, "portkey-server")
+    clientBin := filepath.Join(tempDir, "portkey-client")
+
+    buildBinary(t, "../cmd/server", serverBin, buildFlags...)
+    buildBinary(t, "../cmd/client", clientBin, buildFlags...)
+
+    // local app echoes the request's Accept values and trailer, and sets two
+    // cookies plus a trailer of its own
+    local := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        io.ReadAll(r.Body)
+        w.Header().Set("Trailer", "X-Checksum")
+        w.Header().Add("Set-Cookie", "a=1")
+        w.Header().Add("Set-Cookie", "b=2")
+        w.Header()["X-Accept"] = r.Header["Accept"]
+        io.WriteString(w, "trailer="+r.Trailer.Get("X-Upload-Sum"))
+        w.Header().Set("X-Checksum", "abc")
+    }))
+    defer local.Close()
+    localPort := strings.Split(local.URL, ":")[2]
+
+    srvPort, _ := findFreePort()
+
+    ctx, cancel := context.WithCancel(context.Background())
+    defer cancel()
+
+    srvCmd := exec.CommandContext(ctx, serverBin, "--port", fmt.Sprintf("%d", srvPort), "--domain", "example.com")
+    var races syncBuffer
+    srvCmd.Stdout, srvCmd.Stderr = os.Stdout, io.MultiWriter(os.Stderr, &races)
+    if err := srvCmd.Start(); err != nil { t.Fatalf("srv: %v", err) }
+    time.Sleep(300 * time.Millisecond)
+
+    serverURL := fmt.Sprintf("http://127.0.0.1:%d", srvPort)
+    clientCmd := exec.CommandContext(ctx, clientBin, "--server", serverURL, "--subdomain", "multi", "--port", localPort)
+    clientCmd.Stdout, clientCmd.Stderr = os.Stdout, io.MultiWriter(os.Stderr, &races)
+    if err := clientCmd.Start(); err != nil { t.Fatalf("cli: %v", err) }
+    defer func() { cancel(); clientCmd.Wait(); srvCmd.Wait() }()
+    time.Sleep(500 * time.Millisecond)
+
+    req, _ := http.NewRequest("POST", serverURL+"/", io.NopCloser(strings.NewReader("payload")))
+    req.Host = "multi.example.com"
+    req.Header.Add("Accept", "text/html")
+    req.Header.Add("Accept", "application/json")
+    req.Trailer = http.Header{"X-Upload-Sum": {"42"}}
+    resp, err := (&http.Client{Timeout: 5 * time.Second}).Do(req)
+    if err != nil { t.Fatalf("request: %v", err) }
+    defer resp.Body.Close()
+    body, _ := io.ReadAll(resp.Body)
+
+    if got := resp.Header["Set-Cookie"]; !reflect.DeepEqual(got, []string{"a=1", "b=2"}) {
+        t.Fatalf("Set-Cookie values = %q", got)
+    }
+    if got := resp.Header["X-Accept"]; !reflect.DeepEqual(got, []string{"text/html", "application/json"}) {
+        t.Fatalf("Accept values = %q", got)
+    }
+    if string(body) != "trailer=42" {
+        t.Fatalf("request trailer not relayed: %q", body)
+    }
+    if got := resp.Trailer.Get("X-Checksum"); got != "abc" {
+        t.Fatalf("response trailer = %q", got)
+    }
+    if strings.Contains(races.String(), "DATA RACE") {
+        t.Fatalf("race detector fired")
+    }
+}
+
+// syncBuffer collects the output of several processes at once.
+type syncBuffer struct {
+    mu  sync.Mutex
+    buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    return b.buf.String()
+}
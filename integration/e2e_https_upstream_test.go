@@ -0,0 +1,91 @@
+package integration
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHTTPSUpstream(t *testing.T) {
+    tempDir := t.TempDir()
+
+    serverBin := filepath.Join(tempDir, "portkey-server")
+    clientBin := filepath.Join(tempDir, "portkey-client")
+
+    buildBinary(t, "../cmd/server", serverBin)
+    buildBinary(t, "../cmd/client", clientBin)
+
+    // TLS-only local app that wants a client certificate and reports what it saw
+    local := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        fmt.Fprintf(w, "host=%s sni=%s certs=%d", r.Host, r.TLS.ServerName, len(r.TLS.PeerCertificates))
+    }))
+    local.TLS = &tls.Config{ClientAuth: tls.RequireAnyClientCert}
+    local.StartTLS()
+    defer local.Close()
+    localPort := strings.Split(local.URL, ":")[2]
+
+    // trust the app's certificate, and give the client one of its own
+    caFile := filepath.Join(tempDir, "ca.pem")
+    os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: local.Certificate().Raw}), 0o600)
+    certFile, keyFile := filepath.Join(tempDir, "client.pem"), filepath.Join(tempDir, "client-key.pem")
+    writeClientCert(t, certFile, keyFile)
+
+    srvPort, _ := findFreePort()
+
+    ctx, cancel := context.WithCancel(context.Background())
+    defer cancel()
+
+    srvCmd := exec.CommandContext(ctx, serverBin, "--port", fmt.Sprintf("%d", srvPort), "--domain", "example.com")
+    srvCmd.Stdout, srvCmd.Stderr = os.Stdout, os.Stderr
+    if err := srvCmd.Start(); err != nil { t.Fatalf("srv: %v", err) }
+    time.Sleep(300 * time.Millisecond)
+
+    serverURL := fmt.Sprintf("http://127.0.0.1:%d", srvPort)
+    clientCmd := exec.CommandContext(ctx, clientBin, "--server", serverURL, "--subdomain", "secure", "--host", "127.0.0.1", "--port", localPort,
+        "--upstream-scheme", "https", "--upstream-ca", caFile, "--upstream-cert", certFile, "--upstream-key", keyFile,
+        "--upstream-sni", "example.com", "--upstream-host", "app.internal")
+    clientCmd.Stdout, clientCmd.Stderr = os.Stdout, os.Stderr
+    if err := clientCmd.Start(); err != nil { t.Fatalf("cli: %v", err) }
+    defer func() { cancel(); clientCmd.Wait(); srvCmd.Wait() }()
+    time.Sleep(500 * time.Millisecond)
+
+    req, _ := http.NewRequest("GET", serverURL+"/", nil)
+    req.Host = "secure.example.com"
+    resp, err := (&http.Client{Timeout: 5 * time.Second}).Do(req)
+    if err != nil { t.Fatalf("request: %v", err) }
+    defer resp.Body.Close()
+    body, _ := io.ReadAll(resp.Body)
+    if resp.StatusCode != http.StatusOK || string(body) != "host=app.internal sni=example.com certs=1" {
+        t.Fatalf("unexpected response: %d %q", resp.StatusCode, body)
+    }
+}
+
+// writeClientCert writes a self-signed client certificate and its key as PEM.
+func writeClientCert(t *testing.T, certFile, keyFile string) {
+    key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+    tmpl := x509.Certificate{
+        SerialNumber: big.NewInt(1),
+        NotAfter:     time.Now().Add(time.Hour),
+        ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+    }
+    der, err := x509.CreateCertificate(rand.Reader, &tmpl, &tmpl, &key.PublicKey, key)
+    if err != nil { t.Fatalf("certificate: %v", err) }
+    keyDER, _ := x509.MarshalECPrivateKey(key)
+    os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600)
+    os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600)
+}
@@ -0,0 +1,132 @@
+package integration
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"portkey/internal/logstore"
+)
+
+func TestClientInspector(t *testing.T) {
+    tempDir := t.TempDir()
+
+    serverBin := filepath.Join(tempDir, "portkey-server")
+    clientBin := filepath.Join(tempDir, "portkey-client")
+
+    buildBinary(t, "../cmd/server", serverBin)
+    buildBinary(t, "../cmd/client", clientBin)
+
+    local := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        body, _ := io.ReadAll(r.Body)
+        w.Header().Set("X-Echo", "yes")
+        fmt.Fprintf(w, "echo: %s", body)
+    }))
+    defer local.Close()
+
+    srvPort, _ := findFreePort()
+    serverURL := fmt.Sprintf("http://127.0.0.1:%d", srvPort)
+    inspectPort, _ := findFreePort()
+    inspectURL := fmt.Sprintf("http://127.0.0.1:%d", inspectPort)
+
+    ctx, cancel := context.WithCancel(context.Background())
+    defer cancel()
+
+    srvCmd := exec.CommandContext(ctx, serverBin, "--port", fmt.Sprintf("%d", srvPort), "--domain", "example.com")
+    srvCmd.Stdout, srvCmd.Stderr = os.Stdout, os.Stderr
+    if err := srvCmd.Start(); err != nil { t.Fatalf("srv: %v", err) }
+    time.Sleep(300 * time.Millisecond)
+
+    clientCmd := exec.CommandContext(ctx, clientBin, "--server", serverURL, "--subdomain", "hooks", "--host", "127.0.0.1", "--port", strings.Split(local.URL, ":")[2],
+        "--inspect", fmt.Sprintf("127.0.0.1:%d", inspectPort))
+    clientCmd.Stdout, clientCmd.Stderr = os.Stdout, os.Stderr
+    if err := clientCmd.Start(); err != nil { t.Fatalf("cli: %v", err) }
+    defer func() { cancel(); clientCmd.Wait(); srvCmd.Wait() }()
+    time.Sleep(500 * time.Millisecond)
+
+    hc := &http.Client{Timeout: 5 * time.Second}
+    webhook := func(body string) {
+        t.Helper()
+        req, _ := http.NewRequest("POST", serverURL+"/hook", strings.NewReader(body))
+        req.Host = "hooks.example.com"
+        resp, err := hc.Do(req)
+        if err != nil { t.Fatalf("webhook: %v", err) }
+        io.Copy(io.Discard, resp.Body)
+        resp.Body.Close()
+    }
+    getJSON := func(path string, v any) {
+        t.Helper()
+        resp, err := hc.Get(inspectURL + path)
+        if err != nil { t.Fatalf("GET %s: %v", path, err) }
+        defer resp.Body.Close()
+        if resp.StatusCode != http.StatusOK { t.Fatalf("GET %s: status %d", path, resp.StatusCode) }
+        if err := json.NewDecoder(resp.Body).Decode(v); err != nil { t.Fatalf("GET %s: %v", path, err) }
+    }
+
+    webhook(`{"event":"push"}`)
+    time.Sleep(100 * time.Millisecond)
+
+    var entries []logstore.Entry
+    getJSON("/api/requests", &entries)
+    if len(entries) != 1 {
+        t.Fatalf("inspector holds %d requests, want 1", len(entries))
+    }
+    e := entries[0]
+    if e.Subdomain != "hooks" || e.Method != "POST" || e.Path != "/hook" || e.Status != http.StatusOK {
+        t.Errorf("recorded %s %s%s -> %d", e.Method, e.Subdomain, e.Path, e.Status)
+    }
+    if e.Body != `{"event":"push"}` || e.ResponseBody != `echo: {"event":"push"}` || e.ResponseHeaders.Get("X-Echo") != "yes" {
+        t.Errorf("recorded request body %q, response body %q, headers %v", e.Body, e.ResponseBody, e.ResponseHeaders)
+    }
+    var one logstore.Entry
+    getJSON("/api/requests/"+e.ID, &one)
+    if one.ID != e.ID {
+        t.Errorf("lookup by id returned %q, want %q", one.ID, e.ID)
+    }
+    var tunnels []string
+    getJSON("/api/tunnels", &tunnels)
+    if len(tunnels) != 1 || tunnels[0] != "hooks" {
+        t.Errorf("tunnels %v, want [hooks]", tunnels)
+    }
+
+    // the dashboard itself, with no token to ask for
+    resp, err := hc.Get(inspectURL + "/")
+    if err != nil { t.Fatalf("dashboard: %v", err) }
+    page, _ := io.ReadAll(resp.Body)
+    resp.Body.Close()
+    if resp.StatusCode != http.StatusOK || !strings.Contains(string(page), "app.js") {
+        t.Errorf("dashboard: status %d", resp.StatusCode)
+    }
+
+    // live updates
+    ws, _, err := websocket.DefaultDialer.Dial(fmt.Sprintf("ws://127.0.0.1:%d/api/ws", inspectPort), nil)
+    if err != nil { t.Fatalf("ws: %v", err) }
+    defer ws.Close()
+    webhook("second")
+    ws.SetReadDeadline(time.Now().Add(3 * time.Second))
+    var live logstore.Entry
+    if err := ws.ReadJSON(&live); err != nil || live.Body != "second" {
+        t.Errorf("live update %+v, err %v", live, err)
+    }
+
+    // a page on another site whose name resolves here can't read it
+    req, _ := http.NewRequest("GET", inspectURL+"/api/requests", nil)
+    req.Host = "attacker.example:4040"
+    resp, err = hc.Do(req)
+    if err != nil { t.Fatalf("rebound host: %v", err) }
+    resp.Body.Close()
+    if resp.StatusCode != http.StatusForbidden {
+        t.Errorf("request for a foreign host: status %d, want 403", resp.StatusCode)
+    }
+}
@@ -0,0 +1,105 @@
+package integration
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// baselineRequest and baselineResponse are the messages clients spoke before
+// protocol versions were negotiated.
+type baselineRequest struct {
+    ID      string            `json:"id"`
+    Method  string            `json:"method"`
+    Path    string            `json:"path"`
+    Headers map[string]string `json:"headers"`
+    Body    []byte            `json:"body"`
+}
+
+type baselineResponse struct {
+    ID      string            `json:"id"`
+    Status  int               `json:"status"`
+    Headers map[string]string `json:"headers"`
+    Body    []byte            `json:"body"`
+}
+
+func TestBaselineClient(t *testing.T) {
+    tempDir := t.TempDir()
+
+    serverBin := filepath.Join(tempDir, "portkey-server")
+    buildBinary(t, "../cmd/server", serverBin)
+
+    srvPort, _ := findFreePort()
+    serverURL := fmt.Sprintf("http://127.0.0.1:%d", srvPort)
+
+    ctx, cancel := context.WithCancel(context.Background())
+    defer cancel()
+
+    srvCmd := exec.CommandContext(ctx, serverBin, "--port", fmt.Sprintf("%d", srvPort), "--domain", "example.com")
+    srvCmd.Stdout, srvCmd.Stderr = os.Stdout, os.Stderr
+    if err := srvCmd.Start(); err != nil { t.Fatalf("srv: %v", err) }
+    defer func() { cancel(); srvCmd.Wait() }()
+    time.Sleep(300 * time.Millisecond)
+
+    // connect the way the original client did: no protocol header, one JSON
+    // request in and one JSON response out, answered like a local echo service
+    ws, _, err := websocket.DefaultDialer.Dial(fmt.Sprintf("ws://127.0.0.1:%d/connect?subdomain=old", srvPort), nil)
+    if err != nil { t.Fatalf("dial: %v", err) }
+    defer ws.Close()
+    go func() {
+        for {
+            var req baselineRequest
+            if err := ws.ReadJSON(&req); err != nil {
+                return
+            }
+            ws.WriteJSON(baselineResponse{
+                ID:      req.ID,
+                Status:  http.StatusCreated,
+                Headers: map[string]string{"Content-Type": "text/plain", "X-Seen-Header": req.Headers["X-Test"]},
+                Body:    []byte(fmt.Sprintf("%s %s: %s", req.Method, req.Path, req.Body)),
+            })
+        }
+    }()
+    time.Sleep(200 * time.Millisecond)
+
+    hc := &http.Client{Timeout: 5 * time.Second}
+    body := bytes.Repeat([]byte("a"), 100<<10) // several chunks on the server's side
+    req, _ := http.NewRequest("POST", serverURL+"/hook?x=1", bytes.NewReader(body))
+    req.Host = "old.example.com"
+    req.Header.Set("X-Test", "yes")
+    resp, err := hc.Do(req)
+    if err != nil { t.Fatalf("request: %v", err) }
+    got, _ := io.ReadAll(resp.Body)
+    resp.Body.Close()
+    if resp.StatusCode != http.StatusCreated || resp.Header.Get("X-Seen-Header") != "yes" {
+        t.Errorf("status %d, X-Seen-Header %q", resp.StatusCode, resp.Header.Get("X-Seen-Header"))
+    }
+    if want := "POST /hook?x=1: " + string(body); string(got) != want {
+        t.Errorf("body %.40q… (%d bytes), want %d bytes", got, len(got), len(want))
+    }
+
+    // WebSockets didn't exist yet; the visitor is told instead of left hanging
+    vreq, _ := http.NewRequest("GET", serverURL+"/socket", nil)
+    vreq.Host = "old.example.com"
+    vreq.Header.Set("Connection", "Upgrade")
+    vreq.Header.Set("Upgrade", "websocket")
+    vreq.Header.Set("Sec-WebSocket-Version", "13")
+    vreq.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+    resp, err = hc.Do(vreq)
+    if err != nil { t.Fatalf("websocket: %v", err) }
+    msg, _ := io.ReadAll(resp.Body)
+    resp.Body.Close()
+    if resp.StatusCode != http.StatusBadGateway || !strings.Contains(string(msg), "too old") {
+        t.Errorf("websocket to an old client: status %d %q", resp.StatusCode, msg)
+    }
+}
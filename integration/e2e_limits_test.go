@@ -0,0 +1,145 @@
+package integration
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTimeoutsAndBodyLimits(t *testing.T) {
+    tempDir := t.TempDir()
+
+    serverBin := filepath.Join(tempDir, "portkey-server")
+    clientBin := filepath.Join(tempDir, "portkey-client")
+
+    buildBinary(t, "../cmd/server", serverBin)
+    buildBinary(t, "../cmd/client", clientBin)
+
+    big := bytes.Repeat([]byte("x"), 2<<20)
+    local := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        switch r.URL.Path {
+        case "/slow":
+            time.Sleep(1500 * time.Millisecond)
+        case "/slower":
+            time.Sleep(4 * time.Second)
+        case "/big":
+            w.Header().Set("Content-Length", fmt.Sprint(len(big)))
+            w.Write(big)
+            return
+        case "/stream":
+            // no Content-Length, so the limit is only noticed on the way
+            for i := 0; i < 4; i++ {
+                w.Write(big[:1<<19])
+                w.(http.Flusher).Flush()
+            }
+            return
+        }
+        n, _ := io.Copy(io.Discard, r.Body)
+        fmt.Fprintf(w, "got %d bytes", n)
+    }))
+    defer local.Close()
+    localPort := strings.Split(local.URL, ":")[2]
+
+    srvPort, _ := findFreePort()
+    serverURL := fmt.Sprintf("http://127.0.0.1:%d", srvPort)
+
+    ctx, cancel := context.WithCancel(context.Background())
+    defer cancel()
+
+    srvCmd := exec.CommandContext(ctx, serverBin, "--port", fmt.Sprintf("%d", srvPort), "--domain", "example.com",
+        "--request-timeout", "1s", "--max-tunnel-timeout", "3s", "--max-request-body", "1MB")
+    srvCmd.Stdout, srvCmd.Stderr = os.Stdout, os.Stderr
+    if err := srvCmd.Start(); err != nil { t.Fatalf("srv: %v", err) }
+    time.Sleep(300 * time.Millisecond)
+
+    // one tunnel on the server's defaults, one asking for more time (more
+    // than it may have) and a smaller response limit
+    plain := exec.CommandContext(ctx, clientBin, "--server", serverURL, "--subdomain", "plain", "--host", "127.0.0.1", "--port", localPort)
+    reports := exec.CommandContext(ctx, clientBin, "--server", serverURL, "--subdomain", "reports", "--host", "127.0.0.1", "--port", localPort,
+        "--request-timeout", "1h", "--max-response-body", "1MB")
+    for _, c := range []*exec.Cmd{plain, reports} {
+        c.Stdout, c.Stderr = os.Stdout, os.Stderr
+        if err := c.Start(); err != nil { t.Fatalf("cli: %v", err) }
+    }
+    defer func() { cancel(); plain.Wait(); reports.Wait(); srvCmd.Wait() }()
+    time.Sleep(500 * time.Millisecond)
+
+    hc := &http.Client{Timeout: 10 * time.Second}
+    do := func(method, sub, path string, body io.Reader) (*http.Response, error) {
+        req, _ := http.NewRequest(method, serverURL+path, body)
+        req.Host = sub + ".example.com"
+        return hc.Do(req)
+    }
+    status := func(method, sub, path string, body io.Reader) int {
+        t.Helper()
+        resp, err := do(method, sub, path, body)
+        if err != nil { t.Fatalf("%s %s%s: %v", method, sub, path, err) }
+        defer resp.Body.Close()
+        io.Copy(io.Discard, resp.Body)
+        return resp.StatusCode
+    }
+
+    if got := status("GET", "plain", "/slow", nil); got != http.StatusGatewayTimeout {
+        t.Errorf("slow response on default timeout: status %d, want 504", got)
+    }
+    if got := status("GET", "reports", "/slow", nil); got != http.StatusOK {
+        t.Errorf("slow response on raised timeout: status %d, want 200", got)
+    }
+    if got := status("GET", "reports", "/slower", nil); got != http.StatusGatewayTimeout {
+        t.Errorf("timeout beyond the server's maximum: status %d, want 504", got)
+    }
+
+    // a declared length is refused up front, a chunked body once it overflows
+    tooBig := big[:1<<20+1000]
+    if got := status("POST", "plain", "/upload", bytes.NewReader(tooBig)); got != http.StatusRequestEntityTooLarge {
+        t.Errorf("oversized body: status %d, want 413", got)
+    }
+    if got := status("POST", "plain", "/upload", io.MultiReader(bytes.NewReader(tooBig))); got != http.StatusRequestEntityTooLarge {
+        t.Errorf("oversized chunked body: status %d, want 413", got)
+    }
+    if got := status("POST", "plain", "/upload", bytes.NewReader(big[:1<<20])); got != http.StatusOK {
+        t.Errorf("body at the limit: status %d, want 200", got)
+    }
+
+    if got := status("GET", "plain", "/big", nil); got != http.StatusOK {
+        t.Errorf("large response without a limit: status %d, want 200", got)
+    }
+    if got := status("GET", "reports", "/big", nil); got != http.StatusBadGateway {
+        t.Errorf("oversized response: status %d, want 502", got)
+    }
+    resp, err := do("GET", "reports", "/stream", nil)
+    if err != nil { t.Fatalf("stream: %v", err) }
+    n, err := io.Copy(io.Discard, resp.Body)
+    resp.Body.Close()
+    if err == nil || n > 1<<20 {
+        t.Errorf("oversized streamed response: read %d bytes, err %v; want it cut off at 1MB", n, err)
+    }
+
+    // giving up on a request doesn't wait for the visitor to finish uploading
+    upload, uploading := io.Pipe()
+    defer uploading.Close()
+    go func() {
+        for {
+            if _, err := uploading.Write([]byte("x")); err != nil {
+                return
+            }
+            time.Sleep(100 * time.Millisecond)
+        }
+    }()
+    start := time.Now()
+    resp, err = do("POST", "plain", "/upload", upload)
+    if err != nil { t.Fatalf("endless upload: %v", err) }
+    resp.Body.Close()
+    if resp.StatusCode != http.StatusGatewayTimeout || time.Since(start) > 2500*time.Millisecond {
+        t.Errorf("endless upload: status %d after %s; want 504 after 1s", resp.StatusCode, time.Since(start))
+    }
+}
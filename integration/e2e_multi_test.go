@@ -0,0 +1,119 @@
+package integration
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMultipleTunnelsFromConfig(t *testing.T) {
+    tempDir := t.TempDir()
+
+    serverBin := filepath.Join(tempDir, "portkey-server")
+    clientBin := filepath.Join(tempDir, "portkey-client")
+
+    buildBinary(t, "../cmd/server", serverBin)
+    buildBinary(t, "../cmd/client", clientBin)
+
+    // two local web apps and a TCP echo service
+    web := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { io.WriteString(w, "web") }))
+    defer web.Close()
+    api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { io.WriteString(w, "api") }))
+    defer api.Close()
+    echo, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil { t.Fatalf("listen: %v", err) }
+    defer echo.Close()
+    go func() {
+        for {
+            c, err := echo.Accept()
+            if err != nil { return }
+            go func() { defer c.Close(); io.Copy(c, c) }()
+        }
+    }()
+
+    srvPort, _ := findFreePort()
+    tcpPort, _ := findFreePort()
+    serverURL := fmt.Sprintf("http://127.0.0.1:%d", srvPort)
+
+    // the token may only use project1, so "other" is refused on its own
+    cfg := fmt.Sprintf(`server: %s
+auth_token: abc123
+tunnels:
+  web:
+    subdomain: project1
+    port: %s
+  other:
+    port: %s
+  echo:
+    type: tcp
+    host: 127.0.0.1
+    port: %d
+`, serverURL, strings.Split(web.URL, ":")[2], strings.Split(api.URL, ":")[2], echo.Addr().(*net.TCPAddr).Port)
+    cfgPath := filepath.Join(tempDir, "portkey.yaml")
+    if err := os.WriteFile(cfgPath, []byte(cfg), 0o600); err != nil { t.Fatalf("config: %v", err) }
+
+    ctx, cancel := context.WithCancel(context.Background())
+    defer cancel()
+
+    authPath := filepath.Join(".", "auth.yaml")
+    srvCmd := exec.CommandContext(ctx, serverBin, "--port", fmt.Sprintf("%d", srvPort), "-auth-file", authPath, "--domain", "example.com", "--tcp-ports", strconv.Itoa(tcpPort))
+    srvCmd.Stdout, srvCmd.Stderr = os.Stdout, os.Stderr
+    if err := srvCmd.Start(); err != nil { t.Fatalf("srv: %v", err) }
+    time.Sleep(300 * time.Millisecond)
+
+    clientCmd := exec.CommandContext(ctx, clientBin, "start", "--config", cfgPath, "--all")
+    clientCmd.Stdout = os.Stdout
+    logs, _ := clientCmd.StderrPipe()
+    if err := clientCmd.Start(); err != nil { t.Fatalf("cli: %v", err) }
+    defer func() { cancel(); clientCmd.Wait(); srvCmd.Wait() }()
+
+    // each tunnel reports on its own log line
+    refused := make(chan struct{})
+    go func() {
+        sc := bufio.NewScanner(logs)
+        for sc.Scan() {
+            fmt.Fprintln(os.Stderr, sc.Text())
+            if strings.Contains(sc.Text(), "[other] refused by server") {
+                close(refused)
+                break
+            }
+        }
+        io.Copy(os.Stderr, logs)
+    }()
+    select {
+    case <-refused:
+    case <-time.After(5 * time.Second):
+        t.Fatalf("tunnel outside the token's subdomains was not refused")
+    }
+
+    req, _ := http.NewRequest("GET", serverURL+"/", nil)
+    req.Host = "project1.example.com"
+    resp, err := (&http.Client{Timeout: 5 * time.Second}).Do(req)
+    if err != nil { t.Fatalf("request: %v", err) }
+    body, _ := io.ReadAll(resp.Body)
+    resp.Body.Close()
+    if string(body) != "web" {
+        t.Fatalf("project1 served %q", body)
+    }
+
+    conn, err := net.DialTimeout("tcp", fmt.Sprintf("127.0.0.1:%d", tcpPort), 2*time.Second)
+    if err != nil { t.Fatalf("dial tunnel: %v", err) }
+    defer conn.Close()
+    conn.SetDeadline(time.Now().Add(5 * time.Second))
+    io.WriteString(conn, "over the shared connection\n")
+    got, err := bufio.NewReader(conn).ReadString('\n')
+    if err != nil || got != "over the shared connection\n" {
+        t.Fatalf("tcp echo: %q, %v", got, err)
+    }
+}
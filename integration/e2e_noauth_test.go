@@ -53,4 +53,12 @@ func TestBlackboxNoAuth(t *testing.T) {
     if err != nil { t.Fatalf("request: %v", err) }
     body, _ := io.ReadAll(resp.Body)
     if string(body) != "pong" { t.Fatalf("body: %s", body) }
+
+    // with nobody to vouch for them, custom domains can't be added
+    resp, err = http.Post(serverURL+"/api/domains", "application/json", strings.NewReader(`{"host": "evil.test", "subdomain": "public"}`))
+    if err != nil { t.Fatalf("add domain: %v", err) }
+    resp.Body.Close()
+    if resp.StatusCode != http.StatusForbidden {
+        t.Fatalf("adding a custom domain without auth: status %d", resp.StatusCode)
+    }
 }
@@ -0,0 +1,76 @@
+package integration
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPathRouting(t *testing.T) {
+    tempDir := t.TempDir()
+
+    serverBin := filepath.Join(tempDir, "portkey-server")
+    clientBin := filepath.Join(tempDir, "portkey-client")
+
+    buildBinary(t, "../cmd/server", serverBin)
+    buildBinary(t, "../cmd/client", clientBin)
+
+    // each local service reports its name and the path it was asked for
+    service := func(name string) (*httptest.Server, string) {
+        s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+            fmt.Fprintf(w, "%s %s", name, r.URL.RequestURI())
+        }))
+        return s, strings.Split(s.URL, ":")[2]
+    }
+    web, webPort := service("web")
+    defer web.Close()
+    api, apiPort := service("api")
+    defer api.Close()
+    docs, docsPort := service("docs")
+    defer docs.Close()
+
+    srvPort, _ := findFreePort()
+    serverURL := fmt.Sprintf("http://127.0.0.1:%d", srvPort)
+
+    ctx, cancel := context.WithCancel(context.Background())
+    defer cancel()
+
+    srvCmd := exec.CommandContext(ctx, serverBin, "--port", fmt.Sprintf("%d", srvPort), "--domain", "example.com")
+    srvCmd.Stdout, srvCmd.Stderr = os.Stdout, os.Stderr
+    if err := srvCmd.Start(); err != nil { t.Fatalf("srv: %v", err) }
+    time.Sleep(300 * time.Millisecond)
+
+    clientCmd := exec.CommandContext(ctx, clientBin, "--server", serverURL, "--subdomain", "fanout", "--host", "127.0.0.1", "--port", webPort,
+        "--route", "/api/*=127.0.0.1:"+apiPort+",strip", "--route", "/docs="+docsPort)
+    clientCmd.Stdout, clientCmd.Stderr = os.Stdout, os.Stderr
+    if err := clientCmd.Start(); err != nil { t.Fatalf("cli: %v", err) }
+    defer func() { cancel(); clientCmd.Wait(); srvCmd.Wait() }()
+    time.Sleep(500 * time.Millisecond)
+
+    for path, want := range map[string]string{
+        "/":              "web /",
+        "/api/users?x=1": "api /users?x=1",
+        "/api/":          "api /",
+        "/apiary":        "web /apiary",
+        "/docs/intro":    "docs /docs/intro",
+        "/docs":          "docs /docs",
+    } {
+        req, _ := http.NewRequest("GET", serverURL+path, nil)
+        req.Host = "fanout.example.com"
+        resp, err := (&http.Client{Timeout: 5 * time.Second}).Do(req)
+        if err != nil { t.Fatalf("request %s: %v", path, err) }
+        body, _ := io.ReadAll(resp.Body)
+        resp.Body.Close()
+        if string(body) != want {
+            t.Errorf("%s: got %q, want %q", path, body, want)
+        }
+    }
+}
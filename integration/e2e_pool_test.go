@@ -0,0 +1,86 @@
+package integration
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTunnelPool(t *testing.T) {
+    tempDir := t.TempDir()
+
+    serverBin := filepath.Join(tempDir, "portkey-server")
+    clientBin := filepath.Join(tempDir, "portkey-client")
+
+    buildBinary(t, "../cmd/server", serverBin)
+    buildBinary(t, "../cmd/client", clientBin)
+
+    // two replicas of the same app, each answering with its name
+    replica := func(name string) *httptest.Server {
+        return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { io.WriteString(w, name) }))
+    }
+    a, b := replica("a"), replica("b")
+    defer a.Close()
+    defer b.Close()
+
+    srvPort, _ := findFreePort()
+    serverURL := fmt.Sprintf("http://127.0.0.1:%d", srvPort)
+
+    ctx, cancel := context.WithCancel(context.Background())
+    defer cancel()
+
+    srvCmd := exec.CommandContext(ctx, serverBin, "--port", fmt.Sprintf("%d", srvPort), "--domain", "example.com")
+    srvCmd.Stdout, srvCmd.Stderr = os.Stdout, os.Stderr
+    if err := srvCmd.Start(); err != nil { t.Fatalf("srv: %v", err) }
+    time.Sleep(300 * time.Millisecond)
+
+    startClient := func(local *httptest.Server) *exec.Cmd {
+        cmd := exec.CommandContext(ctx, clientBin, "--server", serverURL, "--subdomain", "replicas", "--pool",
+            "--host", "127.0.0.1", "--port", strings.Split(local.URL, ":")[2])
+        cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+        if err := cmd.Start(); err != nil { t.Fatalf("cli: %v", err) }
+        return cmd
+    }
+    cliA, cliB := startClient(a), startClient(b)
+    defer func() { cancel(); cliA.Wait(); cliB.Wait(); srvCmd.Wait() }()
+    time.Sleep(500 * time.Millisecond)
+
+    get := func() string {
+        req, _ := http.NewRequest("GET", serverURL+"/", nil)
+        req.Host = "replicas.example.com"
+        resp, err := (&http.Client{Timeout: 5 * time.Second}).Do(req)
+        if err != nil { t.Fatalf("request: %v", err) }
+        defer resp.Body.Close()
+        body, _ := io.ReadAll(resp.Body)
+        if resp.StatusCode != http.StatusOK {
+            t.Fatalf("status %d: %q", resp.StatusCode, body)
+        }
+        return string(body)
+    }
+
+    seen := map[string]int{}
+    for i := 0; i < 10; i++ {
+        seen[get()]++
+    }
+    if seen["a"] == 0 || seen["b"] == 0 {
+        t.Fatalf("requests not spread across the pool: %v", seen)
+    }
+
+    // a replica going away leaves the rest of the pool serving
+    cliA.Process.Kill()
+    cliA.Wait()
+    time.Sleep(300 * time.Millisecond)
+    for i := 0; i < 5; i++ {
+        if got := get(); got != "b" {
+            t.Fatalf("after failover got %q", got)
+        }
+    }
+}
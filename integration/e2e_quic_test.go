@@ -0,0 +1,83 @@
+package integration
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestQUICTransport(t *testing.T) {
+    tempDir := t.TempDir()
+
+    serverBin := filepath.Join(tempDir, "portkey-server")
+    clientBin := filepath.Join(tempDir, "portkey-client")
+
+    buildBinary(t, "../cmd/server", serverBin)
+    buildBinary(t, "../cmd/client", clientBin)
+
+    // local app echoes request bodies
+    local := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        io.Copy(w, r.Body)
+    }))
+    defer local.Close()
+    localPort := strings.Split(local.URL, ":")[2]
+
+    srvPort, _ := findFreePort()
+    quicPort, _ := findFreePort()
+
+    ctx, cancel := context.WithCancel(context.Background())
+    defer cancel()
+
+    srvCmd := exec.CommandContext(ctx, serverBin, "--port", fmt.Sprintf("%d", srvPort), "--domain", "example.com", "--quic-port", fmt.Sprintf("%d", quicPort))
+    srvCmd.Stdout, srvCmd.Stderr = os.Stdout, os.Stderr
+    if err := srvCmd.Start(); err != nil { t.Fatalf("srv: %v", err) }
+    time.Sleep(300 * time.Millisecond)
+
+    serverURL := fmt.Sprintf("http://127.0.0.1:%d", srvPort)
+    clientCmd := exec.CommandContext(ctx, clientBin, "--server", serverURL, "--subdomain", "fast", "--port", localPort,
+        "--transport", "quic", "--quic-port", fmt.Sprintf("%d", quicPort), "--quic-insecure")
+    clientCmd.Stdout = os.Stdout
+    logs, _ := clientCmd.StderrPipe()
+    if err := clientCmd.Start(); err != nil { t.Fatalf("cli: %v", err) }
+    defer func() { cancel(); clientCmd.Wait(); srvCmd.Wait() }()
+
+    overQUIC := make(chan struct{})
+    go func() {
+        sc := bufio.NewScanner(logs)
+        for sc.Scan() {
+            fmt.Fprintln(os.Stderr, sc.Text())
+            if strings.Contains(sc.Text(), "over QUIC") {
+                close(overQUIC)
+                break
+            }
+        }
+        io.Copy(os.Stderr, logs)
+    }()
+    select {
+    case <-overQUIC:
+    case <-time.After(5 * time.Second):
+        t.Fatalf("client did not establish the tunnel over QUIC")
+    }
+
+    body := strings.Repeat("portkey over quic ", 64*1024) // spans several flow-control windows
+    req, _ := http.NewRequest("POST", serverURL+"/echo", strings.NewReader(body))
+    req.Host = "fast.example.com"
+    resp, err := (&http.Client{Timeout: 10 * time.Second}).Do(req)
+    if err != nil {
+        t.Fatalf("request failed: %v", err)
+    }
+    defer resp.Body.Close()
+    got, _ := io.ReadAll(resp.Body)
+    if resp.StatusCode != http.StatusOK || string(got) != body {
+        t.Fatalf("unexpected response: %d, %d bytes", resp.StatusCode, len(got))
+    }
+}
@@ -0,0 +1,84 @@
+package integration
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestClientReconnectsAndSubdomainIsHeld(t *testing.T) {
+    tempDir := t.TempDir()
+
+    serverBin := filepath.Join(tempDir, "portkey-server")
+    clientBin := filepath.Join(tempDir, "portkey-client")
+
+    buildBinary(t, "../cmd/server", serverBin)
+    buildBinary(t, "../cmd/client", clientBin)
+
+    local := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("pong")) }))
+    defer local.Close()
+    localPort := strings.Split(local.URL, ":")[2]
+
+    srvPort, _ := findFreePort()
+    serverURL := fmt.Sprintf("http://127.0.0.1:%d", srvPort)
+    authPath := filepath.Join(".", "auth.yaml")
+
+    ctx, cancel := context.WithCancel(context.Background())
+    defer cancel()
+
+    startServer := func() *exec.Cmd {
+        cmd := exec.CommandContext(ctx, serverBin, "--port", fmt.Sprintf("%d", srvPort), "-auth-file", authPath, "--domain", "example.com", "--reconnect-grace", "5s")
+        cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+        if err := cmd.Start(); err != nil { t.Fatalf("srv: %v", err) }
+        time.Sleep(300 * time.Millisecond)
+        return cmd
+    }
+    get := func() (int, string) {
+        req, _ := http.NewRequest("GET", serverURL+"/", nil)
+        req.Host = "project1.example.com"
+        resp, err := (&http.Client{Timeout: 2 * time.Second}).Do(req)
+        if err != nil { return 0, err.Error() }
+        defer resp.Body.Close()
+        body, _ := io.ReadAll(resp.Body)
+        return resp.StatusCode, string(body)
+    }
+    waitFor := func(what string, ok func() bool) {
+        for deadline := time.Now().Add(10 * time.Second); time.Now().Before(deadline); time.Sleep(100 * time.Millisecond) {
+            if ok() { return }
+        }
+        t.Fatalf("timed out waiting for %s", what)
+    }
+
+    srvCmd := startServer()
+    clientCmd := exec.CommandContext(ctx, clientBin, "--server", serverURL, "--subdomain", "project1", "--port", localPort, "--auth-token", "abc123")
+    clientCmd.Stdout, clientCmd.Stderr = os.Stdout, os.Stderr
+    if err := clientCmd.Start(); err != nil { t.Fatalf("cli: %v", err) }
+    defer func() { cancel(); clientCmd.Wait(); srvCmd.Wait() }()
+    waitFor("the tunnel", func() bool { _, body := get(); return body == "pong" })
+
+    // restart the server: the client comes back on its own
+    srvCmd.Process.Kill()
+    srvCmd.Wait()
+    srvCmd = startServer()
+    waitFor("the client to reconnect", func() bool { _, body := get(); return body == "pong" })
+
+    // while the client is away its subdomain answers 503 rather than 404...
+    clientCmd.Process.Kill()
+    clientCmd.Wait()
+    waitFor("the reservation", func() bool { status, _ := get(); return status == http.StatusServiceUnavailable })
+
+    // ...and another token can't take it over
+    other := exec.CommandContext(ctx, clientBin, "--server", serverURL, "--subdomain", "project1", "--port", localPort, "--auth-token", "admin456")
+    out, err := other.CombinedOutput()
+    if err == nil || !strings.Contains(string(out), "reserved") {
+        t.Fatalf("expected the other client to be refused, got %v: %s", err, out)
+    }
+}
@@ -0,0 +1,259 @@
+package integration
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"portkey/internal/logstore"
+	"portkey/internal/tunnel"
+)
+
+func TestGracefulShutdown(t *testing.T) {
+    tempDir := t.TempDir()
+
+    serverBin := filepath.Join(tempDir, "portkey-server")
+    clientBin := filepath.Join(tempDir, "portkey-client")
+
+    buildBinary(t, "../cmd/server", serverBin)
+    buildBinary(t, "../cmd/client", clientBin)
+
+    // a webhook handler that takes a while
+    local := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        time.Sleep(2 * time.Second)
+        fmt.Fprint(w, "done")
+    }))
+    defer local.Close()
+
+    srvPort, _ := findFreePort()
+    serverURL := fmt.Sprintf("http://127.0.0.1:%d", srvPort)
+    dbPath := filepath.Join(tempDir, "logs.db")
+
+    ctx, cancel := context.WithCancel(context.Background())
+    defer cancel()
+
+    srvCmd := exec.CommandContext(ctx, serverBin, "--port", fmt.Sprintf("%d", srvPort), "--domain", "example.com",
+        "--log-store", "sqlite", "--log-db", dbPath, "--shutdown-timeout", "10s")
+    srvCmd.Stdout, srvCmd.Stderr = os.Stdout, os.Stderr
+    if err := srvCmd.Start(); err != nil { t.Fatalf("srv: %v", err) }
+    time.Sleep(300 * time.Millisecond)
+
+    clientCmd := exec.CommandContext(ctx, clientBin, "--server", serverURL, "--subdomain", "hooks", "--host", "127.0.0.1", "--port", strings.Split(local.URL, ":")[2])
+    clientCmd.Stdout = os.Stdout
+    logs, _ := clientCmd.StderrPipe()
+    if err := clientCmd.Start(); err != nil { t.Fatalf("cli: %v", err) }
+    defer func() { cancel(); clientCmd.Wait() }()
+
+    drained := make(chan struct{})
+    go func() {
+        sc := bufio.NewScanner(logs)
+        for sc.Scan() {
+            fmt.Fprintln(os.Stderr, sc.Text())
+            if strings.Contains(sc.Text(), "Server is draining") {
+                close(drained)
+                break
+            }
+        }
+        io.Copy(os.Stderr, logs)
+    }()
+    time.Sleep(500 * time.Millisecond)
+
+    type result struct {
+        status int
+        body   string
+        err    error
+    }
+    webhook := make(chan result, 1)
+    go func() {
+        req, _ := http.NewRequest("POST", serverURL+"/hook", strings.NewReader("event"))
+        req.Host = "hooks.example.com"
+        resp, err := (&http.Client{Timeout: 10 * time.Second}).Do(req)
+        if err != nil {
+            webhook <- result{err: err}
+            return
+        }
+        defer resp.Body.Close()
+        body, _ := io.ReadAll(resp.Body)
+        webhook <- result{status: resp.StatusCode, body: string(body)}
+    }()
+    time.Sleep(300 * time.Millisecond)
+
+    if err := srvCmd.Process.Signal(syscall.SIGTERM); err != nil { t.Fatalf("signal: %v", err) }
+
+    select {
+    case <-drained:
+    case <-time.After(2 * time.Second):
+        t.Errorf("client wasn't told the server is draining")
+    }
+    if _, err := (&http.Client{Timeout: time.Second}).Get(serverURL + "/"); err == nil {
+        t.Errorf("draining server still accepted a new visitor")
+    }
+
+    // the webhook in flight still gets its answer
+    r := <-webhook
+    if r.err != nil || r.status != http.StatusOK || r.body != "done" {
+        t.Fatalf("in-flight request: status %d body %q err %v", r.status, r.body, r.err)
+    }
+
+    exited := make(chan error, 1)
+    go func() { exited <- srvCmd.Wait() }()
+    select {
+    case err := <-exited:
+        if err != nil {
+            t.Fatalf("server exited with %v", err)
+        }
+    case <-time.After(5 * time.Second):
+        t.Fatalf("server didn't exit after draining")
+    }
+
+    store, err := logstore.NewSQLite(dbPath)
+    if err != nil { t.Fatalf("open log db: %v", err) }
+    defer store.Close()
+    entries, _ := store.All()
+    if len(entries) != 1 || entries[0].Path != "/hook" || entries[0].Status != http.StatusOK {
+        t.Errorf("log db holds %+v, want the webhook", entries)
+    }
+}
+
+func TestDrainRawTunnels(t *testing.T) {
+    tempDir := t.TempDir()
+
+    serverBin := filepath.Join(tempDir, "portkey-server")
+    clientBin := filepath.Join(tempDir, "portkey-client")
+
+    buildBinary(t, "../cmd/server", serverBin)
+    buildBinary(t, "../cmd/client", clientBin)
+
+    // local TCP and UDP echo services
+    tcpLocal, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil { t.Fatalf("listen: %v", err) }
+    defer tcpLocal.Close()
+    go func() {
+        for {
+            c, err := tcpLocal.Accept()
+            if err != nil { return }
+            go func() { defer c.Close(); io.Copy(c, c) }()
+        }
+    }()
+    udpLocal, err := net.ListenPacket("udp", "127.0.0.1:0")
+    if err != nil { t.Fatalf("listen: %v", err) }
+    defer udpLocal.Close()
+    go func() {
+        buf := make([]byte, 2048)
+        for {
+            n, addr, err := udpLocal.ReadFrom(buf)
+            if err != nil { return }
+            udpLocal.WriteTo(buf[:n], addr)
+        }
+    }()
+
+    srvPort, _ := findFreePort()
+    tcpPort, _ := findFreePort()
+    udpPort, _ := findFreePort()
+    quicPort, _ := findFreePort()
+    serverURL := fmt.Sprintf("http://127.0.0.1:%d", srvPort)
+
+    ctx, cancel := context.WithCancel(context.Background())
+    defer cancel()
+
+    srvCmd := exec.CommandContext(ctx, serverBin, "--port", fmt.Sprintf("%d", srvPort), "--domain", "example.com", "--shutdown-timeout", "10s",
+        "--tcp-ports", strconv.Itoa(tcpPort), "--udp-ports", strconv.Itoa(udpPort), "--quic-port", strconv.Itoa(quicPort))
+    srvCmd.Stdout, srvCmd.Stderr = os.Stdout, os.Stderr
+    if err := srvCmd.Start(); err != nil { t.Fatalf("srv: %v", err) }
+    time.Sleep(300 * time.Millisecond)
+
+    tcpClient := exec.CommandContext(ctx, clientBin, "tcp", "--server", serverURL, "--port", strconv.Itoa(tcpLocal.Addr().(*net.TCPAddr).Port), "--inspect", "")
+    udpClient := exec.CommandContext(ctx, clientBin, "udp", "--server", serverURL, "--port", strconv.Itoa(udpLocal.LocalAddr().(*net.UDPAddr).Port), "--inspect", "")
+    for _, c := range []*exec.Cmd{tcpClient, udpClient} {
+        c.Stdout, c.Stderr = os.Stdout, os.Stderr
+        if err := c.Start(); err != nil { t.Fatalf("cli: %v", err) }
+    }
+    defer func() { cancel(); tcpClient.Wait(); udpClient.Wait() }()
+    time.Sleep(500 * time.Millisecond)
+
+    echoes := func(c net.Conn, msg string) bool {
+        c.SetDeadline(time.Now().Add(time.Second))
+        if _, err := c.Write([]byte(msg)); err != nil {
+            return false
+        }
+        buf := make([]byte, 64)
+        n, err := c.Read(buf)
+        return err == nil && string(buf[:n]) == msg
+    }
+    tcpConn, err := net.DialTimeout("tcp", fmt.Sprintf("127.0.0.1:%d", tcpPort), 2*time.Second)
+    if err != nil { t.Fatalf("dial tcp tunnel: %v", err) }
+    defer tcpConn.Close()
+    udpConn, err := net.Dial("udp", fmt.Sprintf("127.0.0.1:%d", udpPort))
+    if err != nil { t.Fatalf("dial udp tunnel: %v", err) }
+    defer udpConn.Close()
+    if !echoes(tcpConn, "tcp before") || !echoes(udpConn, "udp before") {
+        t.Fatalf("tunnels don't echo before draining")
+    }
+    quicTLS := &tls.Config{InsecureSkipVerify: true, NextProtos: []string{tunnel.QUICProtocol}}
+    dialQUIC := func() error {
+        ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+        defer cancel()
+        q, err := tunnel.DialQUIC(ctx, fmt.Sprintf("127.0.0.1:%d", quicPort), quicTLS, tunnel.NewQUICConfig(time.Second, 3*time.Second), "subdomain=probe")
+        if err == nil {
+            q.Close()
+        }
+        return err
+    }
+    if err := dialQUIC(); err != nil { t.Fatalf("quic before draining: %v", err) }
+
+    if err := srvCmd.Process.Signal(syscall.SIGTERM); err != nil { t.Fatalf("signal: %v", err) }
+    time.Sleep(300 * time.Millisecond)
+
+    // what was open carries on
+    if !echoes(tcpConn, "tcp during") {
+        t.Errorf("open TCP connection stopped while draining")
+    }
+    if !echoes(udpConn, "udp during") {
+        t.Errorf("open UDP session stopped while draining")
+    }
+    // nothing new gets in
+    if c, err := net.DialTimeout("tcp", fmt.Sprintf("127.0.0.1:%d", tcpPort), time.Second); err == nil {
+        c.Close()
+        t.Errorf("draining server accepted a new TCP visitor")
+    }
+    newUDP, err := net.Dial("udp", fmt.Sprintf("127.0.0.1:%d", udpPort))
+    if err != nil { t.Fatalf("dial udp tunnel: %v", err) }
+    defer newUDP.Close()
+    if echoes(newUDP, "udp new") {
+        t.Errorf("draining server started a new UDP session")
+    }
+    if err := dialQUIC(); err == nil {
+        t.Errorf("draining server accepted a new QUIC connection")
+    }
+
+    // and the server waits for the open TCP connection before it exits
+    exited := make(chan error, 1)
+    go func() { exited <- srvCmd.Wait() }()
+    select {
+    case err := <-exited:
+        t.Fatalf("server exited (%v) with a TCP connection still open", err)
+    case <-time.After(time.Second):
+    }
+    tcpConn.Close()
+    select {
+    case err := <-exited:
+        if err != nil {
+            t.Fatalf("server exited with %v", err)
+        }
+    case <-time.After(3 * time.Second):
+        t.Fatalf("server didn't exit once the TCP connection closed")
+    }
+}
@@ -0,0 +1,58 @@
+package integration
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStreamLargeBody(t *testing.T) {
+    tempDir := t.TempDir()
+
+    serverBin := filepath.Join(tempDir, "portkey-server")
+    clientBin := filepath.Join(tempDir, "portkey-client")
+
+    buildBinary(t, "../cmd/server", serverBin)
+    buildBinary(t, "../cmd/client", clientBin)
+
+    // local app echoes the request body back
+    local := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { io.Copy(w, r.Body) }))
+    defer local.Close()
+    localPort := strings.Split(local.URL, ":")[2]
+
+    srvPort, _ := findFreePort()
+
+    ctx, cancel := context.WithCancel(context.Background())
+    defer cancel()
+
+    srvCmd := exec.CommandContext(ctx, serverBin, "--port", fmt.Sprintf("%d", srvPort), "--domain", "example.com")
+    srvCmd.Stdout, srvCmd.Stderr = os.Stdout, os.Stderr
+    if err := srvCmd.Start(); err != nil { t.Fatalf("srv: %v", err) }
+    time.Sleep(300 * time.Millisecond)
+
+    serverURL := fmt.Sprintf("http://127.0.0.1:%d", srvPort)
+    clientCmd := exec.CommandContext(ctx, clientBin, "--server", serverURL, "--subdomain", "bulk", "--port", localPort)
+    clientCmd.Stdout, clientCmd.Stderr = os.Stdout, os.Stderr
+    if err := clientCmd.Start(); err != nil { t.Fatalf("cli: %v", err) }
+    time.Sleep(500 * time.Millisecond)
+
+    payload := bytes.Repeat([]byte("portkey-"), 1<<20) // 8 MiB, many chunks
+    req, _ := http.NewRequest("POST", serverURL+"/upload", bytes.NewReader(payload))
+    req.Host = "bulk.example.com"
+    resp, err := (&http.Client{Timeout: 20 * time.Second}).Do(req)
+    if err != nil { t.Fatalf("request: %v", err) }
+    defer resp.Body.Close()
+    body, _ := io.ReadAll(resp.Body)
+    if !bytes.Equal(body, payload) {
+        t.Fatalf("echoed body mismatch: got %d bytes, want %d", len(body), len(payload))
+    }
+}
@@ -0,0 +1,104 @@
+package integration
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSubdomainTakeover(t *testing.T) {
+    tempDir := t.TempDir()
+
+    serverBin := filepath.Join(tempDir, "portkey-server")
+    clientBin := filepath.Join(tempDir, "portkey-client")
+
+    buildBinary(t, "../cmd/server", serverBin)
+    buildBinary(t, "../cmd/client", clientBin)
+
+    app := func(name string) *httptest.Server {
+        return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { io.WriteString(w, name) }))
+    }
+    first, second := app("first"), app("second")
+    defer first.Close()
+    defer second.Close()
+
+    srvPort, _ := findFreePort()
+    serverURL := fmt.Sprintf("http://127.0.0.1:%d", srvPort)
+
+    ctx, cancel := context.WithCancel(context.Background())
+    defer cancel()
+
+    authPath := filepath.Join(".", "auth.yaml")
+    srvCmd := exec.CommandContext(ctx, serverBin, "--port", fmt.Sprintf("%d", srvPort), "-auth-file", authPath, "--domain", "example.com")
+    srvCmd.Stdout, srvCmd.Stderr = os.Stdout, os.Stderr
+    if err := srvCmd.Start(); err != nil { t.Fatalf("srv: %v", err) }
+    defer func() { cancel(); srvCmd.Wait() }()
+    time.Sleep(300 * time.Millisecond)
+
+    // client runs a client for project1 against local, capturing its log
+    client := func(local *httptest.Server, extra ...string) (*exec.Cmd, *bytes.Buffer) {
+        args := append([]string{"--server", serverURL, "--subdomain", "project1", "--auth-token", "abc123",
+            "--host", "127.0.0.1", "--port", strings.Split(local.URL, ":")[2]}, extra...)
+        cmd := exec.CommandContext(ctx, clientBin, args...)
+        var logs bytes.Buffer
+        cmd.Stdout, cmd.Stderr = os.Stdout, io.MultiWriter(os.Stderr, &logs)
+        if err := cmd.Start(); err != nil { t.Fatalf("cli: %v", err) }
+        return cmd, &logs
+    }
+    get := func() string {
+        req, _ := http.NewRequest("GET", serverURL+"/", nil)
+        req.Host = "project1.example.com"
+        resp, err := (&http.Client{Timeout: 5 * time.Second}).Do(req)
+        if err != nil { t.Fatalf("request: %v", err) }
+        defer resp.Body.Close()
+        body, _ := io.ReadAll(resp.Body)
+        return string(body)
+    }
+    exited := func(cmd *exec.Cmd) chan struct{} {
+        done := make(chan struct{})
+        go func() { cmd.Wait(); close(done) }()
+        return done
+    }
+
+    owner, ownerLogs := client(first)
+    ownerDone := exited(owner)
+    time.Sleep(500 * time.Millisecond)
+
+    // a second client with the same token is turned away and says why
+    rival, rivalLogs := client(second)
+    select {
+    case <-exited(rival):
+    case <-time.After(5 * time.Second):
+        t.Fatalf("conflicting client kept running")
+    }
+    if !strings.Contains(rivalLogs.String(), "subdomain is in use by another client") {
+        t.Fatalf("conflicting client didn't print the reason: %q", rivalLogs.String())
+    }
+    if got := get(); got != "first" {
+        t.Fatalf("subdomain was taken over without --force: %q", got)
+    }
+
+    // --force takes it over, and the old client hears about it
+    forced, _ := client(second, "--force")
+    defer func() { cancel(); forced.Wait() }()
+    select {
+    case <-ownerDone:
+    case <-time.After(5 * time.Second):
+        t.Fatalf("displaced client kept running")
+    }
+    if !strings.Contains(ownerLogs.String(), "taken over by another client") {
+        t.Fatalf("displaced client didn't print the reason: %q", ownerLogs.String())
+    }
+    if got := get(); got != "second" {
+        t.Fatalf("forced client isn't serving: %q", got)
+    }
+}
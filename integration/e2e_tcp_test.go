@@ -0,0 +1,72 @@
+package integration
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestTCPTunnel(t *testing.T) {
+    tempDir := t.TempDir()
+
+    serverBin := filepath.Join(tempDir, "portkey-server")
+    clientBin := filepath.Join(tempDir, "portkey-client")
+
+    buildBinary(t, "../cmd/server", serverBin)
+    buildBinary(t, "../cmd/client", clientBin)
+
+    // local line-echo service
+    local, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil { t.Fatalf("listen: %v", err) }
+    defer local.Close()
+    go func() {
+        for {
+            c, err := local.Accept()
+            if err != nil { return }
+            go func() { defer c.Close(); io.Copy(c, c) }()
+        }
+    }()
+    localPort := local.Addr().(*net.TCPAddr).Port
+
+    srvPort, _ := findFreePort()
+    tcpPort, _ := findFreePort()
+
+    ctx, cancel := context.WithCancel(context.Background())
+    defer cancel()
+
+    authPath := filepath.Join(".", "auth.yaml")
+    srvCmd := exec.CommandContext(ctx, serverBin, "--port", fmt.Sprintf("%d", srvPort), "-auth-file", authPath, "--domain", "example.com", "--tcp-ports", strconv.Itoa(tcpPort))
+    srvCmd.Stdout, srvCmd.Stderr = os.Stdout, os.Stderr
+    if err := srvCmd.Start(); err != nil { t.Fatalf("srv: %v", err) }
+    time.Sleep(300 * time.Millisecond)
+
+    serverURL := fmt.Sprintf("http://127.0.0.1:%d", srvPort)
+    clientCmd := exec.CommandContext(ctx, clientBin, "tcp", "--server", serverURL, "--port", strconv.Itoa(localPort), "--auth-token", "abc123")
+    clientCmd.Stdout, clientCmd.Stderr = os.Stdout, os.Stderr
+    if err := clientCmd.Start(); err != nil { t.Fatalf("cli: %v", err) }
+    defer func() { cancel(); clientCmd.Wait(); srvCmd.Wait() }()
+    time.Sleep(500 * time.Millisecond)
+
+    conn, err := net.DialTimeout("tcp", fmt.Sprintf("127.0.0.1:%d", tcpPort), 2*time.Second)
+    if err != nil { t.Fatalf("dial tunnel: %v", err) }
+    defer conn.Close()
+    conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+    r := bufio.NewReader(conn)
+    for _, line := range []string{"PING\n", "hello over tcp\n"} {
+        if _, err := io.WriteString(conn, line); err != nil { t.Fatalf("write: %v", err) }
+        got, err := r.ReadString('\n')
+        if err != nil { t.Fatalf("read: %v", err) }
+        if got != line {
+            t.Fatalf("echo mismatch: %q != %q", got, line)
+        }
+    }
+}
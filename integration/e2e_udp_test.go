@@ -0,0 +1,93 @@
+package integration
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestUDPTunnel(t *testing.T) {
+    tempDir := t.TempDir()
+
+    serverBin := filepath.Join(tempDir, "portkey-server")
+    clientBin := filepath.Join(tempDir, "portkey-client")
+
+    buildBinary(t, "../cmd/server", serverBin)
+    buildBinary(t, "../cmd/client", clientBin)
+
+    // local UDP echo service
+    local, err := net.ListenPacket("udp", "127.0.0.1:0")
+    if err != nil { t.Fatalf("listen: %v", err) }
+    defer local.Close()
+    go func() {
+        buf := make([]byte, 2048)
+        for {
+            n, addr, err := local.ReadFrom(buf)
+            if err != nil { return }
+            local.WriteTo(append([]byte("echo:"), buf[:n]...), addr)
+        }
+    }()
+    localPort := local.LocalAddr().(*net.UDPAddr).Port
+
+    srvPort, _ := findFreePort()
+    udpPort, _ := findFreePort()
+
+    ctx, cancel := context.WithCancel(context.Background())
+    defer cancel()
+
+    authPath := filepath.Join(".", "auth.yaml")
+    srvCmd := exec.CommandContext(ctx, serverBin, "--port", fmt.Sprintf("%d", srvPort), "-auth-file", authPath, "--domain", "example.com", "--enable-web-ui",
+        "--udp-ports", strconv.Itoa(udpPort), "--udp-idle-timeout", "500ms")
+    srvCmd.Stdout, srvCmd.Stderr = os.Stdout, os.Stderr
+    if err := srvCmd.Start(); err != nil { t.Fatalf("srv: %v", err) }
+    time.Sleep(300 * time.Millisecond)
+
+    serverURL := fmt.Sprintf("http://127.0.0.1:%d", srvPort)
+    clientCmd := exec.CommandContext(ctx, clientBin, "udp", "--server", serverURL, "--port", strconv.Itoa(localPort), "--auth-token", "abc123")
+    clientCmd.Stdout, clientCmd.Stderr = os.Stdout, os.Stderr
+    if err := clientCmd.Start(); err != nil { t.Fatalf("cli: %v", err) }
+    defer func() { cancel(); clientCmd.Wait(); srvCmd.Wait() }()
+    time.Sleep(500 * time.Millisecond)
+
+    conn, err := net.Dial("udp", fmt.Sprintf("127.0.0.1:%d", udpPort))
+    if err != nil { t.Fatalf("dial tunnel: %v", err) }
+    defer conn.Close()
+
+    buf := make([]byte, 2048)
+    for _, msg := range []string{"one", "two"} {
+        conn.SetDeadline(time.Now().Add(3 * time.Second))
+        if _, err := conn.Write([]byte(msg)); err != nil { t.Fatalf("write: %v", err) }
+        n, err := conn.Read(buf)
+        if err != nil { t.Fatalf("read: %v", err) }
+        if got := string(buf[:n]); got != "echo:"+msg {
+            t.Fatalf("unexpected datagram %q", got)
+        }
+    }
+
+    // the idle session expires and is logged
+    time.Sleep(1500 * time.Millisecond)
+    resp, err := http.Get(serverURL + "/api/requests?token=admin456")
+    if err != nil { t.Fatalf("api: %v", err) }
+    var entries []struct {
+        Method, Body string
+        ClientIP     string `json:"client_ip"`
+    }
+    json.NewDecoder(resp.Body).Decode(&entries)
+    for _, e := range entries {
+        if e.Method == "UDP" {
+            if e.ClientIP != "127.0.0.1" {
+                t.Fatalf("UDP session logged with visitor IP %q", e.ClientIP)
+            }
+            return
+        }
+    }
+    t.Fatalf("expected an expired UDP session in the log, got %+v", entries)
+}
@@ -0,0 +1,217 @@
+package integration
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestWebSocketPassthrough(t *testing.T) {
+    tempDir := t.TempDir()
+
+    serverBin := filepath.Join(tempDir, "portkey-server")
+    clientBin := filepath.Join(tempDir, "portkey-client")
+
+    buildBinary(t, "../cmd/server", serverBin)
+    buildBinary(t, "../cmd/client", clientBin)
+
+    // local app echoes every WebSocket message, prefixed
+    local := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        up := websocket.Upgrader{Subprotocols: []string{"echo"}}
+        ws, err := up.Upgrade(w, r, nil)
+        if err != nil { return }
+        defer ws.Close()
+        for {
+            op, data, err := ws.ReadMessage()
+            if err != nil { return }
+            ws.WriteMessage(op, append([]byte("echo:"), data...))
+        }
+    }))
+    defer local.Close()
+    localPort := strings.Split(local.URL, ":")[2]
+
+    srvPort, _ := findFreePort()
+
+    ctx, cancel := context.WithCancel(context.Background())
+    defer cancel()
+
+    srvCmd := exec.CommandContext(ctx, serverBin, "--port", fmt.Sprintf("%d", srvPort), "--domain", "example.com", "--enable-web-ui")
+    srvCmd.Stdout, srvCmd.Stderr = os.Stdout, os.Stderr
+    if err := srvCmd.Start(); err != nil { t.Fatalf("srv: %v", err) }
+    time.Sleep(300 * time.Millisecond)
+
+    serverURL := fmt.Sprintf("http://127.0.0.1:%d", srvPort)
+    clientCmd := exec.CommandContext(ctx, clientBin, "--server", serverURL, "--subdomain", "live", "--port", localPort)
+    clientCmd.Stdout, clientCmd.Stderr = os.Stdout, os.Stderr
+    if err := clientCmd.Start(); err != nil { t.Fatalf("cli: %v", err) }
+    // the local app holds hijacked connections open, so reap the tunnel before closing it
+    defer func() { cancel(); clientCmd.Wait(); srvCmd.Wait() }()
+    time.Sleep(500 * time.Millisecond)
+
+    dialer := websocket.Dialer{Subprotocols: []string{"echo"}, HandshakeTimeout: 5 * time.Second}
+    ws, _, err := dialer.Dial(fmt.Sprintf("ws://127.0.0.1:%d/socket", srvPort), http.Header{"Host": {"live.example.com"}})
+    if err != nil { t.Fatalf("dial: %v", err) }
+    defer ws.Close()
+    if ws.Subprotocol() != "echo" {
+        t.Fatalf("subprotocol not negotiated: %q", ws.Subprotocol())
+    }
+
+    for _, msg := range []string{"hello", "world"} {
+        if err := ws.WriteMessage(websocket.TextMessage, []byte(msg)); err != nil { t.Fatalf("write: %v", err) }
+        ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+        _, data, err := ws.ReadMessage()
+        if err != nil { t.Fatalf("read: %v", err) }
+        if string(data) != "echo:"+msg {
+            t.Fatalf("unexpected frame: %s", data)
+        }
+    }
+
+    // frames show up in the request log
+    resp, err := http.Get(serverURL + "/api/requests")
+    if err != nil { t.Fatalf("api: %v", err) }
+    var entries []struct{ Method, Body string }
+    json.NewDecoder(resp.Body).Decode(&entries)
+    var in, out int
+    for _, e := range entries {
+        switch e.Method {
+        case "WS-IN":
+            in++
+        case "WS-OUT":
+            out++
+        }
+    }
+    if in < 2 || out < 2 {
+        t.Fatalf("expected logged frames, got in=%d out=%d", in, out)
+    }
+}
+
+func TestStalledWebSocket(t *testing.T) {
+    tempDir := t.TempDir()
+
+    serverBin := filepath.Join(tempDir, "portkey-server")
+    clientBin := filepath.Join(tempDir, "portkey-client")
+
+    buildBinary(t, "../cmd/server", serverBin)
+    buildBinary(t, "../cmd/client", clientBin)
+
+    // local app floods every WebSocket it gets, and answers plain requests
+    local := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if !websocket.IsWebSocketUpgrade(r) {
+            fmt.Fprint(w, "pong")
+            return
+        }
+        ws, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+        if err != nil { return }
+        defer ws.Close()
+        frame := []byte(strings.Repeat("x", 64<<10))
+        for ws.WriteMessage(websocket.BinaryMessage, frame) == nil {
+        }
+    }))
+    defer local.Close()
+    localPort := strings.Split(local.URL, ":")[2]
+
+    for _, transport := range []string{"ws", "quic"} {
+        t.Run(transport, func(t *testing.T) {
+            srvPort, _ := findFreePort()
+            quicPort, _ := findFreePort()
+            serverURL := fmt.Sprintf("http://127.0.0.1:%d", srvPort)
+
+            ctx, cancel := context.WithCancel(context.Background())
+            defer cancel()
+
+            srvCmd := exec.CommandContext(ctx, serverBin, "--port", fmt.Sprintf("%d", srvPort), "--domain", "example.com", "--quic-port", fmt.Sprintf("%d", quicPort))
+            srvCmd.Stdout, srvCmd.Stderr = os.Stdout, os.Stderr
+            if err := srvCmd.Start(); err != nil { t.Fatalf("srv: %v", err) }
+            time.Sleep(300 * time.Millisecond)
+
+            clientCmd := exec.CommandContext(ctx, clientBin, "--server", serverURL, "--subdomain", "flood", "--port", localPort,
+                "--transport", transport, "--quic-port", fmt.Sprintf("%d", quicPort), "--quic-insecure")
+            clientCmd.Stdout, clientCmd.Stderr = os.Stdout, os.Stderr
+            if err := clientCmd.Start(); err != nil { t.Fatalf("cli: %v", err) }
+            defer func() { cancel(); clientCmd.Wait(); srvCmd.Wait() }()
+            time.Sleep(500 * time.Millisecond)
+
+            // a visitor that opens a socket and never reads from it
+            ws, _, err := websocket.DefaultDialer.Dial(fmt.Sprintf("ws://127.0.0.1:%d/socket", srvPort), http.Header{"Host": {"flood.example.com"}})
+            if err != nil { t.Fatalf("dial: %v", err) }
+            defer ws.Close()
+            time.Sleep(time.Second)
+
+            // must not hold up the rest of the tunnel
+            req, _ := http.NewRequest("GET", serverURL+"/ping", nil)
+            req.Host = "flood.example.com"
+            resp, err := (&http.Client{Timeout: 5 * time.Second}).Do(req)
+            if err != nil { t.Fatalf("request beside a stalled socket: %v", err) }
+            resp.Body.Close()
+            if resp.StatusCode != http.StatusOK {
+                t.Errorf("request beside a stalled socket: status %d", resp.StatusCode)
+            }
+        })
+    }
+}
+
+func TestWebSocketHandshakeAbandoned(t *testing.T) {
+    tempDir := t.TempDir()
+
+    serverBin := filepath.Join(tempDir, "portkey-server")
+    clientBin := filepath.Join(tempDir, "portkey-client")
+
+    buildBinary(t, "../cmd/server", serverBin)
+    buildBinary(t, "../cmd/client", clientBin)
+
+    // local app takes its time over the handshake, noting when it is given up on
+    started, gone := make(chan struct{}, 1), make(chan struct{}, 1)
+    local := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        started <- struct{}{}
+        <-r.Context().Done()
+        gone <- struct{}{}
+    }))
+    defer local.Close()
+    localPort := strings.Split(local.URL, ":")[2]
+
+    srvPort, _ := findFreePort()
+
+    ctx, cancel := context.WithCancel(context.Background())
+    defer cancel()
+
+    srvCmd := exec.CommandContext(ctx, serverBin, "--port", fmt.Sprintf("%d", srvPort), "--domain", "example.com")
+    srvCmd.Stdout, srvCmd.Stderr = os.Stdout, os.Stderr
+    if err := srvCmd.Start(); err != nil { t.Fatalf("srv: %v", err) }
+    time.Sleep(300 * time.Millisecond)
+
+    serverURL := fmt.Sprintf("http://127.0.0.1:%d", srvPort)
+    clientCmd := exec.CommandContext(ctx, clientBin, "--server", serverURL, "--subdomain", "slow", "--port", localPort)
+    clientCmd.Stdout, clientCmd.Stderr = os.Stdout, os.Stderr
+    if err := clientCmd.Start(); err != nil { t.Fatalf("cli: %v", err) }
+    defer func() { cancel(); clientCmd.Wait(); srvCmd.Wait() }()
+    time.Sleep(500 * time.Millisecond)
+
+    // the visitor hangs up half way through the handshake
+    conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", srvPort))
+    if err != nil { t.Fatalf("dial: %v", err) }
+    fmt.Fprint(conn, "GET /socket HTTP/1.1\r\nHost: slow.example.com\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n"+
+        "Sec-WebSocket-Version: 13\r\nSec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n\r\n")
+    select {
+    case <-started:
+    case <-time.After(5 * time.Second):
+        t.Fatalf("handshake never reached the local app")
+    }
+    conn.Close()
+
+    select {
+    case <-gone:
+    case <-time.After(5 * time.Second):
+        t.Fatalf("local handshake still open after the visitor left")
+    }
+}
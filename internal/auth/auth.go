@@ -66,6 +66,16 @@ func (m *Manager) Validate(token, sub string) bool {
     return false
 }
 
+// Known reports whether the token exists, regardless of its subdomain scope.
+// Tunnels that aren't addressed by subdomain (raw TCP) only require this.
+func (m *Manager) Known(token string) bool {
+    if token == "" {
+        return false
+    }
+    _, ok := m.entries[token]
+    return ok
+}
+
 // Role returns role for token or empty string if not found.
 func (m *Manager) Role(token string) string {
     if e, ok := m.entries[token]; ok {
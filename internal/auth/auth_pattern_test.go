@@ -1,6 +1,9 @@
 package auth
 
-import "testing"
+import (
+	"strings"
+	"testing"
+)
 
 func TestPatternValidation(t *testing.T) {
     m := &Manager{entries: map[string]TokenEntry{
@@ -14,3 +17,22 @@ func TestPatternValidation(t *testing.T) {
         t.Errorf("unexpected match")
     }
 }
+
+func TestGenerateWithinPatterns(t *testing.T) {
+    for i := 0; i < 50; i++ {
+        name, ok := Generate([]string{"project1", "project1-*"})
+        if !ok || !strings.HasPrefix(name, "project1-") || strings.Count(name, "-") != 3 {
+            t.Fatalf("unexpected name %q ok=%v", name, ok)
+        }
+        m := &Manager{entries: map[string]TokenEntry{"t1": {Token: "t1", Subdomains: []string{"project1-*"}}}}
+        if !m.Validate("t1", name) {
+            t.Fatalf("generated name %q outside its pattern", name)
+        }
+    }
+    if _, ok := Generate([]string{"project1", "dev-?"}); ok {
+        t.Fatalf("expected no name without a '*' pattern")
+    }
+    if got := Exact([]string{"project1", "project1-*", "*"}); len(got) != 1 || got[0] != "project1" {
+        t.Fatalf("unexpected exact names %v", got)
+    }
+}
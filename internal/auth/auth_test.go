@@ -18,3 +18,15 @@ func TestValidate(t *testing.T) {
         t.Fatalf("admin should allow any subdomain")
     }
 }
+
+func TestKnown(t *testing.T) {
+    m := &Manager{entries: map[string]TokenEntry{
+        "abc": {Token: "abc", Subdomains: []string{"project1"}, Role: "user"},
+    }}
+    if !m.Known("abc") {
+        t.Fatalf("expected token to be known")
+    }
+    if m.Known("") || m.Known("nope") {
+        t.Fatalf("unexpected known token")
+    }
+}
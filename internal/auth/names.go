@@ -0,0 +1,67 @@
+package auth
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"path"
+	"strings"
+)
+
+// Words for generated sub-domains, e.g. "brave-otter-42".
+var (
+    adjectives = []string{
+        "amber", "bold", "brave", "bright", "calm", "clever", "cosmic", "crisp",
+        "eager", "fancy", "gentle", "golden", "happy", "jolly", "keen", "lively",
+        "lucky", "mellow", "merry", "nimble", "proud", "quick", "quiet", "rapid",
+        "shiny", "silent", "snowy", "sunny", "swift", "tidy", "vivid", "witty",
+    }
+    nouns = []string{
+        "badger", "beacon", "comet", "falcon", "fern", "fox", "harbor", "heron",
+        "lantern", "maple", "meadow", "moon", "otter", "owl", "panda", "pebble",
+        "pine", "planet", "raven", "river", "robin", "rocket", "sparrow", "star",
+        "stone", "tiger", "trail", "tulip", "walrus", "willow", "wombat", "zephyr",
+    }
+)
+
+// Patterns returns the sub-domain patterns token may use.
+func (m *Manager) Patterns(token string) []string {
+    return m.entries[token].Subdomains
+}
+
+// Generate returns a random, readable sub-domain matching one of patterns,
+// filling each '*' with words such as "brave-otter-42": "project1-*" gives
+// "project1-brave-otter-42". Only patterns whose sole wildcard is '*' are
+// used; it reports false if there are none.
+func Generate(patterns []string) (string, bool) {
+    var usable []string
+    for _, p := range patterns {
+        if strings.Contains(p, "*") && !strings.ContainsAny(p, "?[\\") {
+            usable = append(usable, p)
+        }
+    }
+    if len(usable) == 0 {
+        return "", false
+    }
+    p := usable[rand.IntN(len(usable))]
+    name := p
+    for strings.Contains(name, "*") {
+        word := fmt.Sprintf("%s-%s-%d", adjectives[rand.IntN(len(adjectives))], nouns[rand.IntN(len(nouns))], 10+rand.IntN(90))
+        name = strings.Replace(name, "*", word, 1)
+    }
+    // A DNS label is at most 63 characters.
+    if ok, _ := path.Match(p, name); !ok || len(name) > 63 {
+        return "", false
+    }
+    return name, true
+}
+
+// Exact returns the patterns that name a single sub-domain.
+func Exact(patterns []string) []string {
+    var names []string
+    for _, p := range patterns {
+        if !strings.ContainsAny(p, "*?[\\") {
+            names = append(names, p)
+        }
+    }
+    return names
+}
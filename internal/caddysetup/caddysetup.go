@@ -4,6 +4,7 @@ import (
 	"context"
 	"encoding/json"
 	"log"
+	"time"
 
 	caddy "github.com/caddyserver/caddy/v2"
 	// Register standard modules (http, tls, reverse_proxy, file storage, etc.)
@@ -12,7 +13,8 @@ import (
 
 // Start launches an embedded Caddy instance that proxies from listenAddr
 // to upstream (e.g., 127.0.0.1:8081). Domain/email are used for automatic TLS.
-func Start(ctx context.Context, listenAddr, upstream, domain, email, askURL string) error {
+// When stopped, Caddy waits up to grace for requests in flight.
+func Start(ctx context.Context, listenAddr, upstream, domain, email, askURL string, grace time.Duration) error {
     // Build TLS automation policy, using internal issuer for localhost/dev
     policy := map[string]any{
         "on_demand": true,
@@ -34,12 +36,34 @@ func Start(ctx context.Context, listenAddr, upstream, domain, email, askURL stri
                 },
             },
             "http": map[string]any{
+                "grace_period": grace.String(),
                 "servers": map[string]any{
                     "srv0": map[string]any{
                         "listen": []string{listenAddr},
+                        // Routes match any host: custom domains point here
+                        // too, and the ask endpoint decides which hosts get
+                        // a certificate.
                         "routes": []any{
+                            // gRPC needs HTTP/2 all the way through; the
+                            // upstream accepts it in cleartext (h2c). Other
+                            // traffic keeps HTTP/1.1 so WebSocket upgrades work.
+                            map[string]any{
+                                "match": []any{map[string]any{
+                                    "header": map[string][]string{"Content-Type": {"application/grpc*"}},
+                                }},
+                                "handle": []any{
+                                    map[string]any{
+                                        "handler":        "reverse_proxy",
+                                        "flush_interval": -1,
+                                        "transport":      map[string]any{"protocol": "http", "versions": []string{"h2c"}},
+                                        "upstreams": []any{
+                                            map[string]any{"dial": upstream},
+                                        },
+                                    },
+                                },
+                                "terminal": true,
+                            },
                             map[string]any{
-                                "match": []any{map[string]any{"host": []string{domain, "*." + domain}}},
                                 "handle": []any{
                                     map[string]any{
                                         "handler": "reverse_proxy",
@@ -76,3 +100,9 @@ func Start(ctx context.Context, listenAddr, upstream, domain, email, askURL stri
     log.Printf("Caddy started on %s, proxy -> %s", listenAddr, upstream)
     return nil
 }
+
+// Stop closes Caddy's listeners and returns once the requests it was
+// proxying are done, or the grace period given to Start is up.
+func Stop() error {
+    return caddy.Stop()
+}
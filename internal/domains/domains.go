@@ -0,0 +1,180 @@
+package domains
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+    ErrExists   = errors.New("domain already mapped")
+    ErrNotFound = errors.New("no such domain")
+)
+
+// Domain maps a custom host name, such as dev.example.org, onto the tunnel
+// serving a subdomain. It is only routed once its CNAME has been verified.
+type Domain struct {
+    Host      string    `json:"host"`
+    Subdomain string    `json:"subdomain"`
+    Owner     string    `json:"owner,omitempty"` // token whose tunnel may serve it; any if empty
+    Verified  bool      `json:"verified"`
+    Created   time.Time `json:"created"`
+}
+
+// Resolver looks up the canonical name of a host; *net.Resolver is one.
+type Resolver interface {
+    LookupCNAME(ctx context.Context, host string) (string, error)
+}
+
+// Store is the custom domain table, saved as JSON to a file if it has a
+// path. Safe for concurrent use.
+type Store struct {
+    mu   sync.RWMutex
+    path string
+    m    map[string]Domain // by host
+}
+
+// Open loads the table from path; a missing file is an empty table. An empty
+// path keeps the table in memory only.
+func Open(path string) (*Store, error) {
+    s := &Store{path: path, m: make(map[string]Domain)}
+    if path == "" {
+        return s, nil
+    }
+    raw, err := os.ReadFile(path)
+    if errors.Is(err, os.ErrNotExist) {
+        return s, nil
+    }
+    if err != nil {
+        return nil, err
+    }
+    var list []Domain
+    if err := json.Unmarshal(raw, &list); err != nil {
+        return nil, fmt.Errorf("%s: %w", path, err)
+    }
+    for _, d := range list {
+        s.m[d.Host] = d
+    }
+    return s, nil
+}
+
+// Normalize lower-cases host and drops a trailing dot, as hosts are stored.
+func Normalize(host string) string {
+    return strings.TrimSuffix(strings.ToLower(host), ".")
+}
+
+// Lookup returns the mapping for host, verified or not.
+func (s *Store) Lookup(host string) (Domain, bool) {
+    s.mu.RLock()
+    defer s.mu.RUnlock()
+    d, ok := s.m[Normalize(host)]
+    return d, ok
+}
+
+// List returns every mapping, ordered by host.
+func (s *Store) List() []Domain {
+    s.mu.RLock()
+    defer s.mu.RUnlock()
+    list := make([]Domain, 0, len(s.m))
+    for _, d := range s.m {
+        list = append(list, d)
+    }
+    sort.Slice(list, func(i, j int) bool { return list[i].Host < list[j].Host })
+    return list
+}
+
+// Add maps a new host, unverified. Like every change to the table, it is
+// undone if the table can't be saved.
+func (s *Store) Add(d Domain) (Domain, error) {
+    d.Host = Normalize(d.Host)
+    if d.Host == "" || d.Subdomain == "" {
+        return Domain{}, errors.New("host and subdomain are required")
+    }
+    if strings.ContainsAny(d.Host, ":/ ") || !strings.Contains(d.Host, ".") {
+        return Domain{}, fmt.Errorf("invalid host %q", d.Host)
+    }
+    d.Verified, d.Created = false, time.Now().UTC()
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    if _, ok := s.m[d.Host]; ok {
+        return Domain{}, ErrExists
+    }
+    s.m[d.Host] = d
+    if err := s.save(); err != nil {
+        delete(s.m, d.Host)
+        return Domain{}, err
+    }
+    return d, nil
+}
+
+// Remove deletes the mapping for host.
+func (s *Store) Remove(host string) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    host = Normalize(host)
+    old, ok := s.m[host]
+    if !ok {
+        return ErrNotFound
+    }
+    delete(s.m, host)
+    if err := s.save(); err != nil {
+        s.m[host] = old
+        return err
+    }
+    return nil
+}
+
+// Verify checks that host is a CNAME for target and, if so, marks it
+// verified.
+func (s *Store) Verify(ctx context.Context, host, target string, r Resolver) (Domain, error) {
+    host = Normalize(host)
+    if _, ok := s.Lookup(host); !ok {
+        return Domain{}, ErrNotFound
+    }
+    cname, err := r.LookupCNAME(ctx, host)
+    if err != nil {
+        return Domain{}, fmt.Errorf("looking up %s: %w", host, err)
+    }
+    if Normalize(cname) != Normalize(target) {
+        return Domain{}, fmt.Errorf("%s points at %q, not %s", host, Normalize(cname), target)
+    }
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    d, ok := s.m[host]
+    if !ok {
+        return Domain{}, ErrNotFound
+    }
+    old := d
+    d.Verified = true
+    s.m[host] = d
+    if err := s.save(); err != nil {
+        s.m[host] = old
+        return Domain{}, err
+    }
+    return d, nil
+}
+
+// save writes the table to its file, if any, replacing it atomically. The
+// caller holds the write lock.
+func (s *Store) save() error {
+    if s.path == "" {
+        return nil
+    }
+    list := make([]Domain, 0, len(s.m))
+    for _, d := range s.m {
+        list = append(list, d)
+    }
+    sort.Slice(list, func(i, j int) bool { return list[i].Host < list[j].Host })
+    raw, _ := json.MarshalIndent(list, "", "  ")
+    tmp := s.path + ".tmp"
+    if err := os.WriteFile(tmp, raw, 0o600); err != nil {
+        return err
+    }
+    return os.Rename(tmp, s.path)
+}
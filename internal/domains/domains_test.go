@@ -0,0 +1,69 @@
+package domains
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+// fakeResolver answers CNAME lookups from a map.
+type fakeResolver map[string]string
+
+func (f fakeResolver) LookupCNAME(_ context.Context, host string) (string, error) {
+    if c, ok := f[host]; ok {
+        return c, nil
+    }
+    return "", errors.New("no such host")
+}
+
+func TestVerifyAndPersist(t *testing.T) {
+    path := filepath.Join(t.TempDir(), "domains.json")
+    s, err := Open(path)
+    if err != nil { t.Fatalf("open: %v", err) }
+
+    if _, err := s.Add(Domain{Host: "Dev.Example.org.", Subdomain: "dev", Owner: "tok"}); err != nil {
+        t.Fatalf("add: %v", err)
+    }
+    if _, err := s.Add(Domain{Host: "dev.example.org", Subdomain: "other"}); err != ErrExists {
+        t.Fatalf("expected ErrExists, got %v", err)
+    }
+    if d, ok := s.Lookup("dev.example.org"); !ok || d.Verified {
+        t.Fatalf("expected an unverified mapping, got %+v ok=%v", d, ok)
+    }
+
+    r := fakeResolver{"dev.example.org": "elsewhere.example.net."}
+    if _, err := s.Verify(context.Background(), "dev.example.org", "dev.tunnel.test", r); err == nil {
+        t.Fatalf("expected a CNAME pointing elsewhere to fail")
+    }
+    r["dev.example.org"] = "DEV.tunnel.test."
+    if d, err := s.Verify(context.Background(), "dev.example.org", "dev.tunnel.test", r); err != nil || !d.Verified {
+        t.Fatalf("verify: %+v, %v", d, err)
+    }
+
+    // the table survives a restart
+    s, err = Open(path)
+    if err != nil { t.Fatalf("reopen: %v", err) }
+    if d, ok := s.Lookup("dev.example.org"); !ok || !d.Verified || d.Subdomain != "dev" || d.Owner != "tok" {
+        t.Fatalf("unexpected mapping after reload: %+v ok=%v", d, ok)
+    }
+    if err := s.Remove("dev.example.org"); err != nil {
+        t.Fatalf("remove: %v", err)
+    }
+    if len(s.List()) != 0 {
+        t.Fatalf("expected an empty table")
+    }
+}
+
+func TestFailedSaveLeavesTableUnchanged(t *testing.T) {
+    // the directory doesn't exist, so the table loads empty but can't be saved
+    s, err := Open(filepath.Join(t.TempDir(), "missing", "domains.json"))
+    if err != nil { t.Fatalf("open: %v", err) }
+
+    if _, err := s.Add(Domain{Host: "dev.example.org", Subdomain: "dev"}); err == nil {
+        t.Fatalf("expected the save to fail")
+    }
+    if d, ok := s.Lookup("dev.example.org"); ok {
+        t.Fatalf("expected no mapping after a failed add, got %+v", d)
+    }
+}
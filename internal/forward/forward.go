@@ -0,0 +1,148 @@
+package forward
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// Trusted is the set of proxies whose forwarding headers, and PROXY protocol
+// headers, are believed.
+type Trusted []netip.Prefix
+
+// ParseTrusted parses a comma-separated list of CIDRs or single addresses.
+func ParseTrusted(s string) (Trusted, error) {
+    var t Trusted
+    for _, f := range strings.Split(s, ",") {
+        f = strings.TrimSpace(f)
+        if f == "" {
+            continue
+        }
+        if !strings.Contains(f, "/") {
+            addr, err := netip.ParseAddr(f)
+            if err != nil {
+                return nil, fmt.Errorf("trusted proxy %q: %w", f, err)
+            }
+            t = append(t, netip.PrefixFrom(addr, addr.BitLen()))
+            continue
+        }
+        p, err := netip.ParsePrefix(f)
+        if err != nil {
+            return nil, fmt.Errorf("trusted proxy %q: %w", f, err)
+        }
+        t = append(t, p.Masked())
+    }
+    return t, nil
+}
+
+// Contains reports whether ip, as text, is a trusted proxy.
+func (t Trusted) Contains(ip string) bool {
+    addr, err := netip.ParseAddr(ip)
+    if err != nil {
+        return false
+    }
+    addr = addr.Unmap()
+    for _, p := range t {
+        if p.Contains(addr) {
+            return true
+        }
+    }
+    return false
+}
+
+// hostIP returns the IP part of a host:port address.
+func hostIP(addr string) string {
+    if host, _, err := net.SplitHostPort(addr); err == nil {
+        return host
+    }
+    return addr
+}
+
+// ClientIP returns the visitor's IP for r. The X-Forwarded-For chain is only
+// followed back through trusted proxies: the first hop that isn't one is the
+// client.
+func ClientIP(r *http.Request, t Trusted) string {
+    ip := hostIP(r.RemoteAddr)
+    if !t.Contains(ip) {
+        return ip
+    }
+    chain := forwardedFor(r.Header)
+    for i := len(chain) - 1; i >= 0; i-- {
+        ip = chain[i]
+        if !t.Contains(ip) {
+            break
+        }
+    }
+    return ip
+}
+
+// forwardedFor returns the addresses in h's X-Forwarded-For headers, in order.
+func forwardedFor(h http.Header) []string {
+    var chain []string
+    for _, v := range h.Values("X-Forwarded-For") {
+        for _, ip := range strings.Split(v, ",") {
+            if ip = strings.TrimSpace(ip); ip != "" {
+                chain = append(chain, hostIP(ip))
+            }
+        }
+    }
+    return chain
+}
+
+// Set writes X-Forwarded-For, -Proto, -Host and Forwarded (RFC 7239) into h,
+// the headers to send on for r. What a trusted proxy sent is extended; from
+// anyone else the headers are replaced.
+func Set(h http.Header, r *http.Request, t Trusted) {
+    peer := hostIP(r.RemoteAddr)
+    proto, host := "http", r.Host
+    if r.TLS != nil {
+        proto = "https"
+    }
+    if t.Contains(peer) {
+        if p := r.Header.Get("X-Forwarded-Proto"); p != "" {
+            proto = p
+        }
+        if fh := r.Header.Get("X-Forwarded-Host"); fh != "" {
+            host = fh
+        }
+        chain := append(forwardedFor(r.Header), peer)
+        h.Set("X-Forwarded-For", strings.Join(chain, ", "))
+        prior := strings.Join(r.Header.Values("Forwarded"), ", ")
+        if prior == "" {
+            // Build the earlier hops from X-Forwarded-For.
+            elems := make([]string, 0, len(chain)-1)
+            for _, ip := range chain[:len(chain)-1] {
+                elems = append(elems, "for="+node(ip))
+            }
+            prior = strings.Join(elems, ", ")
+        }
+        last := fmt.Sprintf("for=%s;host=%s;proto=%s", node(peer), quote(host), proto)
+        if prior != "" {
+            last = prior + ", " + last
+        }
+        h.Set("Forwarded", last)
+    } else {
+        h.Set("X-Forwarded-For", peer)
+        h.Set("Forwarded", fmt.Sprintf("for=%s;host=%s;proto=%s", node(peer), quote(host), proto))
+    }
+    h.Set("X-Forwarded-Proto", proto)
+    h.Set("X-Forwarded-Host", host)
+}
+
+// node formats ip as a Forwarded node: IPv6 addresses are bracketed and quoted.
+func node(ip string) string {
+    if strings.Contains(ip, ":") {
+        return `"[` + ip + `]"`
+    }
+    return ip
+}
+
+// quote makes v a Forwarded value, quoting it unless it is a plain token.
+func quote(v string) string {
+    if v != "" && !strings.ContainsAny(v, ":[]\"\\ ,;=") {
+        return v
+    }
+    return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(v) + `"`
+}
@@ -0,0 +1,115 @@
+package forward
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestClientIPFollowsTrustedProxiesOnly(t *testing.T) {
+    trusted, err := ParseTrusted("10.0.0.0/8, 127.0.0.1")
+    if err != nil { t.Fatalf("parse: %v", err) }
+
+    r, _ := http.NewRequest("GET", "/", nil)
+    r.Header.Set("X-Forwarded-For", "198.51.100.9, 203.0.113.7, 10.1.2.3")
+
+    // a visitor can't spoof its address...
+    r.RemoteAddr = "192.0.2.1:5000"
+    if ip := ClientIP(r, trusted); ip != "192.0.2.1" {
+        t.Errorf("untrusted peer: got %s", ip)
+    }
+    // ...but a trusted proxy's chain is followed to the first untrusted hop
+    r.RemoteAddr = "127.0.0.1:5000"
+    if ip := ClientIP(r, trusted); ip != "203.0.113.7" {
+        t.Errorf("trusted peer: got %s", ip)
+    }
+}
+
+func TestSetForwardingHeaders(t *testing.T) {
+    trusted, _ := ParseTrusted("127.0.0.1")
+    r, _ := http.NewRequest("GET", "/", nil)
+    r.Host = "shop.example.com"
+    r.Header.Set("X-Forwarded-For", "203.0.113.7")
+    r.Header.Set("X-Forwarded-Proto", "https")
+
+    r.RemoteAddr = "127.0.0.1:5000"
+    h := http.Header{}
+    Set(h, r, trusted)
+    if got := h.Get("X-Forwarded-For"); got != "203.0.113.7, 127.0.0.1" {
+        t.Errorf("X-Forwarded-For = %q", got)
+    }
+    if got := h.Get("Forwarded"); got != "for=203.0.113.7, for=127.0.0.1;host=shop.example.com;proto=https" {
+        t.Errorf("Forwarded = %q", got)
+    }
+    if h.Get("X-Forwarded-Proto") != "https" || h.Get("X-Forwarded-Host") != "shop.example.com" {
+        t.Errorf("proto/host = %q %q", h.Get("X-Forwarded-Proto"), h.Get("X-Forwarded-Host"))
+    }
+
+    // from an untrusted peer the claimed chain and scheme are dropped
+    r.RemoteAddr = "[2001:db8::1]:5000"
+    h = http.Header{}
+    Set(h, r, trusted)
+    if h.Get("X-Forwarded-For") != "2001:db8::1" || h.Get("X-Forwarded-Proto") != "http" {
+        t.Errorf("untrusted: %v", h)
+    }
+    if got := h.Get("Forwarded"); got != `for="[2001:db8::1]";host=shop.example.com;proto=http` {
+        t.Errorf("Forwarded = %q", got)
+    }
+}
+
+func TestReadHeader(t *testing.T) {
+    v2 := append([]byte{}, v2Signature...)
+    v2 = append(v2, 0x21, 0x11, 0, 12, 203, 0, 113, 7, 10, 0, 0, 1)
+    v2 = binary.BigEndian.AppendUint16(v2, 4321)
+    v2 = binary.BigEndian.AppendUint16(v2, 80)
+
+    for name, tc := range map[string]struct {
+        in, addr string
+    }{
+        "v1":      {"PROXY TCP4 203.0.113.7 10.0.0.1 4321 80\r\nGET /", "203.0.113.7:4321"},
+        "v1 ipv6": {"PROXY TCP6 2001:db8::7 2001:db8::1 4321 80\r\nGET /", "[2001:db8::7]:4321"},
+        "unknown": {"PROXY UNKNOWN\r\nGET /", ""},
+        "v2":      {string(v2) + "GET /", "203.0.113.7:4321"},
+        "none":    {"GET / HTTP/1.1\r\n", ""},
+    } {
+        r := bufio.NewReader(strings.NewReader(tc.in))
+        addr, err := readHeader(r)
+        if err != nil { t.Fatalf("%s: %v", name, err) }
+        if got := ""; addr != nil {
+            got = addr.String()
+            if got != tc.addr { t.Errorf("%s: addr %s, want %s", name, got, tc.addr) }
+        } else if tc.addr != "" {
+            t.Errorf("%s: no address, want %s", name, tc.addr)
+        }
+        rest, _ := io.ReadAll(r)
+        if !strings.HasPrefix(string(rest), "GET /") {
+            t.Errorf("%s: left %q", name, rest)
+        }
+    }
+    if _, err := readHeader(bufio.NewReader(strings.NewReader("PROXY TCP4 nonsense\r\n"))); err == nil {
+        t.Errorf("expected a malformed header to fail")
+    }
+}
+
+func TestListenerOnlyTrustsConfiguredPeers(t *testing.T) {
+    inner, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil { t.Fatalf("listen: %v", err) }
+    defer inner.Close()
+    ln := &Listener{Listener: inner, Trusted: Trusted{}}
+
+    go func() {
+        c, _ := net.Dial("tcp", inner.Addr().String())
+        io.WriteString(c, "PROXY TCP4 203.0.113.7 10.0.0.1 4321 80\r\n")
+        c.Close()
+    }()
+    c, err := ln.Accept()
+    if err != nil { t.Fatalf("accept: %v", err) }
+    defer c.Close()
+    if ip := hostIP(c.RemoteAddr().String()); ip != "127.0.0.1" {
+        t.Errorf("untrusted peer's header believed: %s", ip)
+    }
+}
@@ -0,0 +1,152 @@
+package forward
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// v2Signature starts a PROXY protocol v2 header.
+var v2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// headerTimeout bounds how long a trusted peer may take to send its header.
+const headerTimeout = 5 * time.Second
+
+// Listener accepts connections that may start with a PROXY protocol (v1 or
+// v2) header, as sent by load balancers, and reports the address in it as the
+// connection's remote address. Only trusted peers may send one; from anyone
+// else the bytes are left alone, so a visitor can't claim another address.
+type Listener struct {
+    net.Listener
+    Trusted Trusted
+}
+
+func (l *Listener) Accept() (net.Conn, error) {
+    c, err := l.Listener.Accept()
+    if err != nil {
+        return nil, err
+    }
+    if !l.Trusted.Contains(hostIP(c.RemoteAddr().String())) {
+        return c, nil
+    }
+    return &proxyConn{Conn: c, r: bufio.NewReader(c)}, nil
+}
+
+// proxyConn reads the PROXY header, if there is one, before anything else:
+// lazily, so a slow peer holds up its own connection only.
+type proxyConn struct {
+    net.Conn
+    r      *bufio.Reader
+    once   sync.Once
+    remote net.Addr
+    err    error
+}
+
+func (c *proxyConn) init() {
+    c.once.Do(func() {
+        c.remote = c.Conn.RemoteAddr()
+        c.Conn.SetReadDeadline(time.Now().Add(headerTimeout))
+        defer c.Conn.SetReadDeadline(time.Time{})
+        addr, err := readHeader(c.r)
+        if err != nil {
+            c.err = fmt.Errorf("proxy protocol from %s: %w", c.remote, err)
+            c.Conn.Close()
+            return
+        }
+        if addr != nil {
+            c.remote = addr
+        }
+    })
+}
+
+func (c *proxyConn) Read(p []byte) (int, error) {
+    c.init()
+    if c.err != nil {
+        return 0, c.err
+    }
+    return c.r.Read(p)
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr {
+    c.init()
+    return c.remote
+}
+
+// readHeader consumes a PROXY header from r and returns the source address it
+// gives. It returns nil without consuming anything if r doesn't start with
+// one, and nil for headers that carry no address (LOCAL, UNKNOWN).
+func readHeader(r *bufio.Reader) (net.Addr, error) {
+    // A short read returns what there is: too little for either header.
+    start, _ := r.Peek(len(v2Signature))
+    switch {
+    case bytes.Equal(start, v2Signature):
+        return readV2(r)
+    case bytes.HasPrefix(start, []byte("PROXY ")):
+        return readV1(r)
+    }
+    return nil, nil
+}
+
+// readV1 parses "PROXY TCP4 src dst sport dport\r\n".
+func readV1(r *bufio.Reader) (net.Addr, error) {
+    line, err := r.ReadString('\n')
+    if err != nil {
+        return nil, err
+    }
+    if len(line) > 107 || !strings.HasSuffix(line, "\r\n") {
+        return nil, errors.New("malformed v1 header")
+    }
+    f := strings.Fields(line)
+    if len(f) >= 2 && f[1] == "UNKNOWN" {
+        return nil, nil
+    }
+    if len(f) != 6 || (f[1] != "TCP4" && f[1] != "TCP6") {
+        return nil, errors.New("malformed v1 header")
+    }
+    ip := net.ParseIP(f[2])
+    port, err := strconv.Atoi(f[4])
+    if ip == nil || err != nil {
+        return nil, errors.New("malformed v1 address")
+    }
+    return &net.TCPAddr{IP: ip, Port: port}, nil
+}
+
+// readV2 parses the binary header: signature, version and command, family,
+// length, then the addresses.
+func readV2(r *bufio.Reader) (net.Addr, error) {
+    var hdr [16]byte
+    if _, err := io.ReadFull(r, hdr[:]); err != nil {
+        return nil, err
+    }
+    if hdr[12]>>4 != 2 {
+        return nil, errors.New("unsupported v2 version")
+    }
+    body := make([]byte, binary.BigEndian.Uint16(hdr[14:16]))
+    if _, err := io.ReadFull(r, body); err != nil {
+        return nil, err
+    }
+    if hdr[12]&0x0f == 0 {
+        return nil, nil // LOCAL: the proxy's own connection, e.g. a health check
+    }
+    switch hdr[13] >> 4 {
+    case 1: // AF_INET
+        if len(body) < 12 {
+            return nil, errors.New("short v2 address")
+        }
+        return &net.TCPAddr{IP: net.IP(body[0:4]), Port: int(binary.BigEndian.Uint16(body[8:10]))}, nil
+    case 2: // AF_INET6
+        if len(body) < 36 {
+            return nil, errors.New("short v2 address")
+        }
+        return &net.TCPAddr{IP: net.IP(body[0:16]), Port: int(binary.BigEndian.Uint16(body[32:34]))}, nil
+    }
+    return nil, nil
+}
@@ -0,0 +1,31 @@
+package logstore
+
+import "bytes"
+
+// MaxBodyCapture is the number of body bytes kept on a log entry.
+const MaxBodyCapture = 64 * 1024
+
+// BodyCapture is an io.Writer that keeps the first MaxBodyCapture bytes written
+// to it and discards the rest, so streamed bodies can be logged cheaply.
+type BodyCapture struct {
+    buf       bytes.Buffer
+    truncated bool
+}
+
+func (c *BodyCapture) Write(p []byte) (int, error) {
+    if room := MaxBodyCapture - c.buf.Len(); room < len(p) {
+        c.buf.Write(p[:room])
+        c.truncated = true
+        return len(p), nil
+    }
+    c.buf.Write(p)
+    return len(p), nil
+}
+
+// String returns the captured body, suffixed with a marker if it was cut short.
+func (c *BodyCapture) String() string {
+    if c.truncated {
+        return c.buf.String() + "…[truncated]"
+    }
+    return c.buf.String()
+}
@@ -3,6 +3,8 @@ package logstore
 import (
 	"sync"
 	"time"
+
+	"portkey/internal/tunnel"
 )
 
 type Entry struct {
@@ -11,9 +13,13 @@ type Entry struct {
     Method    string    `json:"method"`
     Path      string    `json:"path"`
     Status    int       `json:"status"`
-    Headers   map[string]string `json:"headers,omitempty"`
+    ClientIP  string    `json:"client_ip,omitempty"` // the visitor, past any trusted proxies
+    Headers   tunnel.Header     `json:"headers,omitempty"`
     Body      string            `json:"body,omitempty"`
     Timestamp time.Time         `json:"timestamp"`
+    // Only the client's inspector records what came back.
+    ResponseHeaders tunnel.Header `json:"response_headers,omitempty"`
+    ResponseBody    string        `json:"response_body,omitempty"`
 }
 
 // Store is a fixed-size circular buffer of entries safe for concurrent use.
@@ -16,3 +16,12 @@ func TestCircularBuffer(t *testing.T) {
         t.Fatalf("circular logic wrong: %+v", all)
     }
 }
+
+func TestBodyCaptureTruncates(t *testing.T) {
+    var c BodyCapture
+    c.Write(make([]byte, MaxBodyCapture-1))
+    c.Write([]byte("abc"))
+    if got := len(c.String()); got <= MaxBodyCapture || c.buf.Len() != MaxBodyCapture {
+        t.Fatalf("expected capture capped at %d bytes, got %d", MaxBodyCapture, c.buf.Len())
+    }
+}
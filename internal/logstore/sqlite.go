@@ -3,9 +3,12 @@ package logstore
 import (
 	"database/sql"
 	"encoding/json"
+	"fmt"
 	"time"
 
 	_ "modernc.org/sqlite"
+
+	"portkey/internal/tunnel"
 )
 
 type SQLite struct {
@@ -31,17 +34,79 @@ func NewSQLite(path string) (*SQLite, error) {
         body TEXT,
         ts INTEGER
     )`); err != nil { return nil, err }
+    if err := migrate(db); err != nil { return nil, err }
     return &SQLite{db: db}, nil
 }
 
+// migrations upgrade the schema one step each; PRAGMA user_version records
+// how many have been applied.
+var migrations = []func(*sql.Tx) error{
+    migrateHeaderLists,
+    migrateClientIP,
+}
+
+func migrate(db *sql.DB) error {
+    var version int
+    if err := db.QueryRow(`PRAGMA user_version`).Scan(&version); err != nil { return err }
+    for ; version < len(migrations); version++ {
+        tx, err := db.Begin()
+        if err != nil { return err }
+        if err := migrations[version](tx); err != nil {
+            tx.Rollback()
+            return fmt.Errorf("logstore migration %d: %w", version+1, err)
+        }
+        // PRAGMA doesn't take bind parameters.
+        if _, err := tx.Exec(fmt.Sprintf(`PRAGMA user_version = %d`, version+1)); err != nil {
+            tx.Rollback()
+            return err
+        }
+        if err := tx.Commit(); err != nil { return err }
+    }
+    return nil
+}
+
+// migrateHeaderLists rewrites headers stored as a flat JSON object into the
+// ordered field list. Values that were joined with ";" stay joined: splitting
+// them again would break headers such as Cookie that contain ";" themselves.
+func migrateHeaderLists(tx *sql.Tx) error {
+    rows, err := tx.Query(`SELECT id, headers FROM logs WHERE headers LIKE '{%'`)
+    if err != nil { return err }
+    converted := make(map[string]string)
+    for rows.Next() {
+        var id, headers string
+        if err := rows.Scan(&id, &headers); err != nil {
+            rows.Close()
+            return err
+        }
+        converted[id] = marshalJSON(unmarshalJSON(headers))
+    }
+    rows.Close()
+    if err := rows.Err(); err != nil { return err }
+    for id, headers := range converted {
+        if _, err := tx.Exec(`UPDATE logs SET headers = ? WHERE id = ?`, headers, id); err != nil { return err }
+    }
+    return nil
+}
+
+// migrateClientIP adds the visitor's address; older rows have none.
+func migrateClientIP(tx *sql.Tx) error {
+    _, err := tx.Exec(`ALTER TABLE logs ADD COLUMN client_ip TEXT NOT NULL DEFAULT ''`)
+    return err
+}
+
+// Close flushes the database to disk and closes it.
+func (s *SQLite) Close() error {
+    return s.db.Close()
+}
+
 func (s *SQLite) Add(e Entry) error {
-    _, err := s.db.Exec(`INSERT INTO logs (id, subdomain, method, path, status, headers, body, ts) VALUES (?,?,?,?,?,?,?,?)`,
-        e.ID, e.Subdomain, e.Method, e.Path, e.Status, marshalJSON(e.Headers), e.Body, e.Timestamp.Unix())
+    _, err := s.db.Exec(`INSERT INTO logs (id, subdomain, method, path, status, client_ip, headers, body, ts) VALUES (?,?,?,?,?,?,?,?,?)`,
+        e.ID, e.Subdomain, e.Method, e.Path, e.Status, e.ClientIP, marshalJSON(e.Headers), e.Body, e.Timestamp.Unix())
     return err
 }
 
 func (s *SQLite) All() ([]Entry, error) {
-    rows, err := s.db.Query(`SELECT id, subdomain, method, path, status, headers, body, ts FROM logs ORDER BY ts DESC`)
+    rows, err := s.db.Query(`SELECT id, subdomain, method, path, status, client_ip, headers, body, ts FROM logs ORDER BY ts DESC`)
     if err != nil { return nil, err }
     defer rows.Close()
     var out []Entry
@@ -49,7 +114,7 @@ func (s *SQLite) All() ([]Entry, error) {
         var e Entry
         var headers string
         var ts int64
-        if err := rows.Scan(&e.ID, &e.Subdomain, &e.Method, &e.Path, &e.Status, &headers, &e.Body, &ts); err != nil { return nil, err }
+        if err := rows.Scan(&e.ID, &e.Subdomain, &e.Method, &e.Path, &e.Status, &e.ClientIP, &headers, &e.Body, &ts); err != nil { return nil, err }
         e.Headers = unmarshalJSON(headers)
         e.Timestamp = time.Unix(ts,0)
         out = append(out, e)
@@ -57,8 +122,8 @@ func (s *SQLite) All() ([]Entry, error) {
     return out, nil
 }
 
-func marshalJSON(h map[string]string) string {
+func marshalJSON(h tunnel.Header) string {
     b, _ := json.Marshal(h)
     return string(b)
 }
-func unmarshalJSON(s string) map[string]string { var h map[string]string; _=json.Unmarshal([]byte(s),&h); return h }
+func unmarshalJSON(s string) tunnel.Header { var h tunnel.Header; _=json.Unmarshal([]byte(s),&h); return h }
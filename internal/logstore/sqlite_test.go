@@ -0,0 +1,54 @@
+package logstore
+
+import (
+	"database/sql"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"portkey/internal/tunnel"
+)
+
+func TestSQLiteMigratesFlatHeaders(t *testing.T) {
+    path := filepath.Join(t.TempDir(), "logs.db")
+
+    // a database written before headers were stored as field lists
+    db, err := sql.Open("sqlite", path)
+    if err != nil { t.Fatalf("open: %v", err) }
+    if _, err := db.Exec(`CREATE TABLE logs (id TEXT PRIMARY KEY, subdomain TEXT, method TEXT, path TEXT, status INTEGER, headers TEXT, body TEXT, ts INTEGER)`); err != nil {
+        t.Fatalf("create: %v", err)
+    }
+    if _, err := db.Exec(`INSERT INTO logs VALUES ('old', 'app', 'GET', '/', 200, '{"Accept":"*/*"}', '', 1)`); err != nil {
+        t.Fatalf("insert: %v", err)
+    }
+    db.Close()
+
+    s, err := NewSQLite(path)
+    if err != nil { t.Fatalf("NewSQLite: %v", err) }
+    multi := tunnel.Header{{Name: "Set-Cookie", Value: "a=1"}, {Name: "Set-Cookie", Value: "b=2"}}
+    if err := s.Add(Entry{ID: "new", Headers: multi, ClientIP: "203.0.113.7"}); err != nil { t.Fatalf("add: %v", err) }
+
+    entries, err := s.All()
+    if err != nil { t.Fatalf("all: %v", err) }
+    got := map[string]tunnel.Header{}
+    ips := map[string]string{}
+    for _, e := range entries {
+        got[e.ID] = e.Headers
+        ips[e.ID] = e.ClientIP
+    }
+    if ips["old"] != "" || ips["new"] != "203.0.113.7" {
+        t.Errorf("client IPs: %v", ips)
+    }
+    if !reflect.DeepEqual(got["old"], tunnel.Header{{Name: "Accept", Value: "*/*"}}) {
+        t.Errorf("legacy row not migrated: %+v", got["old"])
+    }
+    if !reflect.DeepEqual(got["new"], multi) {
+        t.Errorf("repeated values lost: %+v", got["new"])
+    }
+
+    var raw string
+    s.db.QueryRow(`SELECT headers FROM logs WHERE id = 'old'`).Scan(&raw)
+    if raw != `[{"name":"Accept","value":"*/*"}]` {
+        t.Errorf("legacy row stored as %s", raw)
+    }
+}
@@ -0,0 +1,71 @@
+package ports
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var ErrExhausted = errors.New("no free ports in range")
+
+// Pool hands out ports from an inclusive range, safe for concurrent use.
+type Pool struct {
+    mu    sync.Mutex
+    first int
+    last  int
+    used  map[int]bool
+    next  int
+}
+
+// ParseRange parses "20000-20100" (or a single port) into a Pool.
+func ParseRange(s string) (*Pool, error) {
+    lo, hi, found := strings.Cut(s, "-")
+    first, err := strconv.Atoi(strings.TrimSpace(lo))
+    if err != nil {
+        return nil, fmt.Errorf("port range %q: %w", s, err)
+    }
+    last := first
+    if found {
+        if last, err = strconv.Atoi(strings.TrimSpace(hi)); err != nil {
+            return nil, fmt.Errorf("port range %q: %w", s, err)
+        }
+    }
+    if first < 1 || last > 65535 || first > last {
+        return nil, fmt.Errorf("port range %q: invalid bounds", s)
+    }
+    return &Pool{first: first, last: last, used: make(map[int]bool), next: first}, nil
+}
+
+// Acquire reserves a port for which try succeeds. try is typically a listen
+// call; ports it fails on (e.g. taken by another process) are skipped. Ports
+// are handed out round-robin so a just-released port isn't reused at once.
+func (p *Pool) Acquire(try func(port int) error) (int, error) {
+    p.mu.Lock()
+    defer p.mu.Unlock()
+    size := p.last - p.first + 1
+    for i := 0; i < size; i++ {
+        port := p.next
+        p.next++
+        if p.next > p.last {
+            p.next = p.first
+        }
+        if p.used[port] {
+            continue
+        }
+        if err := try(port); err != nil {
+            continue
+        }
+        p.used[port] = true
+        return port, nil
+    }
+    return 0, ErrExhausted
+}
+
+// Release returns a port to the pool.
+func (p *Pool) Release(port int) {
+    p.mu.Lock()
+    defer p.mu.Unlock()
+    delete(p.used, port)
+}
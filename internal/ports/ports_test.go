@@ -0,0 +1,45 @@
+package ports
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestParseRange(t *testing.T) {
+    if _, err := ParseRange("20000-20010"); err != nil {
+        t.Fatalf("valid range: %v", err)
+    }
+    if _, err := ParseRange("3000"); err != nil {
+        t.Fatalf("single port: %v", err)
+    }
+    for _, bad := range []string{"", "x-1", "10-5", "0-10", "1-70000"} {
+        if _, err := ParseRange(bad); err == nil {
+            t.Errorf("expected error for %q", bad)
+        }
+    }
+}
+
+func TestAcquireRelease(t *testing.T) {
+    p, _ := ParseRange("100-102")
+    ok := func(int) error { return nil }
+
+    a, _ := p.Acquire(ok)
+    b, _ := p.Acquire(func(port int) error {
+        if port == 101 {
+            return errors.New("in use")
+        }
+        return nil
+    })
+    if a != 100 || b != 102 {
+        t.Fatalf("expected 100 and 102 (101 busy), got %d and %d", a, b)
+    }
+    if _, err := p.Acquire(func(port int) error {
+        return errors.New("in use")
+    }); !errors.Is(err, ErrExhausted) {
+        t.Fatalf("expected exhaustion, got %v", err)
+    }
+    p.Release(a)
+    if c, err := p.Acquire(ok); err != nil || c != 100 {
+        t.Fatalf("expected released port 100 back, got %d %v", c, err)
+    }
+}
@@ -1,38 +1,224 @@
 package registry
 
-import "sync"
+import (
+	"errors"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
 
 type ClientConn interface{}
 
+// Loader is implemented by connections that can report how many requests
+// they have in flight; pools prefer the least loaded member.
+type Loader interface {
+    InFlight() int
+}
+
+// Owner identifies who registered a sub-domain: the token, and the client's
+// session, which stays the same across its reconnects.
+type Owner struct {
+    Token   string
+    Session string
+}
+
+// Reasons a sub-domain can't be claimed.
+var (
+    ErrInUse    = errors.New("subdomain is in use by another client")
+    ErrPool     = errors.New("subdomain is served by a pool")
+    ErrNotPool  = errors.New("subdomain is served by a tunnel that isn't a pool")
+    ErrReserved = errors.New("subdomain is reserved for a reconnecting client")
+)
+
 type Registry struct {
     
-    mu sync.RWMutex
-    m  map[string]ClientConn
+    mu   sync.RWMutex
+    m    map[string]*entry
+    held map[string]hold // sub-domains kept for a disconnected owner
+}
+
+// entry is what serves a sub-domain: a single connection, or a pool of them
+// sharing the traffic.
+type entry struct {
+    members []ClientConn
+    pool    bool
+    owner   Owner // who claimed it; pools are shared
+    next    atomic.Uint32 // where the next pick starts, for round-robin
+}
+
+// pick returns the member to send a request to: the one with the fewest
+// requests in flight, taking turns among equals.
+func (e *entry) pick() ClientConn {
+    if len(e.members) == 1 {
+        return e.members[0]
+    }
+    start := int(e.next.Add(1))
+    best, bestLoad := ClientConn(nil), -1
+    for i := range e.members {
+        c := e.members[(start+i)%len(e.members)]
+        load := 0
+        if l, ok := c.(Loader); ok {
+            load = l.InFlight()
+        }
+        if bestLoad < 0 || load < bestLoad {
+            best, bestLoad = c, load
+        }
+    }
+    return best
+}
+
+// hold reserves a sub-domain for its owner until a deadline.
+type hold struct {
+    owner string
+    until time.Time
 }
 
 func New() *Registry {
     return &Registry{
-        m: make(map[string]ClientConn),
+        m:    make(map[string]*entry),
+        held: make(map[string]hold),
     }
 }
 
+// Register puts c on sub whoever holds it, without an owner. Tunnels are
+// registered with Claim or Join, which respect the sub-domain's owner.
 func (r *Registry) Register(sub string, c ClientConn) {
     r.mu.Lock()
     defer r.mu.Unlock()
-    r.m[sub] = c
+    r.m[sub] = &entry{members: []ClientConn{c}}
+    delete(r.held, sub)
+}
+
+// Check reports whether o may claim sub now, or join its pool: a live
+// sub-domain belongs to the session that claimed it, or to its token when
+// force is set.
+func (r *Registry) Check(sub string, o Owner, pool, force bool) error {
+    r.mu.RLock()
+    defer r.mu.RUnlock()
+    return r.check(sub, o, pool, force)
+}
+
+func (r *Registry) check(sub string, o Owner, pool, force bool) error {
+    if e, ok := r.m[sub]; ok {
+        switch {
+        case pool && !e.pool:
+            return ErrNotPool
+        case pool:
+            return nil
+        case e.pool:
+            return ErrPool
+        case o.Session != "" && e.owner.Session == o.Session:
+        case force && e.owner.Token == o.Token:
+        default:
+            return ErrInUse
+        }
+    }
+    if h, ok := r.held[sub]; ok && time.Now().Before(h.until) && h.owner != o.Token {
+        return ErrReserved
+    }
+    return nil
+}
+
+// Claim registers c for sub on behalf of o if Check allows it, returning the
+// connections it took sub from.
+func (r *Registry) Claim(sub string, c ClientConn, o Owner, force bool) ([]ClientConn, error) {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    if err := r.check(sub, o, false, force); err != nil {
+        return nil, err
+    }
+    var displaced []ClientConn
+    if e, ok := r.m[sub]; ok {
+        displaced = e.members
+    }
+    r.m[sub] = &entry{members: []ClientConn{c}, owner: o}
+    delete(r.held, sub)
+    return displaced, nil
+}
+
+// Join adds c to the pool serving sub, starting one if sub is free. It fails
+// if sub is served by a connection that didn't join as a pool.
+func (r *Registry) Join(sub string, c ClientConn) bool {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    e, ok := r.m[sub]
+    if !ok {
+        r.m[sub] = &entry{members: []ClientConn{c}, pool: true}
+        delete(r.held, sub)
+        return true
+    }
+    if !e.pool {
+        return false
+    }
+    e.members = append(e.members, c)
+    return true
+}
+
+// Pooled reports whether sub is served by a pool, and by how many connections.
+func (r *Registry) Pooled(sub string) (pool bool, n int) {
+    r.mu.RLock()
+    defer r.mu.RUnlock()
+    if e, ok := r.m[sub]; ok {
+        return e.pool, len(e.members)
+    }
+    return false, 0
 }
 
+// Lookup returns the connection serving sub, spreading lookups across a
+// pool's members. While sub is reserved for a reconnecting owner it returns a
+// nil connection and true.
 func (r *Registry) Lookup(sub string) (ClientConn, bool) {
     r.mu.RLock()
     defer r.mu.RUnlock()
-    c, ok := r.m[sub]
-    return c, ok
+    if e, ok := r.m[sub]; ok {
+        return e.pick(), true
+    }
+    h, ok := r.held[sub]
+    return nil, ok && time.Now().Before(h.until)
+}
+
+// Reserve takes sub away from c, which has disconnected, and holds it for
+// owner until grace has passed so the same client can reconnect to it. It does
+// nothing if sub has meanwhile been registered to another connection. A pool
+// member's share of the traffic goes to the rest of the pool; only once the
+// last member has gone is sub held.
+func (r *Registry) Reserve(sub string, c ClientConn, owner string, grace time.Duration) {
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    e, ok := r.m[sub]
+    if !ok {
+        return
+    }
+    i := slices.Index(e.members, c)
+    if i < 0 {
+        return
+    }
+    if len(e.members) > 1 {
+        e.members = slices.Delete(e.members, i, i+1)
+        return
+    }
+    delete(r.m, sub)
+    if grace <= 0 {
+        return
+    }
+    until := time.Now().Add(grace)
+    r.held[sub] = hold{owner: owner, until: until}
+    time.AfterFunc(grace, func() {
+        r.mu.Lock()
+        defer r.mu.Unlock()
+        if h, ok := r.held[sub]; ok && h.until.Equal(until) {
+            delete(r.held, sub)
+        }
+    })
 }
 
+// Remove forgets sub along with any hold on it.
 func (r *Registry) Remove(sub string) {
     r.mu.Lock()
     defer r.mu.Unlock()
     delete(r.m, sub)
+    delete(r.held, sub)
 }
 
 // Subdomains returns currently registered sub-domain names.
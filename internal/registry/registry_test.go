@@ -3,9 +3,11 @@ package registry
 import (
 	"sync"
 	"testing"
+	"time"
 )
 
-type dummyConn struct{}
+// dummyConn has a field so that distinct instances compare unequal.
+type dummyConn struct{ name string }
 
 func TestRegisterLookupRemove(t *testing.T) {
     reg := New()
@@ -23,6 +25,41 @@ func TestRegisterLookupRemove(t *testing.T) {
     }
 }
 
+func TestReserveHoldsForOwner(t *testing.T) {
+    reg := New()
+
+    old := &dummyConn{name: "old"}
+    reg.Register("foo", old)
+    reg.Reserve("foo", old, "tok", 50*time.Millisecond)
+
+    if c, ok := reg.Lookup("foo"); !ok || c != nil {
+        t.Fatalf("expected a reservation, got %v ok=%v", c, ok)
+    }
+    if err := reg.Check("foo", Owner{Token: "other"}, false, false); err != ErrReserved {
+        t.Fatalf("expected foo held for tok, got %v", err)
+    }
+    if err := reg.Check("foo", Owner{Token: "tok"}, false, false); err != nil {
+        t.Fatalf("expected tok to reclaim foo, got %v", err)
+    }
+
+    // a stale connection can't reserve a sub-domain that was taken over
+    fresh := &dummyConn{name: "fresh"}
+    reg.Register("foo", fresh)
+    reg.Reserve("foo", old, "tok", time.Minute)
+    if c, _ := reg.Lookup("foo"); c != fresh {
+        t.Fatalf("expected the new connection to keep foo, got %v", c)
+    }
+
+    reg.Reserve("foo", fresh, "tok", 50*time.Millisecond)
+    time.Sleep(100 * time.Millisecond)
+    if _, ok := reg.Lookup("foo"); ok {
+        t.Fatalf("expected the reservation to expire")
+    }
+    if err := reg.Check("foo", Owner{Token: "other"}, false, false); err != nil {
+        t.Fatalf("expected no holder after expiry, got %v", err)
+    }
+}
+
 func TestConcurrencySafety(t *testing.T) {
     reg := New()
     const n = 1000
@@ -48,3 +85,109 @@ func TestConcurrencySafety(t *testing.T) {
 
     wg.Wait()
 }
+
+func TestClaimProtectsLiveSubdomain(t *testing.T) {
+    reg := New()
+
+    first, second := &dummyConn{name: "first"}, &dummyConn{name: "second"}
+    alice := Owner{Token: "alice", Session: "s1"}
+    if _, err := reg.Claim("foo", first, alice, false); err != nil {
+        t.Fatalf("claim: %v", err)
+    }
+
+    // neither another token nor another session of the same one takes it over
+    if _, err := reg.Claim("foo", second, Owner{Token: "bob", Session: "s2"}, true); err != ErrInUse {
+        t.Fatalf("expected ErrInUse for another token, got %v", err)
+    }
+    if _, err := reg.Claim("foo", second, Owner{Token: "alice", Session: "s2"}, false); err != ErrInUse {
+        t.Fatalf("expected ErrInUse without force, got %v", err)
+    }
+    if c, _ := reg.Lookup("foo"); c != first {
+        t.Fatalf("expected the first connection to keep foo, got %v", c)
+    }
+
+    // the same session reconnecting, or the same token forcing, does
+    displaced, err := reg.Claim("foo", second, alice, false)
+    if err != nil || len(displaced) != 1 || displaced[0] != first {
+        t.Fatalf("expected the session to reclaim foo, got %v, %v", displaced, err)
+    }
+    displaced, err = reg.Claim("foo", first, Owner{Token: "alice", Session: "s3"}, true)
+    if err != nil || len(displaced) != 1 || displaced[0] != second {
+        t.Fatalf("expected force to take foo over, got %v, %v", displaced, err)
+    }
+
+    // pools and single tunnels don't mix
+    reg.Join("bar", first)
+    if err := reg.Check("bar", alice, false, true); err != ErrPool {
+        t.Fatalf("expected ErrPool, got %v", err)
+    }
+    if err := reg.Check("foo", alice, true, false); err != ErrNotPool {
+        t.Fatalf("expected ErrNotPool, got %v", err)
+    }
+
+    // a hold keeps other tokens out
+    reg.Reserve("foo", first, "alice", time.Minute)
+    if err := reg.Check("foo", Owner{Token: "bob"}, false, false); err != ErrReserved {
+        t.Fatalf("expected ErrReserved, got %v", err)
+    }
+    if err := reg.Check("foo", Owner{Token: "alice"}, false, false); err != nil {
+        t.Fatalf("expected the owner to reclaim a held subdomain, got %v", err)
+    }
+}
+
+// loadedConn reports a fixed number of requests in flight.
+type loadedConn struct {
+    name string
+    load int
+}
+
+func (c *loadedConn) InFlight() int { return c.load }
+
+func TestPoolSpreadsAndFailsOver(t *testing.T) {
+    reg := New()
+
+    a, b := &dummyConn{name: "a"}, &dummyConn{name: "b"}
+    if !reg.Join("foo", a) || !reg.Join("foo", b) {
+        t.Fatalf("expected both connections to join the pool")
+    }
+    seen := map[ClientConn]int{}
+    for i := 0; i < 10; i++ {
+        c, _ := reg.Lookup("foo")
+        seen[c]++
+    }
+    if seen[a] != 5 || seen[b] != 5 {
+        t.Fatalf("expected round-robin, got a=%d b=%d", seen[a], seen[b])
+    }
+
+    // a member leaving doesn't hold the sub-domain while others remain
+    reg.Reserve("foo", a, "tok", time.Minute)
+    for i := 0; i < 3; i++ {
+        if c, _ := reg.Lookup("foo"); c != b {
+            t.Fatalf("expected the remaining member, got %v", c)
+        }
+    }
+    // only the last one leaving does
+    reg.Reserve("foo", b, "tok", time.Minute)
+    if c, ok := reg.Lookup("foo"); !ok || c != nil {
+        t.Fatalf("expected the last member leaving to hold foo, got %v ok=%v", c, ok)
+    }
+
+    // a single tunnel can't be joined
+    reg.Register("bar", a)
+    if reg.Join("bar", b) {
+        t.Fatalf("expected joining a non-pool tunnel to fail")
+    }
+}
+
+func TestPoolPrefersLeastLoaded(t *testing.T) {
+    reg := New()
+
+    busy, idle := &loadedConn{name: "busy", load: 3}, &loadedConn{name: "idle", load: 1}
+    reg.Join("foo", busy)
+    reg.Join("foo", idle)
+    for i := 0; i < 4; i++ {
+        if c, _ := reg.Lookup("foo"); c != idle {
+            t.Fatalf("expected the least loaded member, got %v", c)
+        }
+    }
+}
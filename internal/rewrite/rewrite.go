@@ -0,0 +1,157 @@
+// Package rewrite applies header rewriting rules to proxied requests and
+// responses.
+//
+// A rule is written "set Name: value", "add Name: value", "remove Name" or
+// "rename Old: New". Values may refer to Vars as {name}, e.g.
+// "set X-Real-IP: {visitor_ip}". Rules naming Host act on the request's host,
+// so they only make sense on requests.
+package rewrite
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Operations a Rule can perform.
+const (
+    OpSet    = "set"
+    OpAdd    = "add"
+    OpRemove = "remove"
+    OpRename = "rename"
+)
+
+// Rule is one header operation.
+type Rule struct {
+    Op    string
+    Name  string
+    Value string // set and add: a template; rename: the new name
+}
+
+// Parse reads a rule in the form described in the package comment.
+func Parse(s string) (Rule, error) {
+    op, rest, _ := strings.Cut(strings.TrimSpace(s), " ")
+    name, value, hasValue := strings.Cut(rest, ":")
+    r := Rule{Op: strings.ToLower(op), Name: http.CanonicalHeaderKey(strings.TrimSpace(name)), Value: strings.TrimSpace(value)}
+    if r.Name == "" {
+        return Rule{}, fmt.Errorf("rule %q: missing header name", s)
+    }
+    switch r.Op {
+    case OpSet, OpAdd:
+        if !hasValue {
+            return Rule{}, fmt.Errorf("rule %q: want %q", s, r.Op+" Name: value")
+        }
+    case OpRename:
+        if r.Value == "" {
+            return Rule{}, fmt.Errorf("rule %q: want %q", s, "rename Old: New")
+        }
+        r.Value = http.CanonicalHeaderKey(r.Value)
+    case OpRemove:
+        if hasValue {
+            return Rule{}, fmt.Errorf("rule %q: want %q", s, "remove Name")
+        }
+    default:
+        return Rule{}, fmt.Errorf("rule %q: unknown operation %q (want set, add, remove or rename)", s, op)
+    }
+    return r, nil
+}
+
+// TouchesHost reports whether r reads or writes the host rather than a header.
+func (r Rule) TouchesHost() bool {
+    return r.Name == "Host" || (r.Op == OpRename && r.Value == "Host")
+}
+
+func (r Rule) String() string {
+    if r.Op == OpRemove {
+        return r.Op + " " + r.Name
+    }
+    return r.Op + " " + r.Name + ": " + r.Value
+}
+
+// Rules are the rewrites for each direction.
+type Rules struct {
+    Request  []Rule
+    Response []Rule
+}
+
+// ParseAll parses request and response rule lists.
+func ParseAll(request, response []string) (Rules, error) {
+    var rs Rules
+    for _, s := range request {
+        r, err := Parse(s)
+        if err != nil {
+            return Rules{}, err
+        }
+        rs.Request = append(rs.Request, r)
+    }
+    for _, s := range response {
+        r, err := Parse(s)
+        if err != nil {
+            return Rules{}, err
+        }
+        if r.TouchesHost() {
+            return Rules{}, fmt.Errorf("rule %q: responses have no Host", s)
+        }
+        rs.Response = append(rs.Response, r)
+    }
+    return rs, nil
+}
+
+// Vars are the values templates can use, such as "visitor_ip" or "tunnel".
+type Vars map[string]string
+
+// expand fills {name} references to vars into v; unknown names are kept.
+func (vars Vars) expand(v string) string {
+    if !strings.Contains(v, "{") {
+        return v
+    }
+    pairs := make([]string, 0, 2*len(vars))
+    for k, val := range vars {
+        pairs = append(pairs, "{"+k+"}", val)
+    }
+    return strings.NewReplacer(pairs...).Replace(v)
+}
+
+// Apply runs rules over h in order. Rules naming Host act on *host instead;
+// they are skipped if host is nil.
+func Apply(rules []Rule, h http.Header, host *string, vars Vars) {
+    for _, r := range rules {
+        if r.TouchesHost() {
+            applyHost(r, h, host, vars)
+            continue
+        }
+        switch r.Op {
+        case OpSet:
+            h.Set(r.Name, vars.expand(r.Value))
+        case OpAdd:
+            h.Add(r.Name, vars.expand(r.Value))
+        case OpRemove:
+            h.Del(r.Name)
+        case OpRename:
+            if values := h.Values(r.Name); len(values) > 0 {
+                h.Del(r.Name)
+                h[r.Value] = append(h[r.Value], values...)
+            }
+        }
+    }
+}
+
+// applyHost runs a rule that reads or writes the host, which travels outside
+// the header map.
+func applyHost(r Rule, h http.Header, host *string, vars Vars) {
+    if host == nil {
+        return
+    }
+    switch {
+    case r.Op == OpSet || r.Op == OpAdd:
+        *host = vars.expand(r.Value)
+    case r.Op == OpRename && r.Name == "Host":
+        // Keep the original host visible under another name.
+        h.Set(r.Value, *host)
+    case r.Op == OpRename:
+        if v := h.Get(r.Name); v != "" {
+            *host = v
+            h.Del(r.Name)
+        }
+    }
+}
@@ -0,0 +1,51 @@
+package rewrite
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestApply(t *testing.T) {
+    rules, err := ParseAll([]string{
+        "set Host: app.local",
+        "remove Origin",
+        "rename X-Old: X-New",
+        "add X-Forwarded-For: {visitor_ip}",
+        "set X-Tunnel: {tunnel} via {unknown}",
+    }, nil)
+    if err != nil { t.Fatalf("parse: %v", err) }
+
+    h := http.Header{"Origin": {"https://evil.test"}, "X-Old": {"a", "b"}, "X-Forwarded-For": {"10.0.0.1"}}
+    host := "shop.example.com"
+    Apply(rules.Request, h, &host, Vars{"visitor_ip": "203.0.113.7", "tunnel": "shop"})
+
+    if host != "app.local" {
+        t.Errorf("host = %q", host)
+    }
+    if h.Get("Origin") != "" {
+        t.Errorf("Origin not removed")
+    }
+    if got := h.Values("X-New"); len(got) != 2 || got[0] != "a" || h.Get("X-Old") != "" {
+        t.Errorf("rename gave X-New=%v X-Old=%q", got, h.Get("X-Old"))
+    }
+    if got := h.Values("X-Forwarded-For"); len(got) != 2 || got[1] != "203.0.113.7" {
+        t.Errorf("X-Forwarded-For = %v", got)
+    }
+    if got := h.Get("X-Tunnel"); got != "shop via {unknown}" {
+        t.Errorf("X-Tunnel = %q", got)
+    }
+}
+
+func TestParseErrors(t *testing.T) {
+    for _, s := range []string{"set X-A", "remove X-A: b", "rename X-A", "replace X-A: b", "set : b"} {
+        if _, err := Parse(s); err == nil {
+            t.Errorf("expected %q to be rejected", s)
+        }
+    }
+    if _, err := ParseAll(nil, []string{"set Host: a"}); err == nil {
+        t.Errorf("expected a response rule naming Host to be rejected")
+    }
+    if r, err := Parse("set x-env:  dev "); err != nil || r.Name != "X-Env" || r.Value != "dev" {
+        t.Errorf("parse gave %+v, %v", r, err)
+    }
+}
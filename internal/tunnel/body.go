@@ -0,0 +1,39 @@
+package tunnel
+
+import (
+	"io"
+	"net/http"
+)
+
+// ChunkSize is the largest body payload carried by a single Data message.
+const ChunkSize = 32 * 1024
+
+// SendBody streams r as Data messages for stream id, ending with an End chunk
+// (or a Reset if r fails part way). trailer, if non-nil, is read once r is
+// exhausted — net/http fills trailers in only then — and sent on the End chunk.
+// Memory use is bounded by ChunkSize regardless of the body length.
+func SendBody(id uint32, r io.Reader, trailer http.Header, send func(Message) error) error {
+    buf := make([]byte, ChunkSize)
+    for {
+        n, err := r.Read(buf)
+        if n > 0 {
+            chunk := make([]byte, n)
+            copy(chunk, buf[:n])
+            if werr := send(Message{Type: TypeData, Data: &Data{ID: id, Body: chunk}}); werr != nil {
+                return werr
+            }
+        }
+        if err == io.EOF {
+            end := &Data{ID: id, End: true}
+            if len(trailer) > 0 {
+                end.Trailers = HeaderFrom(trailer, nil)
+            }
+            return send(Message{Type: TypeData, Data: end})
+        }
+        if err != nil {
+            // Abort the stream so the peer doesn't mistake a partial body for a complete one.
+            send(Message{Type: TypeReset, Reset: &Reset{ID: id, Reason: err.Error()}})
+            return err
+        }
+    }
+}
@@ -0,0 +1,174 @@
+package tunnel
+
+import (
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Protocol versions negotiated at /connect.
+const (
+    // ProtocolLegacy is the JSON spoken before versions were negotiated: a
+    // whole request or response per message, HTTP only. See legacyCodec.
+    ProtocolLegacy = 0
+    ProtocolJSON   = 1 // one JSON text message per Message
+    ProtocolBinary = 2 // one binary Frame per Message
+    // ProtocolFlowControl is ProtocolBinary plus per-stream and connection
+    // credit windows for Data bodies, granted with Window messages.
+    ProtocolFlowControl = 3
+    // ProtocolDrain adds the Drain message, which older peers can't decode.
+    ProtocolDrain = 4
+
+    // ProtocolVersion is the newest version this build speaks.
+    ProtocolVersion = ProtocolDrain
+)
+
+// ProtocolHeader carries the protocol version: the client offers the newest it
+// supports and the server echoes the one it picked in the upgrade response.
+// Peers that don't send it speak ProtocolLegacy.
+const ProtocolHeader = "X-Portkey-Protocol"
+
+// NegotiateVersion picks the version to use given the peer's header value.
+func NegotiateVersion(offered string) int {
+    v, err := strconv.Atoi(offered)
+    if err != nil || v < ProtocolJSON {
+        return ProtocolLegacy
+    }
+    if v > ProtocolVersion {
+        return ProtocolVersion
+    }
+    return v
+}
+
+// Conn reads and writes Messages on a WebSocket using the negotiated protocol
+// version. It is the wire codec underneath a Session: writes must come from a
+// single goroutine, as must reads.
+type Conn struct {
+    ws      *websocket.Conn
+    version int
+    legacy  *legacyCodec // only for ProtocolLegacy
+
+    // liveness is how long reads may go quiet before the peer is considered
+    // dead; zero until Heartbeat is called.
+    liveness  time.Duration
+    closed    chan struct{}
+    closeOnce sync.Once
+}
+
+// NewConn wraps ws for the given protocol version.
+func NewConn(ws *websocket.Conn, version int) *Conn {
+    c := &Conn{ws: ws, version: version, closed: make(chan struct{})}
+    if version == ProtocolLegacy {
+        c.legacy = newLegacyCodec()
+    }
+    return c
+}
+
+// Version reports the negotiated protocol version.
+func (c *Conn) Version() int {
+    return c.version
+}
+
+// WriteMessage sends m, encoded for the connection's protocol version.
+func (c *Conn) WriteMessage(m Message) error {
+    if c.legacy != nil {
+        if lm := c.legacy.encode(m); lm != nil {
+            return c.ws.WriteJSON(lm)
+        }
+        return nil
+    }
+    if c.version == ProtocolJSON {
+        return c.ws.WriteJSON(m)
+    }
+    f, err := EncodeMessage(m)
+    if err != nil {
+        return err
+    }
+    return c.ws.WriteMessage(websocket.BinaryMessage, f.Encode())
+}
+
+// ReadMessage blocks until the next Message arrives.
+func (c *Conn) ReadMessage() (Message, error) {
+    var m Message
+    if c.legacy != nil {
+        if m, ok := c.legacy.next(); ok {
+            return m, nil
+        }
+        var lm legacyMessage
+        if err := c.ws.ReadJSON(&lm); err != nil {
+            return m, err
+        }
+        c.alive()
+        c.legacy.decode(lm)
+        m, _ = c.legacy.next()
+        return m, nil
+    }
+    if c.version == ProtocolJSON {
+        err := c.ws.ReadJSON(&m)
+        c.alive()
+        return m, err
+    }
+    _, b, err := c.ws.ReadMessage()
+    if err != nil {
+        return m, err
+    }
+    c.alive()
+    f, err := DecodeFrame(b)
+    if err != nil {
+        return m, err
+    }
+    return DecodeMessage(f)
+}
+
+// Heartbeat pings the peer every interval and fails reads once nothing, not
+// even a pong, has arrived for timeout, so a half-open connection is noticed.
+// Call it before the read loop starts; the pings stop when c is closed.
+// An interval or timeout <= 0 disables heartbeats: no pings, no deadline.
+func (c *Conn) Heartbeat(interval, timeout time.Duration) {
+    if interval <= 0 || timeout <= 0 {
+        return
+    }
+    c.liveness = timeout
+    c.alive()
+    c.ws.SetPongHandler(func(string) error {
+        c.alive()
+        return nil
+    })
+    c.ws.SetPingHandler(func(data string) error {
+        c.alive()
+        err := c.ws.WriteControl(websocket.PongMessage, []byte(data), time.Now().Add(timeout))
+        if err == websocket.ErrCloseSent {
+            return nil
+        }
+        return err
+    })
+    go func() {
+        ticker := time.NewTicker(interval)
+        defer ticker.Stop()
+        for {
+            select {
+            case <-ticker.C:
+                if err := c.ws.WriteControl(websocket.PingMessage, nil, time.Now().Add(timeout)); err != nil {
+                    return
+                }
+            case <-c.closed:
+                return
+            }
+        }
+    }()
+}
+
+// alive pushes the read deadline back after hearing from the peer.
+func (c *Conn) alive() {
+    if c.liveness > 0 {
+        c.ws.SetReadDeadline(time.Now().Add(c.liveness))
+    }
+}
+
+// Close closes the underlying WebSocket.
+func (c *Conn) Close() error {
+    c.closeOnce.Do(func() { close(c.closed) })
+    return c.ws.Close()
+}
@@ -0,0 +1,219 @@
+package tunnel
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// echoServer negotiates like /connect and echoes every message back.
+func echoServer(t *testing.T) *httptest.Server {
+    return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        v := NegotiateVersion(r.Header.Get(ProtocolHeader))
+        ws, err := (&websocket.Upgrader{}).Upgrade(w, r, http.Header{ProtocolHeader: {strconv.Itoa(v)}})
+        if err != nil {
+            t.Errorf("upgrade: %v", err)
+            return
+        }
+        c := NewConn(ws, v)
+        defer c.Close()
+        for {
+            m, err := c.ReadMessage()
+            if err != nil {
+                return
+            }
+            c.WriteMessage(m)
+        }
+    }))
+}
+
+func TestConnNegotiation(t *testing.T) {
+    srv := echoServer(t)
+    defer srv.Close()
+    url := "ws" + strings.TrimPrefix(srv.URL, "http")
+
+    for _, offer := range []string{"1", "2", "3"} {
+        ws, resp, err := websocket.DefaultDialer.Dial(url, http.Header{ProtocolHeader: {offer}})
+        if err != nil {
+            t.Fatalf("dial: %v", err)
+        }
+        c := NewConn(ws, NegotiateVersion(resp.Header.Get(ProtocolHeader)))
+        if want := NegotiateVersion(offer); c.Version() != want {
+            t.Fatalf("offer %q: negotiated v%d, want v%d", offer, c.Version(), want)
+        }
+
+        m := Message{Type: TypeResponse, Response: &Response{ID: 42, Status: 200, Headers: Header{{"A", "b"}, {"A", "c"}}}}
+        if err := c.WriteMessage(m); err != nil {
+            t.Fatalf("write: %v", err)
+        }
+        got, err := c.ReadMessage()
+        if err != nil {
+            t.Fatalf("read: %v", err)
+        }
+        if !reflect.DeepEqual(got, m) {
+            t.Fatalf("v%d echo mismatch: %+v", c.Version(), got)
+        }
+        c.Close()
+    }
+}
+
+func TestHeartbeat(t *testing.T) {
+    live, dead := make(chan *Conn, 1), make(chan *Conn, 1)
+    srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        ws, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+        if err != nil {
+            t.Errorf("upgrade: %v", err)
+            return
+        }
+        c := NewConn(ws, ProtocolJSON)
+        if r.URL.Path == "/dead" {
+            dead <- c // never read, so pings go unanswered
+            return
+        }
+        live <- c
+        for {
+            if _, err := c.ReadMessage(); err != nil {
+                return
+            }
+        }
+    }))
+    defer srv.Close()
+    url := "ws" + strings.TrimPrefix(srv.URL, "http")
+
+    for _, path := range []string{"/live", "/dead"} {
+        ws, _, err := websocket.DefaultDialer.Dial(url+path, nil)
+        if err != nil {
+            t.Fatalf("dial: %v", err)
+        }
+        c := NewConn(ws, ProtocolJSON)
+        defer c.Close()
+        c.Heartbeat(20*time.Millisecond, 200*time.Millisecond)
+        failed := make(chan error, 1)
+        go func() {
+            _, err := c.ReadMessage()
+            failed <- err
+        }()
+        select {
+        case err := <-failed:
+            if path == "/live" {
+                t.Fatalf("live peer dropped: %v", err)
+            }
+        case <-time.After(time.Second):
+            if path == "/dead" {
+                t.Fatalf("silent peer not detected")
+            }
+        }
+    }
+    (<-live).Close()
+    (<-dead).Close()
+}
+
+func TestHeartbeatDisabled(t *testing.T) {
+    srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        ws, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+        if err != nil {
+            t.Errorf("upgrade: %v", err)
+            return
+        }
+        defer ws.Close()
+        ws.ReadMessage() // sends nothing until the client goes away
+    }))
+    defer srv.Close()
+
+    ws, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+    if err != nil {
+        t.Fatalf("dial: %v", err)
+    }
+    c := NewConn(ws, ProtocolJSON)
+    defer c.Close()
+    c.Heartbeat(0, 50*time.Millisecond)
+    failed := make(chan error, 1)
+    go func() {
+        _, err := c.ReadMessage()
+        failed <- err
+    }()
+    select {
+    case err := <-failed:
+        t.Fatalf("read failed with heartbeats disabled: %v", err)
+    case <-time.After(300 * time.Millisecond):
+    }
+}
+
+func TestLegacyConn(t *testing.T) {
+    conns := make(chan *Conn, 1)
+    srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        v := NegotiateVersion(r.Header.Get(ProtocolHeader))
+        ws, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+        if err != nil {
+            t.Errorf("upgrade: %v", err)
+            return
+        }
+        conns <- NewConn(ws, v)
+    }))
+    defer srv.Close()
+
+    // an old client: no protocol header, bare JSON requests and responses
+    old, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+    if err != nil {
+        t.Fatalf("dial: %v", err)
+    }
+    defer old.Close()
+    c := <-conns
+    defer c.Close()
+    if c.Version() != ProtocolLegacy {
+        t.Fatalf("negotiated v%d without a header, want legacy", c.Version())
+    }
+
+    // the body is collected and sent with its request
+    c.WriteMessage(Message{Type: TypeRequest, Request: &Request{ID: 7, Method: "POST", Path: "/hook?x=1", Headers: Header{{"Accept", "a"}, {"Accept", "b"}}}})
+    c.WriteMessage(Message{Type: TypeData, Data: &Data{ID: 7, Body: []byte("hello, ")}})
+    c.WriteMessage(Message{Type: TypeBound, Bound: &Binding{Kind: KindHTTP}})
+    c.WriteMessage(Message{Type: TypeData, Data: &Data{ID: 7, Body: []byte("world"), End: true}})
+    var req legacyMessage
+    if err := old.ReadJSON(&req); err != nil {
+        t.Fatalf("old client read: %v", err)
+    }
+    want := legacyMessage{ID: "7", Method: "POST", Path: "/hook?x=1", Headers: map[string]string{"Accept": "a, b"}, Body: []byte("hello, world")}
+    if !reflect.DeepEqual(req, want) {
+        t.Fatalf("old client got %+v, want %+v", req, want)
+    }
+
+    // and its answer comes back as a Response and the body's end
+    old.WriteJSON(legacyMessage{ID: "7", Status: 201, Headers: map[string]string{"X-B": "2", "X-A": "1"}, Body: []byte("ok")})
+    got := []Message{}
+    for len(got) < 2 {
+        m, err := c.ReadMessage()
+        if err != nil {
+            t.Fatalf("read: %v", err)
+        }
+        got = append(got, m)
+    }
+    wantMsgs := []Message{
+        {Type: TypeResponse, Response: &Response{ID: 7, Status: 201, Headers: Header{{"X-A", "1"}, {"X-B", "2"}}}},
+        {Type: TypeData, Data: &Data{ID: 7, Body: []byte("ok"), End: true}},
+    }
+    if !reflect.DeepEqual(got, wantMsgs) {
+        t.Fatalf("read %+v, want %+v", got, wantMsgs)
+    }
+
+    // IDs the old peer made up itself are kept for the answer
+    old.WriteJSON(legacyMessage{ID: "6f1c-uuid", Method: "GET", Path: "/"})
+    m, err := c.ReadMessage()
+    if err != nil || m.Type != TypeRequest {
+        t.Fatalf("read request: %+v, %v", m, err)
+    }
+    id := m.Request.ID
+    c.ReadMessage()
+    c.WriteMessage(Message{Type: TypeResponse, Response: &Response{ID: id, Status: 204}})
+    c.WriteMessage(Message{Type: TypeData, Data: &Data{ID: id, End: true}})
+    var resp legacyMessage
+    if err := old.ReadJSON(&resp); err != nil || resp.ID != "6f1c-uuid" || resp.Status != 204 {
+        t.Fatalf("old peer got %+v, %v", resp, err)
+    }
+}
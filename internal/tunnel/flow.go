@@ -0,0 +1,265 @@
+package tunnel
+
+import (
+	"io"
+	"sync"
+)
+
+// Flow-control windows, in bytes, used from ProtocolFlowControl on. A stream
+// may have StreamWindow bytes of body unconsumed by the peer, and all streams
+// together ConnWindow, so one slow reader only stalls its own stream.
+const (
+    StreamWindow = 256 * 1024
+    ConnWindow   = 16 * StreamWindow
+)
+
+// sendWindows tracks the credit this side has left to send Data bodies.
+type sendWindows struct {
+    mu      sync.Mutex
+    cond    sync.Cond
+    conn    int
+    streams map[uint32]int // open streams we have sent on
+    err     error          // set once the connection is gone
+}
+
+func newSendWindows() *sendWindows {
+    w := &sendWindows{conn: ConnWindow, streams: make(map[uint32]int)}
+    w.cond.L = &w.mu
+    return w
+}
+
+// acquire blocks until n bytes may be sent on stream id, then takes them.
+func (w *sendWindows) acquire(id uint32, n int) error {
+    w.mu.Lock()
+    defer w.mu.Unlock()
+    if _, ok := w.streams[id]; !ok {
+        w.streams[id] = StreamWindow
+    }
+    for w.err == nil && (w.streams[id] < n || w.conn < n) {
+        w.cond.Wait()
+    }
+    if w.err != nil {
+        return w.err
+    }
+    w.streams[id] -= n
+    w.conn -= n
+    return nil
+}
+
+// grant adds credit from a Window message. Grants for streams that have
+// already ended are ignored.
+func (w *sendWindows) grant(id uint32, n int) {
+    w.mu.Lock()
+    defer w.mu.Unlock()
+    if id == 0 {
+        w.conn += n
+    } else if _, ok := w.streams[id]; ok {
+        w.streams[id] += n
+    } else {
+        return
+    }
+    w.cond.Broadcast()
+}
+
+// forget drops a stream once this side has finished sending on it.
+func (w *sendWindows) forget(id uint32) {
+    w.mu.Lock()
+    delete(w.streams, id)
+    w.mu.Unlock()
+}
+
+// close fails current and future acquires with err.
+func (w *sendWindows) close(err error) {
+    w.mu.Lock()
+    if w.err == nil {
+        w.err = err
+    }
+    w.mu.Unlock()
+    w.cond.Broadcast()
+}
+
+// grantStream gives the peer n more bytes of credit on stream id.
+func (s *Session) grantStream(id uint32, n int) {
+    if !s.flowControlled() || n == 0 {
+        return
+    }
+    s.WriteMessage(Message{Type: TypeWindow, Window: &Window{ID: id, Increment: uint32(n)}})
+}
+
+// grantConn returns connection credit for n consumed bytes, batched so small
+// reads don't each cost a message.
+func (s *Session) grantConn(n int) {
+    if !s.flowControlled() || n == 0 {
+        return
+    }
+    s.ackMu.Lock()
+    s.unacked += n
+    grant := 0
+    if s.unacked >= ConnWindow/4 {
+        grant, s.unacked = s.unacked, 0
+    }
+    s.ackMu.Unlock()
+    if grant > 0 {
+        s.WriteMessage(Message{Type: TypeWindow, Window: &Window{Increment: uint32(grant)}})
+    }
+}
+
+// Discard returns the credit for n bytes of body that arrived on a stream
+// nobody is reading any more, so the sender isn't left waiting for it.
+func (s *Session) Discard(id uint32, n int) {
+    s.grantStream(id, n)
+    s.grantConn(n)
+}
+
+// Pipe creates the receiving end of stream id's body. Unlike io.Pipe, writes
+// from the read loop never block on a flow-controlled connection: the sender
+// stays within the window, and credit is granted back as the reader consumes
+// the data. With older peers writes block once StreamWindow bytes are
+// buffered, as the read loop has no other way to push back.
+func (s *Session) Pipe(id uint32) (*PipeReader, *PipeWriter) {
+    return newPipe(s, id)
+}
+
+// creditor is told how much of a pipe's data has been consumed.
+type creditor interface {
+    flowControlled() bool
+    grantStream(id uint32, n int)
+    grantConn(n int)
+}
+
+func newPipe(c creditor, id uint32) (*PipeReader, *PipeWriter) {
+    p := &pipe{s: c, id: id}
+    p.cond.L = &p.mu
+    return &PipeReader{p}, &PipeWriter{p}
+}
+
+type pipe struct {
+    s  creditor
+    id uint32
+
+    mu      sync.Mutex
+    cond    sync.Cond
+    buf     [][]byte
+    size    int
+    werr    error // io.EOF or the reason the writer gave up
+    rerr    error // set once the reader gives up
+    unacked int   // stream credit consumed but not yet granted back
+}
+
+// PipeReader is the consuming end of a Pipe.
+type PipeReader struct{ p *pipe }
+
+// PipeWriter is the read loop's end of a Pipe.
+type PipeWriter struct{ p *pipe }
+
+// Read reads buffered body data, blocking until some is available or the
+// writer closes.
+func (r *PipeReader) Read(b []byte) (int, error) {
+    p := r.p
+    p.mu.Lock()
+    for len(p.buf) == 0 && p.werr == nil && p.rerr == nil {
+        p.cond.Wait()
+    }
+    if p.rerr != nil {
+        p.mu.Unlock()
+        return 0, io.ErrClosedPipe
+    }
+    if len(p.buf) == 0 {
+        err := p.werr
+        p.mu.Unlock()
+        return 0, err
+    }
+    n := copy(b, p.buf[0])
+    if p.buf[0] = p.buf[0][n:]; len(p.buf[0]) == 0 {
+        p.buf = p.buf[1:]
+    }
+    p.size -= n
+    // Grant stream credit back in batches; once the writer has ended the
+    // sender has forgotten the stream, so only the connection needs it.
+    grant := 0
+    if p.werr == nil {
+        if p.unacked += n; p.unacked >= StreamWindow/4 {
+            grant, p.unacked = p.unacked, 0
+        }
+    }
+    p.mu.Unlock()
+    p.cond.Broadcast()
+    p.s.grantStream(p.id, grant)
+    p.s.grantConn(n)
+    return n, nil
+}
+
+// CloseWithError stops reading. Buffered and later data is discarded and its
+// credit returned, so the sender can finish.
+func (r *PipeReader) CloseWithError(err error) error {
+    p := r.p
+    if err == nil {
+        err = io.ErrClosedPipe
+    }
+    p.mu.Lock()
+    if p.rerr != nil {
+        p.mu.Unlock()
+        return nil
+    }
+    p.rerr = err
+    dropped, grant := p.size, 0
+    if p.werr == nil {
+        grant = p.size + p.unacked
+    }
+    p.buf, p.size, p.unacked = nil, 0, 0
+    p.mu.Unlock()
+    p.cond.Broadcast()
+    p.s.grantStream(p.id, grant)
+    p.s.grantConn(dropped)
+    return nil
+}
+
+// Close is CloseWithError(nil).
+func (r *PipeReader) Close() error {
+    return r.CloseWithError(nil)
+}
+
+// Write buffers a body chunk for the reader. The chunk is kept, not copied.
+func (w *PipeWriter) Write(b []byte) (int, error) {
+    p := w.p
+    p.mu.Lock()
+    for !p.s.flowControlled() && p.size >= StreamWindow && p.rerr == nil && p.werr == nil {
+        p.cond.Wait()
+    }
+    if p.werr != nil {
+        p.mu.Unlock()
+        return 0, io.ErrClosedPipe
+    }
+    if p.rerr != nil {
+        err := p.rerr
+        p.mu.Unlock()
+        p.s.grantStream(p.id, len(b))
+        p.s.grantConn(len(b))
+        return 0, err
+    }
+    p.buf = append(p.buf, b)
+    p.size += len(b)
+    p.mu.Unlock()
+    p.cond.Broadcast()
+    return len(b), nil
+}
+
+// CloseWithError ends the body: readers get err once the buffer is drained.
+func (w *PipeWriter) CloseWithError(err error) error {
+    p := w.p
+    if err == nil {
+        err = io.EOF
+    }
+    p.mu.Lock()
+    if p.werr == nil {
+        p.werr = err
+    }
+    p.mu.Unlock()
+    p.cond.Broadcast()
+    return nil
+}
+
+// Close ends the body with io.EOF.
+func (w *PipeWriter) Close() error {
+    return w.CloseWithError(nil)
+}
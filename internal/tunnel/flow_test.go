@@ -0,0 +1,101 @@
+package tunnel
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// sessionPair returns two flow-controlled Sessions joined by a WebSocket.
+func sessionPair(t *testing.T) (*Session, *Session) {
+    accepted := make(chan *Session, 1)
+    srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        ws, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+        if err != nil {
+            t.Errorf("upgrade: %v", err)
+            return
+        }
+        accepted <- NewSession(ws, ProtocolFlowControl)
+    }))
+    t.Cleanup(srv.Close)
+    ws, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+    if err != nil {
+        t.Fatalf("dial: %v", err)
+    }
+    a, b := NewSession(ws, ProtocolFlowControl), <-accepted
+    t.Cleanup(func() { a.Close(); b.Close() })
+    return a, b
+}
+
+func TestFlowControlStallsOnlyTheSlowStream(t *testing.T) {
+    sender, receiver := sessionPair(t)
+
+    // receiver side: a read loop feeding one pipe per stream
+    pr1, pw1 := receiver.Pipe(1)
+    pr2, pw2 := receiver.Pipe(2)
+    go func() {
+        for {
+            m, err := receiver.ReadMessage()
+            if err != nil {
+                return
+            }
+            map[uint32]*PipeWriter{1: pw1, 2: pw2}[m.Data.ID].Write(m.Data.Body)
+        }
+    }()
+    // sender side: only Window messages arrive, ReadMessage applies them
+    go func() {
+        for {
+            if _, err := sender.ReadMessage(); err != nil {
+                return
+            }
+        }
+    }()
+
+    chunk := make([]byte, ChunkSize)
+    total := 2 * StreamWindow / ChunkSize
+    var sent atomic.Int32
+    done := make(chan error, 1)
+    go func() {
+        for i := 0; i < total; i++ {
+            if err := sender.WriteMessage(Message{Type: TypeData, Data: &Data{ID: 1, Body: chunk}}); err != nil {
+                done <- err
+                return
+            }
+            sent.Add(1)
+        }
+        done <- nil
+    }()
+
+    time.Sleep(200 * time.Millisecond)
+    if n := int(sent.Load()); n != StreamWindow/ChunkSize {
+        t.Fatalf("sent %d chunks on an unread stream, want %d", n, StreamWindow/ChunkSize)
+    }
+
+    // another stream on the same connection is unaffected
+    if err := sender.WriteMessage(Message{Type: TypeData, Data: &Data{ID: 2, Body: []byte("hi")}}); err != nil {
+        t.Fatalf("write stream 2: %v", err)
+    }
+    buf := make([]byte, 2)
+    if _, err := io.ReadFull(pr2, buf); err != nil || string(buf) != "hi" {
+        t.Fatalf("stream 2 read %q, %v", buf, err)
+    }
+
+    // reading the slow stream releases its sender
+    if _, err := io.CopyN(io.Discard, pr1, int64(total*ChunkSize)); err != nil {
+        t.Fatalf("read stream 1: %v", err)
+    }
+    select {
+    case err := <-done:
+        if err != nil {
+            t.Fatalf("sender: %v", err)
+        }
+    case <-time.After(2 * time.Second):
+        t.Fatalf("sender still blocked after the stream was drained")
+    }
+}
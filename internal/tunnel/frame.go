@@ -0,0 +1,349 @@
+package tunnel
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Frame types of the binary protocol.
+const (
+    FrameOpen     byte = 1  // request head (method, path, headers)
+    FrameHeaders  byte = 2  // response head (status, headers)
+    FrameData     byte = 3  // body chunk or WebSocket message
+    FrameEnd      byte = 4  // no more data on this stream; payload is the trailers
+    FrameReset    byte = 5  // abort the stream; payload is the reason
+    FrameBound    byte = 6  // connection-level: tunnel is live (stream ID 0)
+    FrameDatagram byte = 7  // UDP packet; stream ID is the session
+    FrameCancel   byte = 8  // the requester gave up; payload is the reason
+    FrameWindow   byte = 9  // flow-control credit; stream ID 0 is the connection
+    FrameBind     byte = 10 // connection-level: ask for a named tunnel (stream ID 0)
+    FrameDrain    byte = 11 // connection-level: the server is shutting down; payload is the reason
+)
+
+// Frame flags.
+const (
+    FlagEnd       byte = 1 << 0 // Data: last chunk of the body
+    FlagUpgrade   byte = 1 << 1 // Open: WebSocket upgrade rather than a plain request
+    FlagWebSocket byte = 1 << 2 // Data: WebSocket message, first payload byte is the opcode
+    FlagRaw       byte = 1 << 3 // Open: raw TCP connection rather than an HTTP request
+    FlagTunnel    byte = 1 << 4 // Open, Datagram: payload carries the tunnel name
+)
+
+// FrameHeaderSize is the fixed size of the header preceding every payload:
+// version, type, flags, reserved, stream ID (uint32), payload length (uint32).
+const FrameHeaderSize = 12
+
+// MaxFramePayload bounds a single frame so a corrupt length can't exhaust memory.
+const MaxFramePayload = 1 << 24
+
+var errFrameTooLarge = errors.New("tunnel: frame payload too large")
+
+// Frame is the unit of the binary protocol. Many streams share one connection,
+// each identified by StreamID.
+type Frame struct {
+    StreamID uint32
+    Type     byte
+    Flags    byte
+    Payload  []byte
+}
+
+// Encode serialises f with a ProtocolBinary header.
+func (f Frame) Encode() []byte {
+    b := make([]byte, FrameHeaderSize+len(f.Payload))
+    b[0] = ProtocolBinary
+    b[1] = f.Type
+    b[2] = f.Flags
+    binary.BigEndian.PutUint32(b[4:8], f.StreamID)
+    binary.BigEndian.PutUint32(b[8:12], uint32(len(f.Payload)))
+    copy(b[FrameHeaderSize:], f.Payload)
+    return b
+}
+
+// DecodeFrame parses a single encoded frame.
+func DecodeFrame(b []byte) (Frame, error) {
+    if len(b) < FrameHeaderSize {
+        return Frame{}, io.ErrUnexpectedEOF
+    }
+    if b[0] != ProtocolBinary {
+        return Frame{}, fmt.Errorf("tunnel: unsupported frame version %d", b[0])
+    }
+    n := binary.BigEndian.Uint32(b[8:12])
+    if n > MaxFramePayload {
+        return Frame{}, errFrameTooLarge
+    }
+    if len(b)-FrameHeaderSize != int(n) {
+        return Frame{}, io.ErrUnexpectedEOF
+    }
+    return Frame{
+        Type:     b[1],
+        Flags:    b[2],
+        StreamID: binary.BigEndian.Uint32(b[4:8]),
+        Payload:  b[FrameHeaderSize:],
+    }, nil
+}
+
+// ReadFrame reads one frame from a byte stream.
+func ReadFrame(r io.Reader) (Frame, error) {
+    hdr := make([]byte, FrameHeaderSize)
+    if _, err := io.ReadFull(r, hdr); err != nil {
+        return Frame{}, err
+    }
+    n := binary.BigEndian.Uint32(hdr[8:12])
+    if n > MaxFramePayload {
+        return Frame{}, errFrameTooLarge
+    }
+    b := make([]byte, FrameHeaderSize+int(n))
+    copy(b, hdr)
+    if _, err := io.ReadFull(r, b[FrameHeaderSize:]); err != nil {
+        return Frame{}, err
+    }
+    return DecodeFrame(b)
+}
+
+// EncodeMessage converts a Message into its binary frame.
+func EncodeMessage(m Message) (Frame, error) {
+    switch m.Type {
+    case TypeRequest, TypeWSOpen, TypeTCPOpen:
+        var e encoder
+        e.string(m.Request.Method)
+        e.string(m.Request.Path)
+        e.headers(m.Request.Headers)
+        e.string(m.Request.RemoteAddr)
+        f := Frame{StreamID: m.Request.ID, Type: FrameOpen}
+        if m.Request.Tunnel != "" {
+            e.string(m.Request.Tunnel)
+            f.Flags |= FlagTunnel
+        }
+        f.Payload = e.buf
+        switch m.Type {
+        case TypeWSOpen:
+            f.Flags |= FlagUpgrade
+        case TypeTCPOpen:
+            f.Flags |= FlagRaw
+        }
+        return f, nil
+    case TypeResponse:
+        var e encoder
+        e.uvarint(uint64(m.Response.Status))
+        e.headers(m.Response.Headers)
+        return Frame{StreamID: m.Response.ID, Type: FrameHeaders, Payload: e.buf}, nil
+    case TypeData:
+        if len(m.Data.Body) == 0 && m.Data.End {
+            f := Frame{StreamID: m.Data.ID, Type: FrameEnd}
+            if len(m.Data.Trailers) > 0 {
+                var e encoder
+                e.headers(m.Data.Trailers)
+                f.Payload = e.buf
+            }
+            return f, nil
+        }
+        if len(m.Data.Trailers) > 0 {
+            return Frame{}, errors.New("tunnel: trailers must travel on an empty End chunk")
+        }
+        f := Frame{StreamID: m.Data.ID, Type: FrameData, Payload: m.Data.Body}
+        if m.Data.End {
+            f.Flags |= FlagEnd
+        }
+        return f, nil
+    case TypeWSFrame:
+        payload := make([]byte, 1+len(m.Frame.Payload))
+        payload[0] = byte(m.Frame.OpCode)
+        copy(payload[1:], m.Frame.Payload)
+        return Frame{StreamID: m.Frame.ID, Type: FrameData, Flags: FlagWebSocket, Payload: payload}, nil
+    case TypeReset:
+        return Frame{StreamID: m.Reset.ID, Type: FrameReset, Payload: []byte(m.Reset.Reason)}, nil
+    case TypeCancel:
+        return Frame{StreamID: m.Reset.ID, Type: FrameCancel, Payload: []byte(m.Reset.Reason)}, nil
+    case TypeDrain:
+        return Frame{Type: FrameDrain, Payload: []byte(m.Reset.Reason)}, nil
+    case TypeWindow:
+        var e encoder
+        e.uvarint(uint64(m.Window.Increment))
+        return Frame{StreamID: m.Window.ID, Type: FrameWindow, Payload: e.buf}, nil
+    case TypeDatagram:
+        var e encoder
+        f := Frame{StreamID: m.Datagram.Session, Type: FrameDatagram}
+        if m.Datagram.Tunnel != "" {
+            e.string(m.Datagram.Tunnel)
+            f.Flags |= FlagTunnel
+        }
+        e.string(m.Datagram.RemoteAddr)
+        f.Payload = append(e.buf, m.Datagram.Payload...)
+        return f, nil
+    case TypeBound, TypeBind:
+        // Name and Error come last, so peers that predate them can ignore them.
+        var e encoder
+        e.string(m.Bound.Kind)
+        e.string(m.Bound.Subdomain)
+        e.uvarint(uint64(m.Bound.Port))
+        e.string(m.Bound.URL)
+        e.string(m.Bound.Name)
+        e.string(m.Bound.Error)
+        e.string(m.Bound.Options)
+        if m.Type == TypeBind {
+            return Frame{Type: FrameBind, Payload: e.buf}, nil
+        }
+        return Frame{Type: FrameBound, Payload: e.buf}, nil
+    }
+    return Frame{}, fmt.Errorf("tunnel: cannot encode message type %q", m.Type)
+}
+
+// DecodeMessage converts a binary frame back into a Message.
+func DecodeMessage(f Frame) (Message, error) {
+    switch f.Type {
+    case FrameOpen:
+        d := decoder{buf: f.Payload}
+        req := &Request{ID: f.StreamID, Method: d.string(), Path: d.string(), Headers: d.headers(), RemoteAddr: d.string()}
+        if f.Flags&FlagTunnel != 0 {
+            req.Tunnel = d.string()
+        }
+        if d.err != nil {
+            return Message{}, d.err
+        }
+        switch {
+        case f.Flags&FlagUpgrade != 0:
+            return Message{Type: TypeWSOpen, Request: req}, nil
+        case f.Flags&FlagRaw != 0:
+            return Message{Type: TypeTCPOpen, Request: req}, nil
+        }
+        return Message{Type: TypeRequest, Request: req}, nil
+    case FrameHeaders:
+        d := decoder{buf: f.Payload}
+        resp := &Response{ID: f.StreamID, Status: int(d.uvarint()), Headers: d.headers()}
+        if d.err != nil {
+            return Message{}, d.err
+        }
+        return Message{Type: TypeResponse, Response: resp}, nil
+    case FrameData:
+        if f.Flags&FlagWebSocket != 0 {
+            if len(f.Payload) == 0 {
+                return Message{}, io.ErrUnexpectedEOF
+            }
+            return Message{Type: TypeWSFrame, Frame: &WSFrame{ID: f.StreamID, OpCode: int(f.Payload[0]), Payload: f.Payload[1:]}}, nil
+        }
+        return Message{Type: TypeData, Data: &Data{ID: f.StreamID, Body: f.Payload, End: f.Flags&FlagEnd != 0}}, nil
+    case FrameEnd:
+        data := &Data{ID: f.StreamID, End: true}
+        if len(f.Payload) > 0 {
+            d := decoder{buf: f.Payload}
+            if data.Trailers = d.headers(); d.err != nil {
+                return Message{}, d.err
+            }
+        }
+        return Message{Type: TypeData, Data: data}, nil
+    case FrameReset:
+        return Message{Type: TypeReset, Reset: &Reset{ID: f.StreamID, Reason: string(f.Payload)}}, nil
+    case FrameCancel:
+        return Message{Type: TypeCancel, Reset: &Reset{ID: f.StreamID, Reason: string(f.Payload)}}, nil
+    case FrameDrain:
+        return Message{Type: TypeDrain, Reset: &Reset{Reason: string(f.Payload)}}, nil
+    case FrameWindow:
+        d := decoder{buf: f.Payload}
+        w := &Window{ID: f.StreamID, Increment: uint32(d.uvarint())}
+        if d.err != nil {
+            return Message{}, d.err
+        }
+        return Message{Type: TypeWindow, Window: w}, nil
+    case FrameDatagram:
+        d := decoder{buf: f.Payload}
+        dg := &Datagram{Session: f.StreamID}
+        if f.Flags&FlagTunnel != 0 {
+            dg.Tunnel = d.string()
+        }
+        dg.RemoteAddr = d.string()
+        if d.err != nil {
+            return Message{}, d.err
+        }
+        dg.Payload = d.buf
+        return Message{Type: TypeDatagram, Datagram: dg}, nil
+    case FrameBound, FrameBind:
+        d := decoder{buf: f.Payload}
+        b := &Binding{Kind: d.string(), Subdomain: d.string(), Port: int(d.uvarint()), URL: d.string()}
+        if len(d.buf) > 0 {
+            b.Name, b.Error = d.string(), d.string()
+        }
+        if len(d.buf) > 0 {
+            b.Options = d.string()
+        }
+        if d.err != nil {
+            return Message{}, d.err
+        }
+        if f.Type == FrameBind {
+            return Message{Type: TypeBind, Bound: b}, nil
+        }
+        return Message{Type: TypeBound, Bound: b}, nil
+    }
+    return Message{}, fmt.Errorf("tunnel: unknown frame type %d", f.Type)
+}
+
+// encoder builds frame payloads from uvarints and length-prefixed strings.
+type encoder struct {
+    buf []byte
+}
+
+func (e *encoder) uvarint(v uint64) {
+    e.buf = binary.AppendUvarint(e.buf, v)
+}
+
+func (e *encoder) string(s string) {
+    e.uvarint(uint64(len(s)))
+    e.buf = append(e.buf, s...)
+}
+
+func (e *encoder) headers(h Header) {
+    e.uvarint(uint64(len(h)))
+    for _, f := range h {
+        e.string(f.Name)
+        e.string(f.Value)
+    }
+}
+
+// decoder is the inverse of encoder; the first error sticks and later reads return zero values.
+type decoder struct {
+    buf []byte
+    err error
+}
+
+func (d *decoder) uvarint() uint64 {
+    if d.err != nil {
+        return 0
+    }
+    v, n := binary.Uvarint(d.buf)
+    if n <= 0 {
+        d.err = io.ErrUnexpectedEOF
+        return 0
+    }
+    d.buf = d.buf[n:]
+    return v
+}
+
+func (d *decoder) string() string {
+    n := d.uvarint()
+    if d.err != nil {
+        return ""
+    }
+    if uint64(len(d.buf)) < n {
+        d.err = io.ErrUnexpectedEOF
+        return ""
+    }
+    s := string(d.buf[:n])
+    d.buf = d.buf[n:]
+    return s
+}
+
+func (d *decoder) headers() Header {
+    n := d.uvarint()
+    if d.err != nil || n > uint64(len(d.buf)) {
+        if d.err == nil {
+            d.err = io.ErrUnexpectedEOF
+        }
+        return nil
+    }
+    h := make(Header, 0, n)
+    for i := uint64(0); i < n && d.err == nil; i++ {
+        h = append(h, HeaderField{Name: d.string(), Value: d.string()})
+    }
+    return h
+}
@@ -0,0 +1,70 @@
+package tunnel
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestMessageFrameRoundTrip(t *testing.T) {
+    msgs := []Message{
+        {Type: TypeRequest, Request: &Request{ID: 1, Method: "POST", Path: "/upload?x=1", Headers: Header{{"Set-Cookie", "a=1"}, {"Set-Cookie", "b=2"}, {"Content-Type", "text/plain"}}}},
+        {Type: TypeWSOpen, Request: &Request{ID: 2, Method: "GET", Path: "/ws", Headers: Header{}}},
+        {Type: TypeResponse, Response: &Response{ID: 1, Status: 201, Headers: Header{{"X-A", "b"}}}},
+        {Type: TypeData, Data: &Data{ID: 1, Body: []byte("chunk")}},
+        {Type: TypeData, Data: &Data{ID: 1, Body: []byte("last"), End: true}},
+        {Type: TypeData, Data: &Data{ID: 1, End: true}},
+        {Type: TypeData, Data: &Data{ID: 1, End: true, Trailers: Header{{"Grpc-Status", "0"}}}},
+        {Type: TypeWSFrame, Frame: &WSFrame{ID: 2, OpCode: 1, Payload: []byte("hi")}},
+        {Type: TypeReset, Reset: &Reset{ID: 3, Reason: "boom"}},
+        {Type: TypeCancel, Reset: &Reset{ID: 3, Reason: "timeout"}},
+        {Type: TypeDrain, Reset: &Reset{Reason: "server shutting down"}},
+        {Type: TypeWindow, Window: &Window{ID: 3, Increment: 65536}},
+        {Type: TypeWindow, Window: &Window{Increment: 1 << 20}},
+        {Type: TypeTCPOpen, Request: &Request{ID: 4, Headers: Header{}, RemoteAddr: "203.0.113.7:51234"}},
+        {Type: TypeBound, Bound: &Binding{Kind: KindTCP, Port: 20001, URL: "tcp://example.com:20001"}},
+        {Type: TypeDatagram, Datagram: &Datagram{Session: 5, RemoteAddr: "198.51.100.2:5353", Payload: []byte{0, 1, 2}}},
+        {Type: TypeRequest, Request: &Request{ID: 6, Method: "GET", Path: "/", Headers: Header{}, Tunnel: "api"}},
+        {Type: TypeDatagram, Datagram: &Datagram{Session: 7, RemoteAddr: "198.51.100.2:5353", Tunnel: "dns", Payload: []byte{3}}},
+        {Type: TypeBind, Bound: &Binding{Name: "api", Kind: KindHTTP, Subdomain: "api", Options: "request_timeout=5m"}},
+        {Type: TypeBound, Bound: &Binding{Name: "web", Kind: KindHTTP, Error: "409 subdomain taken"}},
+    }
+    for _, m := range msgs {
+        f, err := EncodeMessage(m)
+        if err != nil {
+            t.Fatalf("encode %s: %v", m.Type, err)
+        }
+        got, err := ReadFrame(bytes.NewReader(f.Encode()))
+        if err != nil {
+            t.Fatalf("read %s: %v", m.Type, err)
+        }
+        back, err := DecodeMessage(got)
+        if err != nil {
+            t.Fatalf("decode %s: %v", m.Type, err)
+        }
+        if !reflect.DeepEqual(back, m) {
+            t.Fatalf("round trip mismatch:\n got %+v\nwant %+v", back, m)
+        }
+    }
+}
+
+func TestDecodeFrameRejectsBadInput(t *testing.T) {
+    good := Frame{StreamID: 7, Type: FrameData, Payload: []byte("abc")}.Encode()
+    if _, err := DecodeFrame(good[:len(good)-1]); err == nil {
+        t.Errorf("expected error for truncated frame")
+    }
+    bad := append([]byte{}, good...)
+    bad[0] = 99
+    if _, err := DecodeFrame(bad); err == nil {
+        t.Errorf("expected error for unknown version")
+    }
+}
+
+func TestNegotiateVersion(t *testing.T) {
+    cases := map[string]int{"": ProtocolLegacy, "0": ProtocolLegacy, "1": ProtocolJSON, "2": ProtocolBinary, "9": ProtocolVersion, "x": ProtocolLegacy}
+    for offered, want := range cases {
+        if got := NegotiateVersion(offered); got != want {
+            t.Errorf("NegotiateVersion(%q) = %d, want %d", offered, got, want)
+        }
+    }
+}
@@ -0,0 +1,108 @@
+package tunnel
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// HeaderField is a single header line.
+type HeaderField struct {
+    Name  string `json:"name"`
+    Value string `json:"value"`
+}
+
+// Header is an ordered list of header fields. Unlike a flattened map it keeps
+// every value of a repeated header (Set-Cookie, Vary, …) in the order given.
+type Header []HeaderField
+
+// HeaderFrom converts h into a Header. net/http doesn't record the order of
+// distinct names, so names are sorted; values of each name keep their order.
+// If trailer is non-nil its names are announced in a Trailer field so the
+// receiving side can declare them before the body starts.
+func HeaderFrom(h http.Header, trailer http.Header) Header {
+    names := make([]string, 0, len(h))
+    for k := range h {
+        names = append(names, k)
+    }
+    sort.Strings(names)
+    out := make(Header, 0, len(h))
+    for _, k := range names {
+        for _, v := range h[k] {
+            out = append(out, HeaderField{Name: k, Value: v})
+        }
+    }
+    if len(trailer) > 0 {
+        declared := make([]string, 0, len(trailer))
+        for k := range trailer {
+            declared = append(declared, k)
+        }
+        sort.Strings(declared)
+        out = append(out, HeaderField{Name: "Trailer", Value: strings.Join(declared, ", ")})
+    }
+    return out
+}
+
+// HTTP converts h into an http.Header, preserving every value.
+func (h Header) HTTP() http.Header {
+    out := make(http.Header, len(h))
+    for _, f := range h {
+        out.Add(f.Name, f.Value)
+    }
+    return out
+}
+
+// Get returns the first value for name, compared case-insensitively.
+func (h Header) Get(name string) string {
+    for _, f := range h {
+        if strings.EqualFold(f.Name, name) {
+            return f.Value
+        }
+    }
+    return ""
+}
+
+// DeclaredTrailers returns an http.Header holding the names announced in
+// Trailer fields, ready to be filled in once the body ends, or nil if none are.
+func (h Header) DeclaredTrailers() http.Header {
+    var out http.Header
+    for _, f := range h {
+        if !strings.EqualFold(f.Name, "Trailer") {
+            continue
+        }
+        for _, name := range strings.Split(f.Value, ",") {
+            if name = strings.TrimSpace(name); name != "" {
+                if out == nil {
+                    out = make(http.Header)
+                }
+                out[http.CanonicalHeaderKey(name)] = nil
+            }
+        }
+    }
+    return out
+}
+
+// UnmarshalJSON accepts the list form as well as the flat object written by
+// older peers and log stores, where repeated values had already been joined.
+func (h *Header) UnmarshalJSON(b []byte) error {
+    var fields []HeaderField
+    if err := json.Unmarshal(b, &fields); err == nil {
+        *h = fields
+        return nil
+    }
+    var flat map[string]string
+    if err := json.Unmarshal(b, &flat); err != nil {
+        return err
+    }
+    *h = HeaderFrom(flatToHTTP(flat), nil)
+    return nil
+}
+
+func flatToHTTP(flat map[string]string) http.Header {
+    out := make(http.Header, len(flat))
+    for k, v := range flat {
+        out[k] = []string{v}
+    }
+    return out
+}
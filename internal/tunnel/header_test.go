@@ -0,0 +1,42 @@
+package tunnel
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+func TestHeaderKeepsRepeatedValues(t *testing.T) {
+    h := http.Header{}
+    h.Add("Set-Cookie", "a=1; Path=/")
+    h.Add("Set-Cookie", "b=2")
+    h.Add("Accept", "text/html, application/json")
+
+    got := HeaderFrom(h, http.Header{"Grpc-Status": nil})
+    want := Header{
+        {"Accept", "text/html, application/json"},
+        {"Set-Cookie", "a=1; Path=/"},
+        {"Set-Cookie", "b=2"},
+        {"Trailer", "Grpc-Status"},
+    }
+    if !reflect.DeepEqual(got, want) {
+        t.Fatalf("HeaderFrom = %+v", got)
+    }
+    if back := got.HTTP(); !reflect.DeepEqual(back["Set-Cookie"], h["Set-Cookie"]) {
+        t.Fatalf("round trip lost values: %v", back)
+    }
+    if tr := got.DeclaredTrailers(); len(tr) != 1 {
+        t.Fatalf("expected Grpc-Status to be declared, got %v", tr)
+    }
+}
+
+func TestHeaderUnmarshalLegacyObject(t *testing.T) {
+    var h Header
+    if err := json.Unmarshal([]byte(`{"X-B":"2","X-A":"1"}`), &h); err != nil {
+        t.Fatalf("unmarshal: %v", err)
+    }
+    if !reflect.DeepEqual(h, Header{{"X-A", "1"}, {"X-B", "2"}}) {
+        t.Fatalf("legacy object decoded as %+v", h)
+    }
+}
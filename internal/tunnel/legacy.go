@@ -0,0 +1,135 @@
+package tunnel
+
+import (
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// legacyMessage is the JSON a pre-protocol peer reads and writes: a whole
+// request or response per message, with its body buffered and its headers
+// flattened. Requests have a Method; responses don't.
+type legacyMessage struct {
+    ID      string            `json:"id"`
+    Method  string            `json:"method,omitempty"`
+    Path    string            `json:"path,omitempty"`
+    Status  int               `json:"status,omitempty"`
+    Headers map[string]string `json:"headers"`
+    Body    []byte            `json:"body"`
+}
+
+// legacyCodec translates Messages to and from ProtocolLegacy. An outgoing
+// Request or Response is held until its body ends and then sent in one go; an
+// incoming one is split back into the Request or Response and a final Data.
+// Everything the old format can't express (WebSockets, raw streams,
+// datagrams, resets, windows, bindings) is dropped.
+type legacyCodec struct {
+    mu      sync.Mutex
+    pending map[uint32]*legacyMessage // being written, by stream
+    names   map[uint32]string         // peer IDs that aren't numbers
+    nextID  uint32
+    queued  []Message // read but not yet returned
+}
+
+func newLegacyCodec() *legacyCodec {
+    return &legacyCodec{pending: make(map[uint32]*legacyMessage), names: make(map[uint32]string), nextID: 1 << 31}
+}
+
+// encode returns the message to send for m once a whole exchange has been
+// collected, or nil while it is still buffering (or m has no equivalent).
+func (l *legacyCodec) encode(m Message) *legacyMessage {
+    l.mu.Lock()
+    defer l.mu.Unlock()
+    switch m.Type {
+    case TypeRequest:
+        r := m.Request
+        l.pending[r.ID] = &legacyMessage{ID: l.name(r.ID), Method: r.Method, Path: r.Path, Headers: flatten(r.Headers)}
+    case TypeResponse:
+        r := m.Response
+        l.pending[r.ID] = &legacyMessage{ID: l.name(r.ID), Status: r.Status, Headers: flatten(r.Headers)}
+    case TypeData:
+        lm := l.pending[m.Data.ID]
+        if lm == nil {
+            return nil
+        }
+        lm.Body = append(lm.Body, m.Data.Body...)
+        if m.Data.End {
+            l.forget(m.Data.ID)
+            return lm
+        }
+    case TypeReset, TypeCancel:
+        l.forget(m.Reset.ID)
+    }
+    return nil
+}
+
+// decode queues the Messages lm stands for.
+func (l *legacyCodec) decode(lm legacyMessage) {
+    l.mu.Lock()
+    defer l.mu.Unlock()
+    id := l.id(lm.ID)
+    names := make([]string, 0, len(lm.Headers))
+    for k := range lm.Headers {
+        names = append(names, k)
+    }
+    sort.Strings(names)
+    headers := make(Header, 0, len(names))
+    for _, k := range names {
+        headers = append(headers, HeaderField{Name: k, Value: lm.Headers[k]})
+    }
+    if lm.Method != "" {
+        l.queued = append(l.queued, Message{Type: TypeRequest, Request: &Request{ID: id, Method: lm.Method, Path: lm.Path, Headers: headers}})
+    } else {
+        l.queued = append(l.queued, Message{Type: TypeResponse, Response: &Response{ID: id, Status: lm.Status, Headers: headers}})
+    }
+    l.queued = append(l.queued, Message{Type: TypeData, Data: &Data{ID: id, Body: lm.Body, End: true}})
+}
+
+// next returns a queued message, if there is one.
+func (l *legacyCodec) next() (Message, bool) {
+    l.mu.Lock()
+    defer l.mu.Unlock()
+    if len(l.queued) == 0 {
+        return Message{}, false
+    }
+    m := l.queued[0]
+    l.queued = l.queued[1:]
+    return m, true
+}
+
+// id maps a peer's stream ID to ours: numbers are IDs we handed out, anything
+// else (the old server used UUIDs) gets a fresh one.
+func (l *legacyCodec) id(s string) uint32 {
+    if n, err := strconv.ParseUint(s, 10, 32); err == nil {
+        return uint32(n)
+    }
+    l.nextID++
+    l.names[l.nextID] = s
+    return l.nextID
+}
+
+// name is the inverse of id.
+func (l *legacyCodec) name(id uint32) string {
+    if s, ok := l.names[id]; ok {
+        return s
+    }
+    return strconv.FormatUint(uint64(id), 10)
+}
+
+func (l *legacyCodec) forget(id uint32) {
+    delete(l.pending, id)
+    delete(l.names, id)
+}
+
+// flatten joins repeated headers the way a single header line would.
+func flatten(h Header) map[string]string {
+    out := make(map[string]string, len(h))
+    for _, f := range h {
+        if v, ok := out[f.Name]; ok {
+            out[f.Name] = v + ", " + f.Value
+        } else {
+            out[f.Name] = f.Value
+        }
+    }
+    return out
+}
@@ -1,16 +1,128 @@
 package tunnel
 
+// Message types sent over the tunnel connection.
+const (
+    TypeRequest  = "request"
+    TypeResponse = "response"
+    TypeData     = "data"
+    TypeWSOpen   = "ws_open"
+    TypeWSFrame  = "ws_frame"
+    TypeReset    = "reset"
+    TypeTCPOpen  = "tcp_open"
+    TypeBound    = "bound"
+    TypeDatagram = "datagram"
+    TypeCancel   = "cancel"
+    TypeWindow   = "window"
+    TypeBind     = "bind"
+    TypeDrain    = "drain"
+)
+
+// Tunnel kinds a client can ask for at /connect.
+const (
+    KindHTTP = "http"
+    KindTCP  = "tcp"
+    KindUDP  = "udp"
+    // KindMulti connects without a tunnel; the client then asks for each of
+    // its named tunnels with a Bind message.
+    KindMulti = "multi"
+)
+
+// Message is the envelope for every frame exchanged between server and client.
+// Exactly one of the payload fields is set, according to Type.
+type Message struct {
+    Type     string    `json:"type"`
+    Request  *Request  `json:"request,omitempty"`
+    Response *Response `json:"response,omitempty"`
+    Data     *Data     `json:"data,omitempty"`
+    Frame    *WSFrame  `json:"frame,omitempty"`
+    Reset    *Reset    `json:"reset,omitempty"`
+    Bound    *Binding  `json:"bound,omitempty"`
+    Datagram *Datagram `json:"datagram,omitempty"`
+    Window   *Window   `json:"window,omitempty"`
+}
+
+// Request opens a stream. Its body follows as Data messages with the same ID,
+// which the server allocates uniquely per connection.
+// Sent with TypeWSOpen it instead asks the client to dial a local WebSocket;
+// the client answers with a Response (101 on success) and frames follow.
+// Sent with TypeTCPOpen only ID and RemoteAddr are set: the client dials its
+// local address and raw bytes flow both ways as Data, End being a half-close.
+// On a KindMulti connection Tunnel names the tunnel the stream belongs to.
 type Request struct {
-    ID      string            `json:"id"`
-    Method  string            `json:"method"`
-    Path    string            `json:"path"`
-    Headers map[string]string `json:"headers"`
-    Body    []byte            `json:"body"`
+    ID         uint32 `json:"id,string"`
+    Method     string `json:"method"`
+    Path       string `json:"path"`
+    Headers    Header `json:"headers"`
+    RemoteAddr string `json:"remote_addr,omitempty"`
+    Tunnel     string `json:"tunnel,omitempty"`
 }
 
+// Response answers a Request. Its body follows as Data messages with the same ID.
 type Response struct {
-    ID      string            `json:"id"`
-    Status  int               `json:"status"`
-    Headers map[string]string `json:"headers"`
-    Body    []byte            `json:"body"`
+    ID      uint32 `json:"id,string"`
+    Status  int    `json:"status"`
+    Headers Header `json:"headers"`
+}
+
+// Data carries one chunk of a request or response body. End marks the last
+// chunk, which also carries the body's trailers, if any.
+type Data struct {
+    ID       uint32 `json:"id,string"`
+    Body     []byte `json:"body,omitempty"`
+    End      bool   `json:"end,omitempty"`
+    Trailers Header `json:"trailers,omitempty"`
+}
+
+// WSFrame relays one WebSocket message on an upgraded stream. OpCode uses the
+// RFC 6455 values (text, binary, close); a close frame ends the stream.
+type WSFrame struct {
+    ID      uint32 `json:"id,string"`
+    OpCode  int    `json:"opcode"`
+    Payload []byte `json:"payload,omitempty"`
+}
+
+// Reset aborts a stream, e.g. when a body can't be read to the end.
+// Sent with TypeCancel by the server it means the visitor went away or timed
+// out: the client should abort the local request and not answer it.
+// Sent with TypeDrain (and ID 0) it means the server is shutting down: it
+// takes no new tunnels and closes the connection once the requests in flight
+// are done, so the client should reconnect, elsewhere, straight away. Only
+// sent from ProtocolDrain on.
+type Reset struct {
+    ID     uint32 `json:"id,string"`
+    Reason string `json:"reason,omitempty"`
+}
+
+// Binding is sent by the server once a tunnel is live and tells the client
+// where visitors can reach it. On a KindMulti connection the client sends one
+// with TypeBind, giving Name, Kind and Subdomain, to ask for each tunnel; the
+// server answers with the same Name and either the URL or the Error that
+// refused it. Options carries per-tunnel settings as a URL query, e.g.
+// "request_timeout=5m": asked for in a Bind, and as granted in a Bound.
+type Binding struct {
+    Name      string `json:"name,omitempty"`
+    Kind      string `json:"kind"`
+    Subdomain string `json:"subdomain,omitempty"`
+    Port      int    `json:"port,omitempty"`
+    URL       string `json:"url"`
+    Error     string `json:"error,omitempty"`
+    Options   string `json:"options,omitempty"`
+}
+
+// Datagram relays one UDP packet. Session identifies the visitor (by source
+// address) on the server; the client keeps one local socket per session until
+// the server ends it with a Reset carrying the session ID. Like RemoteAddr,
+// Tunnel is only set on a session's first datagram.
+type Datagram struct {
+    Session    uint32 `json:"session,string"`
+    RemoteAddr string `json:"remote_addr,omitempty"`
+    Tunnel     string `json:"tunnel,omitempty"`
+    Payload    []byte `json:"payload"`
+}
+
+// Window grants the peer Increment more bytes of Data body on stream ID, or on
+// the connection as a whole when ID is 0. Only used from ProtocolFlowControl on.
+type Window struct {
+    ID        uint32 `json:"id,string"`
+    Increment uint32 `json:"increment"`
 }
@@ -0,0 +1,511 @@
+package tunnel
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/quic-go/quic-go"
+)
+
+// QUICProtocol is the ALPN name tunnels are negotiated under.
+const QUICProtocol = "portkey"
+
+// NewQUICConfig returns the quic.Config used on both ends. QUIC keep-alives
+// and its idle timeout stand in for the WebSocket heartbeat. With heartbeats
+// disabled (either duration <= 0) no keep-alives are sent and quic-go's own
+// idle timeout applies.
+func NewQUICConfig(heartbeat, timeout time.Duration) *quic.Config {
+    if heartbeat <= 0 || timeout <= 0 {
+        return &quic.Config{MaxIncomingStreams: 1 << 16}
+    }
+    return &quic.Config{
+        KeepAlivePeriod:    heartbeat,
+        MaxIdleTimeout:     timeout,
+        MaxIncomingStreams: 1 << 16,
+    }
+}
+
+// ConnectError is the server refusing a tunnel, with the HTTP status and
+// reason /connect would have answered.
+type ConnectError struct {
+    Status int
+    Reason string
+}
+
+func (e *ConnectError) Error() string {
+    return fmt.Sprintf("connect refused (%d %s): %s", e.Status, http.StatusText(e.Status), e.Reason)
+}
+
+// QUICSession carries a tunnel over a QUIC connection. Every stream gets a
+// QUIC stream of its own, so one stalled stream never holds up the others,
+// and QUIC's flow control takes the place of Window messages. A control stream
+// opened by the client carries the connect handshake and the messages that
+// belong to no stream: Bound, Datagram and Resets of UDP sessions.
+//
+// Servers follow a client whose address changes, as after a NAT rebinding,
+// and a client can move its connection to a new socket with Migrate.
+type QUICSession struct {
+    conn    quic.Connection
+    ctrl    *quicStream
+    version int
+    // transports are the sockets a dialled session has sent from, kept open
+    // until it closes: closing one would close the connection with it.
+    transports []*quic.Transport
+    in   chan Message
+    // recv stops each stream's reader from running further ahead of the
+    // application than a WebSocket peer's window would allow.
+    recv *sendWindows
+
+    mu      sync.Mutex
+    streams map[uint32]*quicStream
+
+    closed    chan struct{}
+    closeOnce sync.Once
+    errMu     sync.Mutex
+    err       error
+}
+
+type quicStream struct {
+    str quic.Stream
+    r   *bufio.Reader
+    mu  sync.Mutex // serialises writes
+
+    // Guarded by the session's mu: once both directions have ended the
+    // stream is closed and forgotten.
+    sentEnd, gotEnd bool
+}
+
+func (st *quicStream) write(m Message) error {
+    f, err := EncodeMessage(m)
+    if err != nil {
+        return err
+    }
+    st.mu.Lock()
+    defer st.mu.Unlock()
+    _, err = st.str.Write(f.Encode())
+    return err
+}
+
+func (st *quicStream) read() (Message, error) {
+    f, err := ReadFrame(st.r)
+    if err != nil {
+        return Message{}, err
+    }
+    return DecodeMessage(f)
+}
+
+func newQUICSession(conn quic.Connection, ctrl quic.Stream) *QUICSession {
+    return &QUICSession{
+        conn:    conn,
+        ctrl:    &quicStream{str: ctrl, r: bufio.NewReader(ctrl)},
+        in:      make(chan Message, dataQueue),
+        recv:    newSendWindows(),
+        streams: make(map[uint32]*quicStream),
+        closed:  make(chan struct{}),
+    }
+}
+
+// DialQUIC opens a tunnel to the QUIC listener at addr, sending query as the
+// /connect query string. A refusal is returned as a *ConnectError.
+func DialQUIC(ctx context.Context, addr string, tlsConf *tls.Config, conf *quic.Config, query string) (*QUICSession, error) {
+    raddr, err := net.ResolveUDPAddr("udp", addr)
+    if err != nil {
+        return nil, err
+    }
+    tr, err := newQUICTransport()
+    if err != nil {
+        return nil, err
+    }
+    conn, err := tr.Dial(ctx, raddr, tlsConf, conf)
+    if err != nil {
+        closeQUICTransport(tr)
+        return nil, err
+    }
+    ctrl, err := conn.OpenStreamSync(ctx)
+    if err != nil {
+        conn.CloseWithError(0, "")
+        closeQUICTransport(tr)
+        return nil, err
+    }
+    q := newQUICSession(conn, ctrl)
+    q.transports = []*quic.Transport{tr}
+    offer := Header{{ProtocolHeader, strconv.Itoa(ProtocolVersion)}}
+    hello := Message{Type: TypeRequest, Request: &Request{Method: http.MethodGet, Path: "/connect?" + query, Headers: offer}}
+    if err := q.ctrl.write(hello); err != nil {
+        q.Close()
+        return nil, err
+    }
+    m, err := q.ctrl.read()
+    if err == nil && m.Type != TypeResponse {
+        err = fmt.Errorf("tunnel: unexpected %s message in quic handshake", m.Type)
+    }
+    if err != nil {
+        q.Close()
+        return nil, err
+    }
+    if m.Response.Status != http.StatusOK {
+        refused := &ConnectError{Status: m.Response.Status}
+        if body, err := q.ctrl.read(); err == nil && body.Type == TypeData {
+            refused.Reason = string(body.Data.Body)
+        }
+        q.Close()
+        return nil, refused
+    }
+    q.version = quicVersion(m.Response.Headers.Get(ProtocolHeader))
+    q.start()
+    return q, nil
+}
+
+// AcceptQUIC waits for a new connection's control stream and returns the
+// session with the client's /connect request, which the caller answers with
+// Admit or Refuse.
+func AcceptQUIC(ctx context.Context, conn quic.Connection) (*QUICSession, Request, error) {
+    ctrl, err := conn.AcceptStream(ctx)
+    if err != nil {
+        return nil, Request{}, err
+    }
+    q := newQUICSession(conn, ctrl)
+    m, err := q.ctrl.read()
+    if err == nil && m.Type != TypeRequest {
+        err = fmt.Errorf("tunnel: unexpected %s message in quic handshake", m.Type)
+    }
+    if err != nil {
+        conn.CloseWithError(0, "")
+        return nil, Request{}, err
+    }
+    q.version = quicVersion(m.Request.Headers.Get(ProtocolHeader))
+    return q, *m.Request, nil
+}
+
+// Admit accepts the client's /connect request and starts the session.
+func (q *QUICSession) Admit() error {
+    picked := Header{{ProtocolHeader, strconv.Itoa(q.version)}}
+    if err := q.ctrl.write(Message{Type: TypeResponse, Response: &Response{Status: http.StatusOK, Headers: picked}}); err != nil {
+        q.Close()
+        return err
+    }
+    q.start()
+    return nil
+}
+
+// Refuse turns the client's /connect request down and closes the connection
+// once the client has read why.
+func (q *QUICSession) Refuse(status int, reason string) {
+    q.ctrl.write(Message{Type: TypeResponse, Response: &Response{Status: status}})
+    q.ctrl.write(Message{Type: TypeData, Data: &Data{Body: []byte(reason), End: true}})
+    q.ctrl.str.Close()
+    select {
+    case <-q.conn.Context().Done():
+    case <-time.After(5 * time.Second):
+    }
+    q.Close()
+}
+
+func (q *QUICSession) start() {
+    go q.acceptLoop()
+    go func() {
+        for {
+            m, err := q.ctrl.read()
+            if err != nil {
+                q.fail(err)
+                return
+            }
+            if !q.deliver(m) {
+                return
+            }
+        }
+    }()
+}
+
+// acceptLoop picks up streams opened by the peer.
+func (q *QUICSession) acceptLoop() {
+    for {
+        str, err := q.conn.AcceptStream(context.Background())
+        if err != nil {
+            q.fail(err)
+            return
+        }
+        go q.readStream(&quicStream{str: str, r: bufio.NewReader(str)}, 0, false)
+    }
+}
+
+// readStream delivers the messages arriving on st. A stream accepted from
+// the peer is registered under the ID of its first message.
+func (q *QUICSession) readStream(st *quicStream, id uint32, registered bool) {
+    for {
+        m, err := st.read()
+        if err != nil {
+            // A stream that stops before the peer ended it was reset or lost
+            // with the connection; the application hears that as an abort.
+            if registered && !q.ended(id) {
+                q.received(id, Message{Type: TypeReset, Reset: &Reset{ID: id, Reason: err.Error()}})
+            }
+            return
+        }
+        sid, _ := streamOf(m)
+        if !registered {
+            id, registered = sid, true
+            q.mu.Lock()
+            q.streams[id] = st
+            q.mu.Unlock()
+        }
+        if m.Type == TypeData && len(m.Data.Body) > 0 {
+            if err := q.recv.acquire(id, len(m.Data.Body)); err != nil {
+                return
+            }
+        }
+        if !q.received(id, m) {
+            return
+        }
+    }
+}
+
+// ended reports whether the peer's side of stream id is already over.
+func (q *QUICSession) ended(id uint32) bool {
+    q.mu.Lock()
+    defer q.mu.Unlock()
+    st, ok := q.streams[id]
+    return !ok || st.gotEnd
+}
+
+// received notes whether m ends the peer's side of stream id and delivers it.
+func (q *QUICSession) received(id uint32, m Message) bool {
+    if endsStream(m) {
+        q.recv.forget(id)
+        q.mu.Lock()
+        if st, ok := q.streams[id]; ok {
+            st.gotEnd = true
+            if m.Type == TypeCancel {
+                st.sentEnd = true // nobody will read what we'd send
+            }
+            q.finish(id, st)
+        }
+        q.mu.Unlock()
+    }
+    return q.deliver(m)
+}
+
+func (q *QUICSession) deliver(m Message) bool {
+    select {
+    case q.in <- m:
+        return true
+    case <-q.closed:
+        return false
+    }
+}
+
+// finish closes and forgets a stream once both sides are done with it.
+// Callers hold q.mu.
+func (q *QUICSession) finish(id uint32, st *quicStream) {
+    if st.sentEnd && st.gotEnd {
+        delete(q.streams, id)
+        st.str.Close()
+    }
+}
+
+// streamOf returns the stream a message belongs to, if any.
+func streamOf(m Message) (uint32, bool) {
+    switch m.Type {
+    case TypeRequest, TypeWSOpen, TypeTCPOpen:
+        return m.Request.ID, true
+    case TypeResponse:
+        return m.Response.ID, true
+    case TypeData:
+        return m.Data.ID, true
+    case TypeWSFrame:
+        return m.Frame.ID, true
+    case TypeReset, TypeCancel:
+        return m.Reset.ID, true
+    }
+    return 0, false
+}
+
+// endsStream reports whether m is the last message its sender puts on a stream.
+func endsStream(m Message) bool {
+    switch m.Type {
+    case TypeData:
+        return m.Data.End
+    case TypeReset, TypeCancel:
+        return true
+    case TypeWSFrame:
+        return m.Frame.OpCode == websocket.CloseMessage
+    }
+    return false
+}
+
+// Version reports the version negotiated in the handshake. QUIC tunnels
+// always use binary frames, one stream per QUIC stream, with QUIC providing
+// flow control; the version says which messages the peer understands.
+func (q *QUICSession) Version() int {
+    return q.version
+}
+
+// quicVersion is the version a QUIC peer offered or picked: ProtocolBinary
+// for peers that predate negotiating it.
+func quicVersion(v string) int {
+    return max(NegotiateVersion(v), ProtocolBinary)
+}
+
+// WriteMessage sends m on its stream's QUIC stream, opening one for a new
+// stream, or on the control stream for messages that belong to no live stream.
+func (q *QUICSession) WriteMessage(m Message) error {
+    select {
+    case <-q.closed:
+        return q.Err()
+    default:
+    }
+    id, ok := streamOf(m)
+    if !ok {
+        return q.ctrl.write(m)
+    }
+    q.mu.Lock()
+    st, ok := q.streams[id]
+    q.mu.Unlock()
+    if !ok {
+        switch m.Type {
+        case TypeRequest, TypeWSOpen, TypeTCPOpen:
+            str, err := q.conn.OpenStreamSync(context.Background())
+            if err != nil {
+                return err
+            }
+            st = &quicStream{str: str, r: bufio.NewReader(str)}
+            q.mu.Lock()
+            q.streams[id] = st
+            q.mu.Unlock()
+            go q.readStream(st, id, true)
+        default:
+            // e.g. the Reset of a UDP session, or of a stream already done
+            return q.ctrl.write(m)
+        }
+    }
+    if err := st.write(m); err != nil {
+        return err
+    }
+    if endsStream(m) {
+        q.mu.Lock()
+        st.sentEnd = true
+        if m.Type == TypeCancel {
+            st.gotEnd = true
+            st.str.CancelRead(0)
+        }
+        q.finish(id, st)
+        q.mu.Unlock()
+    }
+    return nil
+}
+
+// ReadMessage blocks until the next Message arrives on any stream.
+func (q *QUICSession) ReadMessage() (Message, error) {
+    select {
+    case m := <-q.in:
+        return m, nil
+    case <-q.closed:
+        return Message{}, q.Err()
+    }
+}
+
+// Pipe creates the receiving end of stream id's body. Writes never block;
+// the stream's reader waits for the data to be consumed instead, leaving the
+// sender to QUIC's flow control.
+func (q *QUICSession) Pipe(id uint32) (*PipeReader, *PipeWriter) {
+    return newPipe(q, id)
+}
+
+// Discard releases the credit for n bytes nobody will read.
+func (q *QUICSession) Discard(id uint32, n int) {
+    q.grantStream(id, n)
+    q.grantConn(n)
+}
+
+func (q *QUICSession) flowControlled() bool { return true }
+
+func (q *QUICSession) grantStream(id uint32, n int) { q.recv.grant(id, n) }
+
+func (q *QUICSession) grantConn(n int) { q.recv.grant(0, n) }
+
+// Err reports why the session ended, or nil while it is live.
+func (q *QUICSession) Err() error {
+    q.errMu.Lock()
+    defer q.errMu.Unlock()
+    return q.err
+}
+
+// Close ends the session and the QUIC connection.
+func (q *QUICSession) Close() error {
+    q.fail(net.ErrClosed)
+    return nil
+}
+
+func (q *QUICSession) fail(err error) {
+    q.closeOnce.Do(func() {
+        q.errMu.Lock()
+        q.err = err
+        q.errMu.Unlock()
+        close(q.closed)
+        q.recv.close(err)
+        q.conn.CloseWithError(0, "")
+        q.mu.Lock()
+        for _, tr := range q.transports {
+            closeQUICTransport(tr)
+        }
+        q.mu.Unlock()
+    })
+}
+
+// newQUICTransport opens a socket of its own for a dialled connection, or a
+// new path of one.
+func newQUICTransport() (*quic.Transport, error) {
+    pc, err := net.ListenUDP("udp", nil)
+    if err != nil {
+        return nil, err
+    }
+    return &quic.Transport{Conn: pc}, nil
+}
+
+// closeQUICTransport closes tr and its socket, which a Transport given one
+// leaves open.
+func closeQUICTransport(tr *quic.Transport) {
+    tr.Close()
+    tr.Conn.Close()
+}
+
+// Migrate moves a dialled session's connection onto a new socket, for when
+// the network the old one was sending over has gone, and keeps every stream
+// open. The server checks the new path answers before it is switched to; on
+// failure the connection stays on the old one.
+func (q *QUICSession) Migrate(ctx context.Context) error {
+    tr, err := newQUICTransport()
+    if err != nil {
+        return err
+    }
+    path, err := q.conn.AddPath(tr)
+    if err == nil {
+        if err = path.Probe(ctx); err == nil {
+            err = path.Switch()
+        }
+        if err != nil {
+            path.Close()
+        }
+    }
+    if err != nil {
+        closeQUICTransport(tr)
+        return err
+    }
+    q.mu.Lock()
+    defer q.mu.Unlock()
+    q.transports = append(q.transports, tr)
+    return nil
+}
+
+// Done is closed when the session ends.
+func (q *QUICSession) Done() <-chan struct{} {
+    return q.closed
+}
@@ -0,0 +1,154 @@
+package tunnel
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"math/big"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+// quicListener starts a QUIC listener that admits connections asking for
+// token=ok and refuses the rest, handing admitted sessions to the caller.
+func quicListener(t *testing.T) (string, <-chan *QUICSession) {
+    key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+    tmpl := x509.Certificate{SerialNumber: big.NewInt(1), NotAfter: time.Now().Add(time.Hour)}
+    der, err := x509.CreateCertificate(rand.Reader, &tmpl, &tmpl, &key.PublicKey, key)
+    if err != nil {
+        t.Fatalf("certificate: %v", err)
+    }
+    tlsConf := &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}, NextProtos: []string{QUICProtocol}}
+    ln, err := quic.ListenAddr("127.0.0.1:0", tlsConf, NewQUICConfig(time.Second, 5*time.Second))
+    if err != nil {
+        t.Fatalf("listen: %v", err)
+    }
+    t.Cleanup(func() { ln.Close() })
+    admitted := make(chan *QUICSession, 1)
+    go func() {
+        for {
+            conn, err := ln.Accept(context.Background())
+            if err != nil {
+                return
+            }
+            sess, req, err := AcceptQUIC(context.Background(), conn)
+            if err != nil {
+                t.Errorf("accept: %v", err)
+                return
+            }
+            if req.Path != "/connect?token=ok" {
+                go sess.Refuse(http.StatusUnauthorized, "unauthorized")
+                continue
+            }
+            sess.Admit()
+            t.Cleanup(func() { sess.Close() })
+            admitted <- sess
+        }
+    }()
+    return ln.Addr().String(), admitted
+}
+
+func dialTestQUIC(addr, query string) (*QUICSession, error) {
+    tlsConf := &tls.Config{NextProtos: []string{QUICProtocol}, InsecureSkipVerify: true}
+    return DialQUIC(context.Background(), addr, tlsConf, NewQUICConfig(time.Second, 5*time.Second), query)
+}
+
+func TestQUICSessionRoundTrip(t *testing.T) {
+    addr, admitted := quicListener(t)
+    client, err := dialTestQUIC(addr, "token=ok")
+    if err != nil {
+        t.Fatalf("dial: %v", err)
+    }
+    defer client.Close()
+    server := <-admitted
+    if client.Version() != ProtocolVersion || server.Version() != ProtocolVersion {
+        t.Fatalf("negotiated v%d (client) and v%d (server), want v%d", client.Version(), server.Version(), ProtocolVersion)
+    }
+
+    server.WriteMessage(Message{Type: TypeRequest, Request: &Request{ID: 1, Method: "POST", Path: "/"}})
+    server.WriteMessage(Message{Type: TypeData, Data: &Data{ID: 1, Body: []byte("ping"), End: true}})
+    for _, want := range []string{TypeRequest, TypeData} {
+        m, err := client.ReadMessage()
+        if err != nil || m.Type != want {
+            t.Fatalf("client read %v, %v; want %s", m.Type, err, want)
+        }
+    }
+    client.WriteMessage(Message{Type: TypeResponse, Response: &Response{ID: 1, Status: 200}})
+    client.WriteMessage(Message{Type: TypeData, Data: &Data{ID: 1, Body: []byte("pong"), End: true}})
+    for _, want := range []string{TypeResponse, TypeData} {
+        m, err := server.ReadMessage()
+        if err != nil || m.Type != want {
+            t.Fatalf("server read %v, %v; want %s", m.Type, err, want)
+        }
+    }
+
+    // connection-level messages travel on the control stream
+    server.WriteMessage(Message{Type: TypeDrain, Reset: &Reset{Reason: "server shutting down"}})
+    if m, err := client.ReadMessage(); err != nil || m.Type != TypeDrain || m.Reset.Reason != "server shutting down" {
+        t.Fatalf("client read %+v, %v; want the drain", m, err)
+    }
+
+    // both sides have ended the stream, so the client has let it go
+    client.mu.Lock()
+    open := len(client.streams)
+    client.mu.Unlock()
+    if open != 0 {
+        t.Fatalf("client still tracks %d streams", open)
+    }
+}
+
+func TestQUICSessionRefused(t *testing.T) {
+    addr, _ := quicListener(t)
+    _, err := dialTestQUIC(addr, "token=bad")
+    var refused *ConnectError
+    if !errors.As(err, &refused) || refused.Status != http.StatusUnauthorized || refused.Reason != "unauthorized" {
+        t.Fatalf("dial error = %v, want a 401 ConnectError", err)
+    }
+}
+
+func TestQUICSessionMigrate(t *testing.T) {
+    addr, admitted := quicListener(t)
+    client, err := dialTestQUIC(addr, "token=ok")
+    if err != nil {
+        t.Fatalf("dial: %v", err)
+    }
+    defer client.Close()
+    server := <-admitted
+
+    // a request is half way through when the client moves to a new socket
+    server.WriteMessage(Message{Type: TypeRequest, Request: &Request{ID: 1, Method: "POST", Path: "/"}})
+    server.WriteMessage(Message{Type: TypeData, Data: &Data{ID: 1, Body: []byte("pi")}})
+    for _, want := range []string{TypeRequest, TypeData} {
+        if m, err := client.ReadMessage(); err != nil || m.Type != want {
+            t.Fatalf("client read %v, %v; want %s", m.Type, err, want)
+        }
+    }
+    before := server.conn.RemoteAddr().String()
+    ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+    defer cancel()
+    if err := client.Migrate(ctx); err != nil {
+        t.Fatalf("migrate: %v", err)
+    }
+
+    server.WriteMessage(Message{Type: TypeData, Data: &Data{ID: 1, Body: []byte("ng"), End: true}})
+    if m, err := client.ReadMessage(); err != nil || m.Type != TypeData || string(m.Data.Body) != "ng" {
+        t.Fatalf("client read %+v, %v; want the rest of the body", m, err)
+    }
+    client.WriteMessage(Message{Type: TypeResponse, Response: &Response{ID: 1, Status: 200}})
+    client.WriteMessage(Message{Type: TypeData, Data: &Data{ID: 1, Body: []byte("pong"), End: true}})
+    for _, want := range []string{TypeResponse, TypeData} {
+        if m, err := server.ReadMessage(); err != nil || m.Type != want {
+            t.Fatalf("server read %v, %v; want %s", m.Type, err, want)
+        }
+    }
+    if after := server.conn.RemoteAddr().String(); after == before {
+        t.Fatalf("server still sends to %s after the client migrated", before)
+    }
+}
@@ -0,0 +1,189 @@
+package tunnel
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Outbound queue sizes. Senders block once their queue is full, so a flood of
+// body data pushes back on its producers instead of growing without bound.
+const (
+    controlQueue = 64
+    dataQueue    = 64
+)
+
+// Transport is a live tunnel connection as both ends use it: a Session over a
+// WebSocket or a QUICSession.
+type Transport interface {
+    Version() int
+    // WriteMessage may be called from any goroutine.
+    WriteMessage(m Message) error
+    // ReadMessage must be called from a single goroutine.
+    ReadMessage() (Message, error)
+    Pipe(id uint32) (*PipeReader, *PipeWriter)
+    Discard(id uint32, n int)
+    Close() error
+}
+
+// Session owns one tunnel connection. Any goroutine may call WriteMessage: a
+// single writer goroutine puts messages on the wire, sending control messages
+// (flow-control credit, the tunnel binding) ahead of queued stream traffic.
+// Stream messages keep their relative order, so a Reset never overtakes the
+// Request it aborts. Reads must come from a single goroutine.
+//
+// From ProtocolFlowControl on, writing a Data body blocks until the peer has
+// granted enough credit, and Window messages are consumed by ReadMessage.
+type Session struct {
+    conn    *Conn
+    control chan Message
+    data    chan Message
+    send    *sendWindows // nil unless flow controlled
+
+    // unacked is connection credit consumed locally but not yet granted back.
+    ackMu   sync.Mutex
+    unacked int
+
+    closed    chan struct{}
+    closeOnce sync.Once
+    errMu     sync.Mutex
+    err       error // why the session ended
+}
+
+// NewSession wraps ws for the given protocol version and starts its writer.
+func NewSession(ws *websocket.Conn, version int) *Session {
+    s := &Session{
+        conn:    NewConn(ws, version),
+        control: make(chan Message, controlQueue),
+        data:    make(chan Message, dataQueue),
+        closed:  make(chan struct{}),
+    }
+    if s.flowControlled() {
+        s.send = newSendWindows()
+    }
+    go s.writeLoop()
+    return s
+}
+
+func (s *Session) flowControlled() bool {
+    return s.conn.Version() >= ProtocolFlowControl
+}
+
+// Version reports the negotiated protocol version.
+func (s *Session) Version() int {
+    return s.conn.Version()
+}
+
+// WriteMessage queues m for sending. Data bodies must not exceed ChunkSize.
+// It fails once the session has ended; a write error ends the session.
+func (s *Session) WriteMessage(m Message) error {
+    if s.send != nil {
+        switch {
+        case m.Type == TypeData && len(m.Data.Body) > 0:
+            if err := s.send.acquire(m.Data.ID, len(m.Data.Body)); err != nil {
+                return err
+            }
+            if m.Data.End {
+                defer s.send.forget(m.Data.ID)
+            }
+        case m.Type == TypeData && m.Data.End:
+            defer s.send.forget(m.Data.ID)
+        case m.Type == TypeReset:
+            defer s.send.forget(m.Reset.ID)
+        }
+    }
+    q := s.data
+    if m.Type == TypeWindow || m.Type == TypeBound || m.Type == TypeDrain {
+        q = s.control
+    }
+    select {
+    case <-s.closed:
+        return s.Err()
+    default:
+    }
+    select {
+    case q <- m:
+        return nil
+    case <-s.closed:
+        return s.Err()
+    }
+}
+
+func (s *Session) writeLoop() {
+    for {
+        var m Message
+        select {
+        case m = <-s.control:
+        default:
+            select {
+            case m = <-s.control:
+            case m = <-s.data:
+            case <-s.closed:
+                return
+            }
+        }
+        if err := s.conn.WriteMessage(m); err != nil {
+            s.fail(err)
+            return
+        }
+    }
+}
+
+// ReadMessage blocks until the next Message arrives. Window messages are
+// applied to the session rather than returned. A read error ends the session.
+func (s *Session) ReadMessage() (Message, error) {
+    for {
+        m, err := s.conn.ReadMessage()
+        if err != nil {
+            s.fail(err)
+            return m, err
+        }
+        if m.Type != TypeWindow {
+            return m, nil
+        }
+        if s.send != nil {
+            s.send.grant(m.Window.ID, int(m.Window.Increment))
+        }
+    }
+}
+
+// Heartbeat pings the peer every interval and fails reads once it has been
+// silent for timeout. See Conn.Heartbeat.
+func (s *Session) Heartbeat(interval, timeout time.Duration) {
+    s.conn.Heartbeat(interval, timeout)
+}
+
+// Done is closed once the session has ended.
+func (s *Session) Done() <-chan struct{} {
+    return s.closed
+}
+
+// Err reports why the session ended, or nil while it is live.
+func (s *Session) Err() error {
+    s.errMu.Lock()
+    defer s.errMu.Unlock()
+    return s.err
+}
+
+// Close ends the session and closes the connection. Messages still queued are
+// dropped.
+func (s *Session) Close() error {
+    s.fail(net.ErrClosed)
+    return nil
+}
+
+// fail ends the session with err, unless it has already ended.
+func (s *Session) fail(err error) {
+    s.closeOnce.Do(func() {
+        s.errMu.Lock()
+        s.err = err
+        s.errMu.Unlock()
+        close(s.closed)
+        if s.send != nil {
+            s.send.close(err)
+        }
+        s.conn.Close()
+    })
+}
@@ -0,0 +1,101 @@
+package tunnel
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// handshakeHeaders are generated by the WebSocket library on each leg and must
+// not be copied across the tunnel.
+var handshakeHeaders = []string{
+    "Connection",
+    "Upgrade",
+    "Sec-Websocket-Key",
+    "Sec-Websocket-Version",
+    "Sec-Websocket-Extensions",
+    "Sec-Websocket-Accept",
+}
+
+// FrameWriteTimeout bounds each write of a relayed frame, so a peer that has
+// stopped reading can't hold a relay open for ever.
+const FrameWriteTimeout = 10 * time.Second
+
+// StripHandshakeHeaders removes per-hop WebSocket handshake headers from h.
+func StripHandshakeHeaders(h http.Header) {
+    for _, k := range handshakeHeaders {
+        h.Del(k)
+    }
+}
+
+// RelayWebSocket pumps frames between ws and the tunnel until either side
+// closes. Frames read from ws are sent as TypeWSFrame messages for stream id;
+// frames arriving on in are written to ws, until in is closed. observe, if
+// non-nil, is called for every relayed frame with inbound=true for frames read
+// from ws.
+//
+// The read loop feeding in serves every stream on the connection, so it must
+// not block on it: it should close in once it fills up (the peer isn't
+// reading) and drop that stream's frames from then on.
+func RelayWebSocket(id uint32, ws *websocket.Conn, in <-chan WSFrame, send func(Message) error, observe func(f WSFrame, inbound bool)) {
+    defer ws.Close()
+
+    readDone := make(chan struct{})
+    go func() {
+        defer close(readDone)
+        for {
+            op, data, err := ws.ReadMessage()
+            if err != nil {
+                f := WSFrame{ID: id, OpCode: websocket.CloseMessage, Payload: closePayload(err)}
+                if observe != nil {
+                    observe(f, true)
+                }
+                send(Message{Type: TypeWSFrame, Frame: &f})
+                return
+            }
+            f := WSFrame{ID: id, OpCode: op, Payload: data}
+            if observe != nil {
+                observe(f, true)
+            }
+            if err := send(Message{Type: TypeWSFrame, Frame: &f}); err != nil {
+                return
+            }
+        }
+    }()
+
+    for {
+        select {
+        case f, ok := <-in:
+            if !ok {
+                return
+            }
+            if observe != nil {
+                observe(f, false)
+            }
+            if f.OpCode == websocket.CloseMessage {
+                ws.WriteControl(websocket.CloseMessage, f.Payload, time.Now().Add(time.Second))
+                return
+            }
+            ws.SetWriteDeadline(time.Now().Add(FrameWriteTimeout))
+            if err := ws.WriteMessage(f.OpCode, f.Payload); err != nil {
+                return
+            }
+        case <-readDone:
+            return
+        }
+    }
+}
+
+// closePayload converts a read error into the close frame to forward. Codes
+// that are reserved for local use (1005, 1006) are not sent on the wire.
+func closePayload(err error) []byte {
+    ce, ok := err.(*websocket.CloseError)
+    if !ok || ce.Code == websocket.CloseAbnormalClosure {
+        return websocket.FormatCloseMessage(websocket.CloseGoingAway, "")
+    }
+    if ce.Code == websocket.CloseNoStatusReceived {
+        return []byte{}
+    }
+    return websocket.FormatCloseMessage(ce.Code, ce.Text)
+}
@@ -1,9 +1,8 @@
-const token =
-  localStorage.getItem('portkeyToken') || prompt('Auth token (admin):');
-localStorage.setItem('portkeyToken', token);
+// The server's dashboard wants an admin token; the client's inspector needs
+// none, so only ask once the API refuses.
+let token = localStorage.getItem('portkeyToken') || '';
 
 const protocol = location.protocol === 'https:' ? 'wss:' : 'ws:';
-const ws = new WebSocket(`${protocol}//${location.host}/api/ws?token=${token}`);
 const tbody = document.querySelector('#log-table tbody');
 const filterInput = document.getElementById('filter');
 const tunnelSpan = document.getElementById('tunnel-list');
@@ -73,37 +72,53 @@ function toggleDetails(row, entry) {
   const cell = document.createElement('td');
   cell.colSpan = 6;
   row.querySelector('.arrow').textContent = '▼';
-  let bodyVal = entry.body;
-  try {
-    bodyVal = JSON.parse(entry.body);
-  } catch {}
+  const parse = body => {
+    try {
+      return JSON.parse(body);
+    } catch {
+      return body;
+    }
+  };
+  const shown = { headers: entry.headers, body: parse(entry.body) };
+  if (entry.response_headers || entry.response_body) {
+    shown.response = {
+      headers: entry.response_headers,
+      body: parse(entry.response_body),
+    };
+  }
   const pre = document.createElement('pre');
-  pre.textContent = JSON.stringify(
-    { headers: entry.headers, body: bodyVal },
-    null,
-    2
-  );
+  pre.textContent = JSON.stringify(shown, null, 2);
   cell.appendChild(pre);
   detail.appendChild(cell);
   row.after(detail);
 }
 
-// initial load (fetch latest logs)
-fetch(`/api/requests?token=${token}`)
-  .then(r => r.json())
-  .then(arr => {
-    arr.slice(-showCount).forEach(addRow);
+function api(path) {
+  return fetch(`${path}?token=${encodeURIComponent(token)}`).then(r => {
+    if (r.status === 403) {
+      const asked = prompt('Auth token (admin):');
+      if (asked === null) throw new Error('no auth token');
+      token = asked;
+      localStorage.setItem('portkeyToken', token);
+      return api(path);
+    }
+    return r.json();
   });
+}
 
-// live updates
-ws.onmessage = evt => addRow(JSON.parse(evt.data));
-ws.onerror = () => console.error('WebSocket error');
+// initial load (fetch latest logs), then live updates
+api('/api/requests').then(arr => {
+  arr.slice(-showCount).forEach(addRow);
+  const ws = new WebSocket(
+    `${protocol}//${location.host}/api/ws?token=${encodeURIComponent(token)}`
+  );
+  ws.onmessage = evt => addRow(JSON.parse(evt.data));
+  ws.onerror = () => console.error('WebSocket error');
+});
 
 // tunnel list poll
 setInterval(() => {
-  fetch(`/api/tunnels?token=${token}`)
-    .then(r => r.json())
-    .then(arr => {
-      tunnelSpan.textContent = `Tunnels: ${arr.join(', ')}`;
-    });
+  api('/api/tunnels').then(arr => {
+    tunnelSpan.textContent = `Tunnels: ${arr.join(', ')}`;
+  });
 }, 5000);
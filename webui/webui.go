@@ -0,0 +1,10 @@
+// Package webui is the request log dashboard: served from disk by the server
+// at /ui/, and embedded in the client for its local inspector.
+package webui
+
+import "embed"
+
+// Files holds index.html and app.js.
+//
+//go:embed index.html app.js
+var Files embed.FS